@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/consumer"
+	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/edge"
+	flag2 "github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/resync"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/token"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// edge serves rendered configs like the Cloudflare Worker, from a kv store that is fed by the provisioning topics
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	// postgres connection string
+	dsn := os.Getenv("DSN")
+	if dsn == "" {
+		log.Fatal().Msgf("postgres DSN is empty")
+	}
+	// port for config requests
+	apiPort := os.Getenv("API_PORT")
+	if apiPort == "" {
+		apiPort = "8080"
+	}
+	// port for prometheus
+	metricsPort := os.Getenv("METRICS_PORT")
+	if metricsPort == "" {
+		metricsPort = "8081"
+	}
+	metricsPath := os.Getenv("METRICS_PATH")
+	if metricsPath == "" {
+		metricsPath = "/metrics"
+	}
+	// memory or disk, memory stores are filled from postgres on startup and kept up to date by the provisioning topics
+	store := os.Getenv("STORE")
+	if store == "" {
+		store = "memory"
+	}
+	// directory for the disk store
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "/var/lib/vex"
+	}
+
+	// every replica needs every provisioning event, so each replica must use its own consumer group
+	group := os.Getenv("GROUP")
+	if group == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not get hostname")
+		}
+		group = "vex-edge-" + hostname
+	}
+	topics := os.Getenv("TOPICS")
+	if topics == "" {
+		topics = "vex-provision,vex-deprovision,vex-provision-token,vex-deprovision-token"
+	}
+	brokers := os.Getenv("BROKERS")
+	if brokers == "" {
+		brokers = "kafka-clusterip.kafka.svc.cluster.local:9092"
+	}
+
+	//	initialize database connection
+	database, err := db.InitDB(context.Background(), dsn)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	accountStore, err := account.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	projectStore, err := project.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	flagStore, err := flag2.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	tokenStore, err := token.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+
+	// base64 encoded Ed25519 seed and key id used to sign rendered configs, signing is disabled if empty
+	signingKey := os.Getenv("SIGNING_KEY")
+	signingKeyID := os.Getenv("SIGNING_KEY_ID")
+	var signer *signing.Signer
+	if signingKey != "" {
+		signer, err = signing.NewSigner(signingKeyID, signingKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid signing key")
+		}
+		signingStore, err := signing.NewPostgresStore(database)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		// publish the public key before signing anything with it
+		if err = signingStore.Save(context.Background(), signer.Key()); err != nil {
+			log.Fatal().Err(err).Msg("could not save signing key")
+		}
+	}
+
+	// base64 encoded key used to decrypt SECRET flags, must match the server SECRET_KEY
+	secretKey := os.Getenv("SECRET_KEY")
+	var secrets *secret.Cipher
+	if secretKey != "" {
+		secrets, err = secret.NewCipher(secretKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid secret key")
+		}
+	}
+
+	var projects, tokens kv.Store
+	switch store {
+	case "memory":
+		projects, tokens = kv.NewMemoryStore(), kv.NewMemoryStore()
+	case "disk":
+		projects, err = kv.NewDiskStore(filepath.Join(dataDir, "projects"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create project store")
+		}
+		tokens, err = kv.NewDiskStore(filepath.Join(dataDir, "tokens"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create token store")
+		}
+	default:
+		log.Fatal().Str("store", store).Msg("unknown store")
+	}
+
+	renderer := provisioner.NewRenderer(projectStore, flagStore, secrets)
+	kvProvisioner := provisioner.NewKVProvisioner(projects, tokens, renderer, tokenStore, signer)
+
+	// the consumer group resumes from its committed offsets, so a memory store is filled with every project and token first.
+	// Changes made during the bootstrap are after the committed offsets and are consumed next.
+	if store == "memory" {
+		resyncer := provisioner.NewResyncer(kvProvisioner, accountStore, projectStore, tokenStore, resync.NewMemoryStore(), 8)
+		progress, err := resyncer.Resync(context.Background(), "edge-bootstrap")
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not bootstrap store")
+		}
+		if progress.Failed > 0 {
+			log.Warn().Int64("failed", progress.Failed).Msg("some projects and tokens couldn't be bootstrapped")
+		}
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "vex-edge"
+	version, err := sarama.ParseKafkaVersion("3.1.0")
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	config.Version = version
+	// new consumer groups start from the oldest retained event to fill the store
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	c := consumer.NewConsumer(false)
+	if err := c.HandleProvisioner(kvProvisioner, strings.Split(topics, ",")); err != nil {
+		log.Fatal().Err(err).Msg("could not handle TOPICS")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := sarama.NewConsumerGroup(strings.Split(brokers, ","), group, config)
+	if err != nil {
+		log.Panic().Err(err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	log.Debug().Str("group", group).Str("store", store).Msg("starting consume loop")
+	go func() {
+		defer wg.Done()
+
+		for {
+			if err := client.Consume(ctx, strings.Split(topics, ","), c); err != nil {
+				log.Panic().Err(err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			c.Reset()
+		}
+	}()
+
+	<-c.Ready()
+
+	// start promhttp listener on metrics port
+	m := chi.NewRouter()
+	m.Handle(metricsPath, promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", metricsPort), m); err != nil {
+			log.Fatal().Err(err)
+		}
+	}()
+
+	r := chi.NewRouter()
+	r.Use(middleware.Heartbeat("/healthz"))
+	r.Use(middleware.RealIP)
+	r.Handle("/*", edge.NewHandler(projects, tokens))
+	server := http.Server{
+		Addr:    fmt.Sprintf(":%s", apiPort),
+		Handler: r,
+	}
+	go func() {
+		log.Debug().Msgf("edge listening on :%s", apiPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	s := <-sigs
+	log.Debug().Str("signal", s.String()).Msg("received signal")
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Error().Err(err).Msg("error shutting down edge server")
+	}
+	cancel()
+	wg.Wait()
+	if err := client.Close(); err != nil {
+		log.Debug().Err(err)
+	}
+}
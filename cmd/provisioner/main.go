@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
-	"errors"
 	"flag"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/consumer"
 	"github.com/broswen/vex/internal/db"
 	flag2 "github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/notify"
 	"github.com/broswen/vex/internal/project"
 	"github.com/broswen/vex/internal/provisioner"
-	"github.com/broswen/vex/internal/stats"
+	"github.com/broswen/vex/internal/resync"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/signing"
 	"github.com/broswen/vex/internal/token"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,9 +24,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -52,6 +57,10 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err)
 	}
+	accountStore, err := account.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
 	projectStore, err := project.NewPostgresStore(database)
 	if err != nil {
 		log.Fatal().Err(err)
@@ -65,7 +74,119 @@ func main() {
 		log.Fatal().Err(err)
 	}
 
-	cloudflareProvisioner, err := provisioner.NewCloudflareProvisioner(cloudflareToken, cloudflareAccountId, projectKVNamespaceID, tokenKVNamespaceID, projectStore, flagStore, tokenStore)
+	// base64 encoded Ed25519 seed and key id used to sign rendered configs, signing is disabled if empty
+	// rotate keys by changing both values, the previous public key stays published until the next rotation
+	signingKey := os.Getenv("SIGNING_KEY")
+	signingKeyID := os.Getenv("SIGNING_KEY_ID")
+	var signer *signing.Signer
+	if signingKey != "" {
+		signer, err = signing.NewSigner(signingKeyID, signingKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid signing key")
+		}
+		signingStore, err := signing.NewPostgresStore(database)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		// publish the public key before signing anything with it
+		if err = signingStore.Save(context.Background(), signer.Key()); err != nil {
+			log.Fatal().Err(err).Msg("could not save signing key")
+		}
+		log.Debug().Str("kid", signer.ID()).Msg("signing rendered configs")
+	}
+
+	// base64 encoded key used to decrypt SECRET flags, must match the server SECRET_KEY
+	// SECRET flags are never provisioned if empty
+	secretKey := os.Getenv("SECRET_KEY")
+	var secrets *secret.Cipher
+	if secretKey != "" {
+		secrets, err = secret.NewCipher(secretKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid secret key")
+		}
+	}
+
+	// cloudflare, filesystem or redis
+	target := os.Getenv("PROVISIONER")
+	if target == "" {
+		target = "cloudflare"
+	}
+	// directory that the filesystem provisioner writes to
+	provisionDir := os.Getenv("PROVISION_DIR")
+	if provisionDir == "" {
+		provisionDir = "/var/lib/vex"
+	}
+	// redis url that the redis provisioner writes to, eg. redis://:password@localhost:6379/0
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379"
+	}
+
+	renderer := provisioner.NewRenderer(projectStore, flagStore, secrets)
+	// configs larger than SHARD_SIZE bytes are split into shards, sharding is disabled if empty
+	shardSize := 0
+	if size := os.Getenv("SHARD_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatal().Str("size", size).Msg("invalid shard size")
+		}
+		shardSize = n
+	}
+	// cloudflare writes within the window are sent in bulk requests, disabled if empty
+	var batchWindow time.Duration
+	if window := os.Getenv("CLOUDFLARE_BATCH_WINDOW"); window != "" {
+		batchWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid batch window")
+		}
+	}
+	// requests per second to the cloudflare API, defaults to 1200 per 5 minutes
+	var rateLimit float64
+	if limit := os.Getenv("CLOUDFLARE_RATE_LIMIT"); limit != "" {
+		rateLimit, err = strconv.ParseFloat(limit, 64)
+		if err != nil || rateLimit <= 0 {
+			log.Fatal().Str("limit", limit).Msg("invalid rate limit")
+		}
+	}
+	targetConfig := provisioner.TargetConfig{
+		CloudflareToken:      cloudflareToken,
+		CloudflareAccountID:  cloudflareAccountId,
+		ProjectKVNamespaceID: projectKVNamespaceID,
+		TokenKVNamespaceID:   tokenKVNamespaceID,
+		Dir:                  provisionDir,
+		RedisURL:             redisURL,
+		ShardSize:            shardSize,
+		BatchWindow:          batchWindow,
+		RateLimit:            rateLimit,
+	}
+	// comma separated names of targets that are provisioned in parallel instead of PROVISIONER, eg. us,eu,mirror
+	// each target is configured with TARGET_{NAME}_* variables that fall back to the variables above
+	var p provisioner.Provisioner
+	var composite *provisioner.CompositeProvisioner
+	if targets := os.Getenv("TARGETS"); targets != "" {
+		routes, err := provisioner.RoutesFromEnv(strings.Split(targets, ","), targetConfig, os.Getenv)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid targets")
+		}
+		composite, err = provisioner.NewRoutedTargets(routes, renderer, tokenStore, signer)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create targets")
+		}
+		p = composite
+		for _, r := range routes {
+			log.Debug().Str("target", r.Name).Str("provisioner", r.Target).Strs("accounts", r.Accounts).Msg("provisioning target")
+		}
+		target = "composite"
+	} else {
+		p, err = provisioner.NewTarget(target, targetConfig, renderer, tokenStore, signer)
+		if err != nil {
+			log.Fatal().Err(err).Str("provisioner", target).Msg("could not create provisioner")
+		}
+		log.Debug().Str("provisioner", target).Msg("provisioning target")
+	}
+	inventory, _ := p.(provisioner.Inventory)
+	// record provisioned project versions for the project status api
+	p = provisioner.NewStatusProvisioner(p, projectStore)
 
 	// port for prometheus
 	metricsPort := os.Getenv("METRICS_PORT")
@@ -90,67 +211,212 @@ func main() {
 	if brokers == "" {
 		brokers = "kafka-clusterip.kafka.svc.cluster.local:9092"
 	}
+	// messages that still fail after RETRY_ATTEMPTS are sent to the dead letter topic
+	deadLetterTopic := os.Getenv("DEAD_LETTER_TOPIC")
+	if deadLetterTopic == "" {
+		deadLetterTopic = "vex-dead-letter"
+	}
+	retryAttempts := 5
+	if attempts := os.Getenv("RETRY_ATTEMPTS"); attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil || n < 1 {
+			log.Fatal().Str("attempts", attempts).Msg("invalid retry attempts")
+		}
+		retryAttempts = n
+	}
+	// how often the provisioned keys are reconciled with the database, reconciliation is disabled if empty
+	var reconcileInterval time.Duration
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		reconcileInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid reconcile interval")
+		}
+	}
+	// provisioning messages for the same project within the window are coalesced into one render and KV write, disabled if empty
+	var coalesceWindow time.Duration
+	if window := os.Getenv("COALESCE_WINDOW"); window != "" {
+		coalesceWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid coalesce window")
+		}
+	}
+	// number of projects and tokens a resync provisions at a time
+	resyncConcurrency := 10
+	if concurrency := os.Getenv("RESYNC_CONCURRENCY"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n < 1 {
+			log.Fatal().Str("concurrency", concurrency).Msg("invalid resync concurrency")
+		}
+		resyncConcurrency = n
+	}
+	// kafka or postgres, postgres uses LISTEN and the provision_event table instead of the kafka topics
+	bus := os.Getenv("PROVISION_BUS")
+	if bus == "" {
+		bus = "kafka"
+	}
+	// how long handled postgres provision events are kept
+	provisionEventRetention := time.Hour * 24 * 7
+	if retention := os.Getenv("PROVISION_EVENT_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid provision event retention")
+		}
+		provisionEventRetention = d
+	}
+	// send dead lettered messages back to their topics and exit
+	replay := flag.Bool("replay", false, "replay messages from the dead letter topic")
+	// reconcile the provisioned keys with the database once and exit
+	reconcile := flag.Bool("reconcile", false, "reconcile the provisioned keys with the database")
+	// provision every project and token and exit, running the same resync again resumes it
+	resyncName := flag.String("resync", "", "name of a resync that provisions every project and token")
 	flag.Parse()
 
-	config := sarama.NewConfig()
-	config.ClientID = "vex-cloudflareProvisioner"
-	version, err := sarama.ParseKafkaVersion("3.1.0")
-	if err != nil {
-		log.Fatal().Err(err)
+	if *resyncName != "" {
+		checkpoints, err := resync.NewPostgresStore(database)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		resyncer := provisioner.NewResyncer(p, accountStore, projectStore, tokenStore, checkpoints, resyncConcurrency)
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer cancel()
+		progress, err := resyncer.Resync(ctx, *resyncName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not resync")
+		}
+		if progress.Failed > 0 {
+			log.Fatal().Int64("failed", progress.Failed).Msg("resync failed, run it again to retry")
+		}
+		return
 	}
-	config.Version = version
 
-	sarama.Logger = log2.New(os.Stdout, "[sarama] ", log2.LstdFlags)
-
-	consumer := NewConsumer(skipProvision == "true")
-	consumer.HandleFunc("vex-provision", func(message *sarama.ConsumerMessage) error {
-		log.Debug().Str("id", string(message.Value)).Msg("provisioning project")
-		stats.ProjectProvisioned.Inc()
-		return cloudflareProvisioner.ProvisionProject(context.Background(), &project.Project{ID: string(message.Value)})
-	})
-	consumer.HandleFunc("vex-deprovision", func(message *sarama.ConsumerMessage) error {
-		log.Debug().Str("id", string(message.Value)).Msg("deprovisioning project")
-		stats.ProjectDeprovisioned.Inc()
-		return cloudflareProvisioner.DeprovisionProject(context.Background(), &project.Project{ID: string(message.Value)})
-	})
-
-	consumer.HandleFunc("vex-provision-token", func(message *sarama.ConsumerMessage) error {
-		log.Debug().Str("id", string(message.Value)).Msg("provisioning token")
-		stats.ProjectProvisioned.Inc()
-		return cloudflareProvisioner.ProvisionToken(context.Background(), &token.Token{ID: string(message.Value)})
-	})
-	consumer.HandleFunc("vex-deprovision-token", func(message *sarama.ConsumerMessage) error {
-		log.Debug().Str("token_hash", hex.EncodeToString(message.Value)).Msg("deprovisioning token")
-		stats.ProjectDeprovisioned.Inc()
-		return cloudflareProvisioner.DeprovisionToken(context.Background(), &token.Token{TokenHash: message.Value})
-	})
+	if *replay {
+		if err := replayDeadLetters(strings.Split(brokers, ","), group, deadLetterTopic); err != nil {
+			log.Fatal().Err(err).Msg("could not replay dead letters")
+		}
+		return
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	client, err := sarama.NewConsumerGroup(strings.Split(brokers, ","), group, config)
-	if err != nil {
-		log.Panic().Err(err)
+	var reconciler *provisioner.Reconciler
+	if *reconcile || reconcileInterval > 0 {
+		switch {
+		case composite != nil:
+			// every target is reconciled with the accounts routed to it
+			reconciler, err = provisioner.NewRoutedReconciler(composite, renderer, accountStore, projectStore, tokenStore)
+			if err != nil {
+				log.Fatal().Err(err).Msg("targets can't be reconciled")
+			}
+		case inventory == nil:
+			log.Fatal().Str("provisioner", target).Msg("provisioner can't be reconciled")
+		default:
+			reconciler = provisioner.NewReconciler(p, inventory, renderer, accountStore, projectStore, tokenStore)
+		}
+	}
+	if *reconcile {
+		if _, err := reconciler.RunOnce(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("could not reconcile")
+		}
+		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	wg := sync.WaitGroup{}
-	wg.Add(1)
+	var closeConsumer func() error
 
-	log.Debug().Msg("starting consume loop")
-	go func() {
-		defer wg.Done()
+	switch bus {
+	case "kafka":
+		config := sarama.NewConfig()
+		config.ClientID = "vex-cloudflareProvisioner"
+		version, err := sarama.ParseKafkaVersion("3.1.0")
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		config.Version = version
+		config.Producer.Return.Successes = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+
+		sarama.Logger = log2.New(os.Stdout, "[sarama] ", log2.LstdFlags)
+
+		producer, err := sarama.NewSyncProducer(strings.Split(brokers, ","), config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create dead letter producer")
+		}
+
+		c := consumer.NewConsumer(skipProvision == "true")
+		if err := c.HandleProvisioner(p, strings.Split(topics, ",")); err != nil {
+			log.Fatal().Err(err).Msg("could not handle TOPICS")
+		}
+		c.Retry(retryAttempts, time.Second, time.Second*30)
+		c.DeadLetter(producer, deadLetterTopic)
+		c.Coalesce(coalesceWindow)
 
-		for {
-			if err := client.Consume(ctx, strings.Split(topics, ","), consumer); err != nil {
-				log.Panic().Err(err)
+		client, err := sarama.NewConsumerGroup(strings.Split(brokers, ","), group, config)
+		if err != nil {
+			log.Panic().Err(err)
+		}
+		closeConsumer = func() error {
+			if err := client.Close(); err != nil {
+				return err
 			}
-			if ctx.Err() != nil {
-				log.Error().Err(err).Msg("")
-				return
+			return producer.Close()
+		}
+
+		wg.Add(1)
+		log.Debug().Msg("starting consume loop")
+		go func() {
+			defer wg.Done()
+
+			for {
+				if err := client.Consume(ctx, strings.Split(topics, ","), c); err != nil {
+					log.Panic().Err(err)
+				}
+				if ctx.Err() != nil {
+					log.Error().Err(err).Msg("")
+					return
+				}
+				c.Reset()
+			}
+		}()
+
+		<-c.Ready()
+	case "postgres":
+		eventStore, err := notify.NewPostgresStore(database)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		handler := provisioner.NotifyHandler(p)
+		if skipProvision == "true" {
+			handler = func(ctx context.Context, e *notify.Event) error {
+				log.Debug().Int64("id", e.ID).Str("type", string(e.Type)).Msg("provisioning skipped")
+				return nil
 			}
-			consumer.ready = make(chan bool)
 		}
-	}()
+		// the group is the cursor name, replicas in the same group take turns holding a lock so events are handled once
+		listener := notify.NewListener(eventStore, group, handler)
+		closeConsumer = func() error { return nil }
 
-	<-consumer.ready
+		wg.Add(2)
+		log.Debug().Msg("starting listen loop")
+		go func() {
+			defer wg.Done()
+			if err := listener.Run(ctx, database); err != nil {
+				log.Error().Err(err).Msg("")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			listener.Prune(ctx, provisionEventRetention, time.Hour)
+		}()
+	default:
+		log.Fatal().Str("bus", bus).Msg("unknown provision bus")
+	}
+
+	if reconciler != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reconciler.Run(ctx, reconcileInterval)
+		}()
+	}
 
 	// start promhttp listener on metrics port
 	m := chi.NewRouter()
@@ -169,69 +435,67 @@ func main() {
 	}
 	cancel()
 	wg.Wait()
-	if err := client.Close(); err != nil {
+	if err := closeConsumer(); err != nil {
 		log.Debug().Err(err)
 	}
 }
 
-func NewConsumer(skip bool) *Consumer {
-	return &Consumer{
-		ready:    make(chan bool),
-		skip:     skip,
-		handlers: make(map[string]MessageHandler),
+// replayDeadLetters sends the messages in the dead letter topic back to their topics.
+// Replayed offsets are committed with the group, so each message is only replayed once.
+func replayDeadLetters(brokers []string, group, topic string) error {
+	config := sarama.NewConfig()
+	config.ClientID = "vex-cloudflareProvisioner"
+	version, err := sarama.ParseKafkaVersion("3.1.0")
+	if err != nil {
+		return err
 	}
-}
-
-type MessageHandler func(message *sarama.ConsumerMessage) error
-
-type Consumer struct {
-	ready chan bool
-	// whether in dev mode and shouldn't actually provision anything
-	skip     bool
-	handlers map[string]MessageHandler
-}
+	config.Version = version
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
 
-func (c *Consumer) Handle(message *sarama.ConsumerMessage) error {
-	for k, f := range c.handlers {
-		if message.Topic == k {
-			if c.skip {
-				log.Debug().Str("topic", message.Topic).Str("value", string(message.Value)).Msg("provisioning skipped")
-				return nil
-			}
-			return f(message)
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	until := make(map[int32]int64)
+	for _, partition := range partitions {
+		offset, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
 		}
+		until[partition] = offset
 	}
-	return errors.New("no matching handler: " + message.Topic)
-}
-
-func (c *Consumer) HandleFunc(topic string, f MessageHandler) {
-	c.handlers[topic] = f
-}
-
-func (c *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	close(c.ready)
-	return nil
-}
 
-func (c *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
-	return nil
-}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(group+"-replay", client)
+	if err != nil {
+		return err
+	}
+	defer consumerGroup.Close()
 
-func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for {
-		select {
-		case message, ok := <-claim.Messages():
-			if !ok {
-				return nil
-			}
-			err := c.Handle(message)
-			if err != nil {
-				log.Debug().Err(err)
-				continue
-			}
-			session.MarkMessage(message, "")
-		case <-session.Context().Done():
-			return nil
+	replayer := consumer.NewReplayer(producer, until)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-replayer.Done()
+		cancel()
+	}()
+	log.Debug().Str("topic", topic).Msg("replaying dead letters")
+	for ctx.Err() == nil {
+		if err := consumerGroup.Consume(ctx, []string{topic}, replayer); err != nil {
+			return err
 		}
 	}
+	log.Debug().Str("topic", topic).Msg("replayed dead letters")
+	return nil
 }
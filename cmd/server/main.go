@@ -6,10 +6,17 @@ import (
 	"github.com/broswen/vex/internal/account"
 	"github.com/broswen/vex/internal/api"
 	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/event"
 	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/notify"
+	"github.com/broswen/vex/internal/outbox"
 	"github.com/broswen/vex/internal/project"
 	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/stream"
 	"github.com/broswen/vex/internal/token"
+	"github.com/broswen/vex/internal/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
@@ -18,7 +25,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -65,12 +74,87 @@ func main() {
 	if tokenDeprovisionTopic == "" {
 		tokenDeprovisionTopic = "vex-deprovision-token"
 	}
+	// CloudEvents for every account, project, flag and token change
+	changesTopic := os.Getenv("CHANGES_TOPIC")
+	if changesTopic == "" {
+		changesTopic = "vex-changes"
+	}
+
+	// kafka, postgres or inprocess
+	// postgres sends provisioning events with pg_notify instead of the kafka topics
+	// inprocess provisions from the server with a worker pool, without a provisioner
+	bus := os.Getenv("PROVISION_BUS")
+	if bus == "" {
+		bus = "kafka"
+	}
+	// the inprocess provisioner target and its settings, see cmd/provisioner
+	target := os.Getenv("PROVISIONER")
+	if target == "" {
+		target = "cloudflare"
+	}
+	targetConfig := provisioner.TargetConfig{
+		CloudflareToken:      os.Getenv("CLOUDFLARE_API_TOKEN"),
+		CloudflareAccountID:  os.Getenv("CLOUDFLARE_ACCOUNT_ID"),
+		ProjectKVNamespaceID: os.Getenv("PROJECT_KV_NAMESPACE_ID"),
+		TokenKVNamespaceID:   os.Getenv("TOKEN_KV_NAMESPACE_ID"),
+		Dir:                  os.Getenv("PROVISION_DIR"),
+		RedisURL:             os.Getenv("REDIS_URL"),
+	}
+	if targetConfig.Dir == "" {
+		targetConfig.Dir = "/var/lib/vex"
+	}
+	if targetConfig.RedisURL == "" {
+		targetConfig.RedisURL = "redis://localhost:6379"
+	}
+	// configs larger than SHARD_SIZE bytes are split into shards by the inprocess provisioner, sharding is disabled if empty
+	if size := os.Getenv("SHARD_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatal().Str("size", size).Msg("invalid shard size")
+		}
+		targetConfig.ShardSize = n
+	}
+	// changes that would render a config larger than MAX_CONFIG_SIZE bytes are rejected,
+	// it defaults to a single KV value or MaxShards shards of SHARD_SIZE
+	maxConfigSize := provisioner.MaxConfigSize(targetConfig.ShardSize)
+	if size := os.Getenv("MAX_CONFIG_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatal().Str("size", size).Msg("invalid max config size")
+		}
+		maxConfigSize = n
+	}
+	provisionWorkers := 4
+	if workers := os.Getenv("PROVISION_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 1 {
+			log.Fatal().Str("workers", workers).Msg("invalid provision workers")
+		}
+		provisionWorkers = n
+	}
 
 	brokers := os.Getenv("BROKERS")
 	if brokers == "" {
 		brokers = "kafka-clusterip.kafka.svc.cluster.local:9092"
 	}
 
+	// base64 encoded Ed25519 seed and key id used to sign configs that are provisioned inprocess, see cmd/provisioner
+	signingKey := os.Getenv("SIGNING_KEY")
+	signingKeyID := os.Getenv("SIGNING_KEY_ID")
+
+	// base64 encoded 32 byte key that SECRET flags are encrypted with at rest, SECRET flags are disabled if empty
+	secretKey := os.Getenv("SECRET_KEY")
+
+	// how long config events are kept for clients that reconnect to the event stream
+	eventRetention := time.Hour * 24
+	if retention := os.Getenv("EVENT_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid event retention")
+		}
+		eventRetention = d
+	}
+
 	//Cloudflare Access Application policy AUD
 	policyAUD := os.Getenv("POLICY_AUD")
 	//Cloudflare Access team domain <team>.cloudflareaccess.com
@@ -97,13 +181,106 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err)
 	}
+	signingStore, err := signing.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+
+	webhookStore, err := webhook.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+	eventStore, err := stream.NewPostgresStore(database)
+	if err != nil {
+		log.Fatal().Err(err)
+	}
+
+	var secrets *secret.Cipher
+	if secretKey != "" {
+		secrets, err = secret.NewCipher(secretKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid secret key")
+		}
+	}
+
+	publisher := event.Multi{webhook.NewPublisher(webhookStore)}
+	renderer := provisioner.NewRenderer(projectStore, flagStore, secrets)
+	// configs are rendered in the transactions that change them, so provisioning reads them from one row
+	projectStore.RenderWith(renderer.RenderDoc)
+	flagStore.RenderWith(renderer.RenderDoc)
+	var busProvisioner provisioner.Provisioner
+	switch bus {
+	case "kafka":
+		busProvisioner, err = provisioner.NewKafkaProvisioner(provisionTopic, deprovisionTopic, tokenProvisionTopic, tokenDeprovisionTopic, brokers)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		// change events are only published to kafka
+		changesPublisher, err := event.NewKafkaPublisher(changesTopic, brokers)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		publisher = append(publisher, changesPublisher)
+	case "postgres":
+		provisionEventStore, err := notify.NewPostgresStore(database)
+		if err != nil {
+			log.Fatal().Err(err)
+		}
+		busProvisioner = provisioner.NewPostgresProvisioner(provisionEventStore)
+	case "inprocess":
+		var signer *signing.Signer
+		if signingKey != "" {
+			signer, err = signing.NewSigner(signingKeyID, signingKey)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid signing key")
+			}
+			// publish the public key before signing anything with it
+			if err = signingStore.Save(context.Background(), signer.Key()); err != nil {
+				log.Fatal().Err(err).Msg("could not save signing key")
+			}
+		}
+		p, err := provisioner.NewTarget(target, targetConfig, renderer, tokenStore, signer)
+		if err != nil {
+			log.Fatal().Err(err).Str("provisioner", target).Msg("could not create provisioner")
+		}
+		pool := provisioner.NewPoolProvisioner(provisioner.NewStatusProvisioner(p, projectStore), provisionWorkers, 100)
+		defer pool.Close()
+		busProvisioner = pool
+	default:
+		log.Fatal().Str("bus", bus).Msg("unknown provision bus")
+	}
+
+	hub := stream.NewHub(eventStore)
 
-	provisioner, err := provisioner.NewKafkaProvisioner(provisionTopic, deprovisionTopic, tokenProvisionTopic, tokenDeprovisionTopic, brokers)
+	outboxStore, err := outbox.NewPostgresStore(database)
 	if err != nil {
 		log.Fatal().Err(err)
 	}
+	// changes are provisioned from the outbox, handlers only provision ?sync=true requests
+	relay := outbox.NewRelay(outboxStore, provisioner.OutboxHandler(provisioner.NewStreamProvisioner(busProvisioner, renderer, eventStore)))
 
 	eg := errgroup.Group{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// fan out config events from every replica to event stream subscribers
+	eg.Go(func() error {
+		return hub.Listen(ctx, database)
+	})
+	eg.Go(func() error {
+		return hub.Prune(ctx, eventRetention, time.Hour)
+	})
+
+	// send every committed change to the provision bus, replicas claim messages with SKIP LOCKED
+	eg.Go(func() error {
+		return relay.Run(ctx, database)
+	})
+
+	// deliver queued webhooks, replicas claim deliveries with SKIP LOCKED so each delivery is only sent once
+	webhookWorker := webhook.NewWorker(webhookStore, webhook.NewClient(time.Second*10), secrets, 50)
+	eg.Go(func() error {
+		return webhookWorker.Run(ctx, time.Second)
+	})
 
 	// start promhttp listener on metrics port
 	m := chi.NewRouter()
@@ -117,7 +294,16 @@ func main() {
 		Project:     projectStore,
 		Flag:        flagStore,
 		Token:       tokenStore,
-		Provisioner: provisioner,
+		Provisioner: provisioner.NewSyncProvisioner(busProvisioner),
+		// ?sync=true only waits for provisioning when it happens in process
+		SyncProvisioning: bus == "inprocess",
+		SigningKey:       signingStore,
+		Webhook:          webhookStore,
+		Publisher:        publisher,
+		Renderer:         renderer,
+		Events:           hub,
+		Secrets:          secrets,
+		MaxConfigSize:    maxConfigSize,
 	}
 
 	accessClient := api.NewAccessClient(teamDomain, policyAUD)
@@ -158,6 +344,7 @@ func main() {
 		signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM)
 		sig := <-sigint
 		log.Debug().Str("signal", sig.String()).Msg("received signal")
+		cancel()
 
 		var err error
 		log.Debug().Msg("shutting down admin server")
@@ -3,6 +3,7 @@ package account
 import (
 	"context"
 	"github.com/stretchr/testify/mock"
+	"time"
 )
 
 type MockStore struct {
@@ -33,6 +34,11 @@ func (m *MockStore) List(ctx context.Context, limit, offset int64) ([]*Account,
 	return args.Get(0).([]*Account), args.Error(1)
 }
 
+func (m *MockStore) ListAfter(ctx context.Context, createdOn time.Time, id string, limit int64) ([]*Account, error) {
+	args := m.Called(ctx, createdOn, id, limit)
+	return args.Get(0).([]*Account), args.Error(1)
+}
+
 func (m *MockStore) Delete(ctx context.Context, id string) error {
 	args := m.Called(ctx, id)
 	return args.Error(0)
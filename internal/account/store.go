@@ -3,6 +3,7 @@ package account
 import (
 	"context"
 	"github.com/broswen/vex/internal/db"
+	"time"
 )
 
 type Store interface {
@@ -10,6 +11,7 @@ type Store interface {
 	Update(ctx context.Context, a *Account) (*Account, error)
 	Get(ctx context.Context, id string) (*Account, error)
 	List(ctx context.Context, limit, offset int64) ([]*Account, error)
+	ListAfter(ctx context.Context, createdOn time.Time, id string, limit int64) ([]*Account, error)
 	Delete(ctx context.Context, id string) error
 }
 
@@ -73,7 +75,35 @@ func (store *PostgresStore) Get(ctx context.Context, id string) (*Account, error
 }
 
 func (store *PostgresStore) List(ctx context.Context, limit, offset int64) ([]*Account, error) {
-	rows, err := store.db.Query(ctx, `SELECT id, account_name, account_description, created_on, modified_on FROM account LIMIT $1 OFFSET $2;`, limit, offset)
+	rows, err := store.db.Query(ctx, `SELECT id, account_name, account_description, created_on, modified_on FROM account ORDER BY created_on, id LIMIT $1 OFFSET $2;`, limit, offset)
+	err = db.PgError(err)
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			return nil, ErrAccountNotFound{err}
+		case db.ErrInvalidData:
+			return nil, ErrInvalidData{err}
+		default:
+			return nil, ErrUnknown{err}
+		}
+	}
+
+	defer rows.Close()
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		a := &Account{}
+		err = rows.Scan(&a.ID, &a.Name, &a.Description, &a.CreatedOn, &a.ModifiedOn)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+// ListAfter lists accounts ordered by (created_on, id) that sort after the given cursor
+func (store *PostgresStore) ListAfter(ctx context.Context, createdOn time.Time, id string, limit int64) ([]*Account, error) {
+	rows, err := store.db.Query(ctx, `SELECT id, account_name, account_description, created_on, modified_on FROM account WHERE (created_on, id) > ($1, $2::uuid) ORDER BY created_on, id LIMIT $3;`, createdOn, id, limit)
 	err = db.PgError(err)
 	if err != nil {
 		switch err {
@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/event"
 	"net/http"
 )
 
@@ -20,6 +21,7 @@ func (api *API) CreateAccount() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		api.publish(r.Context(), event.New(event.AccountCreated, newAccount.ID, "", nil, newAccount))
 
 		err = writeOK(w, http.StatusOK, newAccount)
 		if err != nil {
@@ -46,12 +48,19 @@ func (api *API) UpdateAccount() http.HandlerFunc {
 
 		a.ID = accountId
 
+		before, err := api.Account.Get(r.Context(), accountId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
 		updatedAccount, err := api.Account.Update(r.Context(), a)
 
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
+		api.publish(r.Context(), event.New(event.AccountUpdated, accountId, "", before, updatedAccount))
 
 		err = writeOK(w, http.StatusOK, updatedAccount)
 		if err != nil {
@@ -104,11 +113,17 @@ func (api *API) DeleteAccount() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		before, err := api.Account.Get(r.Context(), accountId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		err = api.Account.Delete(r.Context(), accountId)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
+		api.publish(r.Context(), event.New(event.AccountDeleted, accountId, "", before, nil))
 		err = writeOK(w, http.StatusOK, &struct{ id string }{id: accountId})
 		if err != nil {
 			writeErr(w, nil, err)
@@ -59,6 +59,13 @@ func TestUpdateAccountHandler(t *testing.T) {
 	req.WithContext(context.Background())
 	rr := httptest.NewRecorder()
 	store := account.NewMockStore()
+	store.On("Get", mock.Anything, accountID).Return(&account.Account{
+		ID:          accountID,
+		Name:        "old",
+		Description: "old account",
+		CreatedOn:   now,
+		ModifiedOn:  now,
+	}, nil)
 	store.On("Update", mock.Anything, &account.Account{
 		ID:          accountID,
 		Name:        "test",
@@ -4,10 +4,15 @@ import (
 	"net/http"
 
 	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/event"
 	"github.com/broswen/vex/internal/flag"
 	"github.com/broswen/vex/internal/project"
 	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/stream"
 	"github.com/broswen/vex/internal/token"
+	"github.com/broswen/vex/internal/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -19,6 +24,20 @@ type API struct {
 	Flag        flag.Store
 	Token       token.Store
 	Provisioner provisioner.Provisioner
+	SigningKey  signing.Store
+	Webhook     webhook.Store
+	// Publisher publishes flag and project change events, events are dropped if it is nil
+	Publisher event.Publisher
+	// Renderer renders project configs to compute their content hashes
+	Renderer *provisioner.Renderer
+	// Events streams config changes to clients
+	Events *stream.Hub
+	// Secrets encrypts SECRET flags and webhook secrets at rest, SECRET flags are disabled if it is nil
+	Secrets *secret.Cipher
+	// MaxConfigSize rejects changes that would render a larger config, there is no limit if it is 0
+	MaxConfigSize int
+	// SyncProvisioning is true when Provisioner provisions in process, ?sync=true requests are rejected otherwise
+	SyncProvisioning bool
 }
 
 func (api *API) AdminRouter(accessClient AccessClient) http.Handler {
@@ -28,6 +47,7 @@ func (api *API) AdminRouter(accessClient AccessClient) http.Handler {
 	r.Use(middleware.Logger)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
+	r.Use(api.syncSupported)
 	r.Use(CloudflareAccessVerifier(accessClient))
 	r.Use(CloudflareAccessIdentityLogger(accessClient))
 
@@ -46,10 +66,12 @@ func (api *API) Router() http.Handler {
 	r.Use(middleware.Logger)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
+	r.Use(api.syncSupported)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://vex.broswen.com", "http://localhost:3000", "http://localhost:8080"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "Authorization", "If-None-Match", "Last-Event-ID"},
+		ExposedHeaders:   []string{"ETag", "Vex-Provisioned"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -62,6 +84,8 @@ func (api *API) Router() http.Handler {
 		writeOK(w, http.StatusOK, "OK")
 	})
 
+	r.Get("/api/.well-known/jwks.json", api.JWKS())
+
 	//disable creating accounts through api for now
 	//r.Post("/accounts", CreateAccount(accountStore))
 	//r.Get("/accounts/", http.NotFound)
@@ -76,11 +100,25 @@ func (api *API) Router() http.Handler {
 		r.Put("/tokens/{tokenId}", api.RerollToken())
 		r.Delete("/tokens/{tokenId}", api.DeleteToken())
 
+		r.Get("/webhooks", api.ListWebhooks())
+		r.Post("/webhooks", api.CreateWebhook())
+		r.Get("/webhooks/{webhookId}", api.GetWebhook())
+		r.Put("/webhooks/{webhookId}", api.UpdateWebhook())
+		r.Delete("/webhooks/{webhookId}", api.DeleteWebhook())
+		r.Get("/webhooks/{webhookId}/deliveries", api.ListWebhookDeliveries())
+		r.Post("/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", api.RedeliverWebhook())
+
 		r.Post("/projects", api.CreateProject())
 		r.Get("/projects", api.ListProjects())
 		r.Put("/projects/{projectId}", api.UpdateProject())
 		r.Get("/projects/{projectId}", api.GetProject())
 		r.Delete("/projects/{projectId}", api.DeleteProject())
+		r.Get("/projects/{projectId}/version", api.GetProjectVersion())
+		r.Get("/projects/{projectId}/status", api.GetProjectStatus())
+		r.Get("/projects/{projectId}/events", api.StreamEvents())
+		r.Get("/projects/{projectId}/delta", api.GetDelta())
+		r.Post("/projects/{projectId}/payload-key", api.GeneratePayloadKey())
+		r.Delete("/projects/{projectId}/payload-key", api.DeletePayloadKey())
 
 		r.Post("/projects/{projectId}/flags", api.CreateFlag())
 		r.Put("/projects/{projectId}/flags", api.ReplaceFlags())
@@ -88,6 +126,8 @@ func (api *API) Router() http.Handler {
 		r.Put("/projects/{projectId}/flags/{flagId}", api.UpdateFlag())
 		r.Get("/projects/{projectId}/flags/{flagId}", api.GetFlag())
 		r.Delete("/projects/{projectId}/flags/{flagId}", api.DeleteFlag())
+		//POST so only tokens that aren't read only can reveal secrets
+		r.Post("/projects/{projectId}/flags/{flagId}/reveal", api.RevealFlag())
 	})
 
 	return r
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/broswen/vex/internal/flag"
+)
+
+// GetDelta returns the flags that were added, changed or removed since the version in the since query parameter.
+// The full config is returned if the delta can't be computed from the flag change history.
+func (api *API) GetDelta() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		var since int64
+		if s := r.URL.Query().Get("since"); s != "" {
+			since, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || since < 0 {
+				writeErr(w, nil, ErrBadRequest.WithError(errors.New("invalid since version")))
+				return
+			}
+		}
+		rendered, err := api.Renderer.Snapshot(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p := rendered.Project
+		if p.AccountID != accountId {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+
+		var delta *flag.Delta
+		if since == 0 || since < p.PrunedVersion || since > p.Version {
+			delta, err = flag.FullDelta(p.ID, p.Version, rendered.Flags)
+		} else {
+			var changes []*flag.Change
+			changes, err = api.Flag.ChangesSince(r.Context(), p.ID, since, p.Version)
+			if err != nil {
+				writeErr(w, nil, err)
+				return
+			}
+			delta, err = flag.NewDelta(p.ID, since, p.Version, changes, rendered.Flags, rendered.Hidden)
+		}
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, delta)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	provisioner2 "github.com/broswen/vex/internal/provisioner"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetDeltaHandler(t *testing.T) {
+	projectStore := project.NewMockStore()
+	//the project changed after the flags were read, the delta is for the version of the flags
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{
+		ID:            projectID,
+		AccountID:     accountID,
+		Version:       8,
+		PrunedVersion: 2,
+	}, nil)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, projectID).Return(&flag.Snapshot{
+		Version:       7,
+		PrunedVersion: 2,
+		Flags: []*flag.Flag{
+			{Key: "a", Type: flag.STRING, Value: "b"},
+			{Key: "c", Type: flag.STRING, Value: "d"},
+		},
+	}, nil)
+	flagStore.On("ChangesSince", mock.Anything, projectID, int64(5), int64(7)).Return([]*flag.Change{
+		{Version: 6, Key: "a", Type: flag.UPDATED},
+	}, nil)
+	app := &API{
+		Flag:     flagStore,
+		Renderer: provisioner2.NewRenderer(projectStore, flagStore, nil),
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/delta", app.GetDelta())
+
+	tests := []struct {
+		Since string
+		Full  bool
+	}{
+		{Since: "5", Full: false},
+		//history before version 2 was pruned
+		{Since: "1", Full: true},
+		{Since: "0", Full: true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/delta?since="+test.Since, nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		res := struct {
+			Data flag.Delta `json:"data"`
+		}{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		assert.Equal(t, test.Full, res.Data.Full)
+		assert.Equal(t, int64(7), res.Data.Version)
+		if test.Full {
+			assert.Len(t, res.Data.Added, 2)
+		} else {
+			assert.Len(t, res.Data.Changed, 1)
+			assert.Contains(t, res.Data.Changed, "a")
+		}
+	}
+	flagStore.AssertNumberOfCalls(t, "ChangesSince", 1)
+}
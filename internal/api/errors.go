@@ -5,6 +5,7 @@ import (
 	"github.com/broswen/vex/internal/account"
 	"github.com/broswen/vex/internal/flag"
 	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/webhook"
 	"net/http"
 )
 
@@ -14,6 +15,12 @@ var (
 	ErrBadRequest     = NewAPIError(http.StatusBadRequest, 9400, "bad request")
 	ErrNotFound       = NewAPIError(http.StatusNotFound, 9404, "not found")
 	ErrUnauthorized   = NewAPIError(http.StatusUnauthorized, 9401, "unauthorized")
+	// ErrSecretsDisabled is returned for SECRET flag operations when the server has no SECRET_KEY
+	ErrSecretsDisabled = NewAPIError(http.StatusBadRequest, 9410, "secret flags are not enabled")
+	// ErrProvisioning is returned for ?sync=true requests when the change was saved but couldn't be provisioned
+	ErrProvisioning = NewAPIError(http.StatusBadGateway, 9502, "changes were saved but could not be provisioned")
+	// ErrConfigTooLarge is returned when a change would render a config larger than the max config size
+	ErrConfigTooLarge = NewAPIError(http.StatusRequestEntityTooLarge, 9413, "config is too large")
 )
 
 type APIError struct {
@@ -40,11 +47,13 @@ func translateError(err error) *APIError {
 	switch err.(type) {
 	case account.ErrAccountNotFound,
 		project.ErrProjectNotFound,
-		flag.ErrFlagNotFound:
+		flag.ErrFlagNotFound,
+		webhook.ErrWebhookNotFound:
 		return ErrNotFound
 	case account.ErrInvalidData,
 		project.ErrInvalidData,
-		flag.ErrInvalidData:
+		flag.ErrInvalidData,
+		webhook.ErrInvalidData:
 		return ErrBadRequest.WithError(err)
 	case flag.ErrKeyNotUnique:
 		return ErrBadRequest.WithError(err)
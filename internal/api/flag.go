@@ -1,9 +1,14 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/broswen/vex/internal/event"
 	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
 	"github.com/broswen/vex/internal/stats"
 	"github.com/rs/zerolog/log"
 )
@@ -15,6 +20,11 @@ func (api *API) CreateFlag() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		wait, err := waitDuration(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		p, err := api.Project.Get(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -40,21 +50,39 @@ func (api *API) CreateFlag() http.HandlerFunc {
 			return
 		}
 
-		newFlag, err := api.Flag.Insert(r.Context(), f)
+		if err = api.validateNestedKeys(r.Context(), p, f); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 
-		if err != nil {
+		if err = api.encryptSecret(f, nil); err != nil {
 			writeErr(w, nil, err)
 			return
 		}
 
-		err = api.Provisioner.ProvisionProject(r.Context(), p)
+		if err = api.validateConfigSize(r.Context(), p, f); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
+		newFlag, err := api.Flag.Insert(r.Context(), f)
+
 		if err != nil {
-			log.Warn().Str("id", projectId).Err(err).Msg("could not provision project")
+			writeErr(w, nil, err)
+			return
 		}
 
+		provisionErr := api.provisionProject(r, p)
+		api.publish(r.Context(), event.New(event.FlagCreated, p.AccountID, p.ID, nil, flag.Mask(newFlag)))
+
 		stats.FlagCreated.Inc()
 
-		err = writeOK(w, http.StatusOK, newFlag)
+		api.waitProvisioned(w, r, projectId, wait)
+		if provisionErr != nil {
+			writeErr(w, flag.Mask(newFlag), provisionErr)
+			return
+		}
+		err = writeOK(w, http.StatusOK, flag.Mask(newFlag))
 		if err != nil {
 			writeErr(w, nil, err)
 			return
@@ -69,6 +97,11 @@ func (api *API) ReplaceFlags() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		wait, err := waitDuration(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		p, err := api.Project.Get(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -102,21 +135,53 @@ func (api *API) ReplaceFlags() http.HandlerFunc {
 			newFlags = append(newFlags, newFlag)
 		}
 
-		insertedFlags, err := api.Flag.ReplaceFlags(r.Context(), projectId, newFlags)
+		if p.RenderMode == project.NESTED {
+			if err = flag.ValidateNestedKeys(newFlags); err != nil {
+				writeErr(w, nil, ErrBadRequest.WithError(err))
+				return
+			}
+		}
+
+		oldFlags, err := api.Flag.All(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
+		stored := make(map[string]*flag.Flag, len(oldFlags))
+		for _, f := range oldFlags {
+			stored[f.Key] = f
+		}
+
+		for _, f := range newFlags {
+			if err = api.encryptSecret(f, stored[f.Key]); err != nil {
+				writeErr(w, nil, err)
+				return
+			}
+		}
+
+		if err = api.checkConfigSize(p, newFlags); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 
-		err = api.Provisioner.ProvisionProject(r.Context(), p)
+		insertedFlags, err := api.Flag.ReplaceFlags(r.Context(), projectId, newFlags)
 		if err != nil {
-			log.Warn().Str("id", projectId).Err(err).Msg("could not provision project")
+			writeErr(w, nil, err)
+			return
 		}
 
+		provisionErr := api.provisionProject(r, p)
+		api.publish(r.Context(), event.New(event.FlagsReplaced, p.AccountID, p.ID, maskFlags(oldFlags), maskFlags(insertedFlags)))
+
 		stats.FlagCreated.Add(float64(len(insertedFlags)))
 		stats.FlagDeleted.Add(float64(len(insertedFlags)))
 
-		err = writeOK(w, http.StatusOK, insertedFlags)
+		api.waitProvisioned(w, r, projectId, wait)
+		if provisionErr != nil {
+			writeErr(w, maskFlags(insertedFlags), provisionErr)
+			return
+		}
+		err = writeOK(w, http.StatusOK, maskFlags(insertedFlags))
 		if err != nil {
 			writeErr(w, nil, err)
 			return
@@ -136,6 +201,11 @@ func (api *API) UpdateFlag() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		wait, err := waitDuration(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		p, err := api.Project.Get(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -163,19 +233,43 @@ func (api *API) UpdateFlag() http.HandlerFunc {
 			return
 		}
 
-		updatedFlag, err := api.Flag.Update(r.Context(), f)
+		if err = api.validateNestedKeys(r.Context(), p, f); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
+		before, err := api.Flag.Get(r.Context(), flagId)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
-		err = api.Provisioner.ProvisionProject(r.Context(), p)
+
+		if err = api.encryptSecret(f, before); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
+		if err = api.validateConfigSize(r.Context(), p, f); err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
+		updatedFlag, err := api.Flag.Update(r.Context(), f)
 		if err != nil {
-			log.Warn().Str("id", projectId).Err(err).Msg("could not provision project")
+			writeErr(w, nil, err)
+			return
 		}
+		provisionErr := api.provisionProject(r, p)
+		api.publish(r.Context(), event.New(event.FlagUpdated, p.AccountID, p.ID, flag.Mask(before), flag.Mask(updatedFlag)))
 
 		stats.FlagUpdated.Inc()
 
-		err = writeOK(w, http.StatusOK, updatedFlag)
+		api.waitProvisioned(w, r, projectId, wait)
+		if provisionErr != nil {
+			writeErr(w, flag.Mask(updatedFlag), provisionErr)
+			return
+		}
+		err = writeOK(w, http.StatusOK, flag.Mask(updatedFlag))
 		if err != nil {
 			writeErr(w, nil, err)
 			return
@@ -201,7 +295,7 @@ func (api *API) ListFlags() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
-		err = writeOK(w, http.StatusOK, flags)
+		err = writeOK(w, http.StatusOK, maskFlags(flags))
 		if err != nil {
 			writeErr(w, nil, err)
 			return
@@ -221,6 +315,56 @@ func (api *API) GetFlag() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		err = writeOK(w, http.StatusOK, flag.Mask(f))
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// RevealFlag returns the decrypted value of a SECRET flag
+func (api *API) RevealFlag() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		flagId, err := flagId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		f, err := api.Flag.Get(r.Context(), flagId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if f.AccountID != accountId || f.ProjectID != projectId {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+		if f.Type != flag.SECRET {
+			writeErr(w, nil, ErrBadRequest.WithError(errors.New("flag is not a secret")))
+			return
+		}
+		if api.Secrets == nil {
+			writeErr(w, nil, ErrSecretsDisabled)
+			return
+		}
+		value, err := api.Secrets.Decrypt(f.Value)
+		if err != nil {
+			log.Error().Str("id", flagId).Err(err).Msg("could not decrypt secret flag")
+			writeErr(w, nil, ErrInternalServer)
+			return
+		}
+		f.Value = string(value)
 		err = writeOK(w, http.StatusOK, f)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -236,6 +380,11 @@ func (api *API) DeleteFlag() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
+		wait, err := waitDuration(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		p, err := api.Project.Get(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -246,18 +395,26 @@ func (api *API) DeleteFlag() http.HandlerFunc {
 			writeErr(w, nil, err)
 			return
 		}
-		err = api.Flag.Delete(r.Context(), flagId)
+		before, err := api.Flag.Get(r.Context(), flagId)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
-		err = api.Provisioner.ProvisionProject(r.Context(), p)
+		err = api.Flag.Delete(r.Context(), flagId)
 		if err != nil {
-			log.Warn().Str("id", projectId).Err(err).Msg("could not provision project")
+			writeErr(w, nil, err)
+			return
 		}
+		provisionErr := api.provisionProject(r, p)
+		api.publish(r.Context(), event.New(event.FlagDeleted, p.AccountID, p.ID, flag.Mask(before), nil))
 
 		stats.FlagDeleted.Inc()
 
+		api.waitProvisioned(w, r, projectId, wait)
+		if provisionErr != nil {
+			writeErr(w, &struct{ id string }{id: flagId}, provisionErr)
+			return
+		}
 		err = writeOK(w, http.StatusOK, &struct{ id string }{id: flagId})
 		if err != nil {
 			writeErr(w, nil, err)
@@ -265,3 +422,90 @@ func (api *API) DeleteFlag() http.HandlerFunc {
 		}
 	}
 }
+
+// validateNestedKeys checks that a new or updated flag doesn't conflict with the
+// other flag keys of a project that is rendered in NESTED mode
+func (api *API) validateNestedKeys(ctx context.Context, p *project.Project, f *flag.Flag) error {
+	if p.RenderMode != project.NESTED {
+		return nil
+	}
+	existing, err := api.Flag.All(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	flags := []*flag.Flag{f}
+	for _, e := range existing {
+		if e.ID != f.ID {
+			flags = append(flags, e)
+		}
+	}
+	if err = flag.ValidateNestedKeys(flags); err != nil {
+		return ErrBadRequest.WithError(err)
+	}
+	return nil
+}
+
+// validateConfigSize checks that the config of a project is still within MaxConfigSize with a new or updated flag
+func (api *API) validateConfigSize(ctx context.Context, p *project.Project, f *flag.Flag) error {
+	if api.MaxConfigSize == 0 {
+		return nil
+	}
+	existing, err := api.Flag.All(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	flags := []*flag.Flag{f}
+	for _, e := range existing {
+		if e.ID != f.ID && e.Key != f.Key {
+			flags = append(flags, e)
+		}
+	}
+	return api.checkConfigSize(p, flags)
+}
+
+// checkConfigSize checks that the configs rendered for flags are within MaxConfigSize
+func (api *API) checkConfigSize(p *project.Project, flags []*flag.Flag) error {
+	if api.MaxConfigSize == 0 {
+		return nil
+	}
+	size, err := api.Renderer.ConfigSize(p, flags)
+	if err != nil {
+		return ErrBadRequest.WithError(err)
+	}
+	if size > api.MaxConfigSize {
+		return ErrConfigTooLarge.WithError(fmt.Errorf("the rendered config would be %d bytes, the limit is %d bytes", size, api.MaxConfigSize))
+	}
+	return nil
+}
+
+// encryptSecret encrypts the value of a SECRET flag before it is stored.
+// A value of SecretMask is what responses show for the flag, so the ciphertext of the stored flag is kept instead.
+func (api *API) encryptSecret(f, stored *flag.Flag) error {
+	if f.Type != flag.SECRET {
+		return nil
+	}
+	if f.Value == flag.SecretMask {
+		if stored == nil || stored.Type != flag.SECRET {
+			return ErrBadRequest.WithError(fmt.Errorf("secret flag %s must have a value", f.Key))
+		}
+		f.Value = stored.Value
+		return nil
+	}
+	if api.Secrets == nil {
+		return ErrSecretsDisabled
+	}
+	value, err := api.Secrets.Encrypt([]byte(f.Value))
+	if err != nil {
+		return err
+	}
+	f.Value = value
+	return nil
+}
+
+func maskFlags(flags []*flag.Flag) []*flag.Flag {
+	masked := make([]*flag.Flag, 0, len(flags))
+	for _, f := range flags {
+		masked = append(masked, flag.Mask(f))
+	}
+	return masked
+}
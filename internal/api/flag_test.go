@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/broswen/vex/internal/event"
 	"github.com/broswen/vex/internal/flag"
 	"github.com/broswen/vex/internal/project"
 	provisioner2 "github.com/broswen/vex/internal/provisioner"
@@ -72,6 +75,124 @@ func TestCreateFlagHandler(t *testing.T) {
 	store.AssertExpectations(t)
 }
 
+func TestCreateFlagHandler_SyncProvisionError(t *testing.T) {
+	reqBody, err := json.Marshal(&flag.Flag{Key: "flag1", Type: flag.STRING, Value: "test"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags?sync=true", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{ID: projectID, AccountID: accountID, Version: 1}
+	p2 := &project.Project{ID: projectID, AccountID: accountID, Version: 2}
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil).Once()
+	projectStore.On("Get", mock.Anything, projectID).Return(p2, nil).Once()
+	store := flag.NewMockStore()
+	store.On("Insert", mock.Anything, mock.Anything).Return(&flag.Flag{ID: flagID, ProjectID: projectID, AccountID: accountID, Key: "flag1", Type: flag.STRING, Value: "test"}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	//the version written by the change is provisioned
+	provisioner.On("ProvisionProject", mock.MatchedBy(provisioner2.IsSync), p2).Return(errors.New("kv unavailable"))
+	app := &API{
+		Flag:             store,
+		Project:          projectStore,
+		Provisioner:      provisioner,
+		SyncProvisioning: true,
+	}
+	r := chi.NewRouter()
+	r.Use(app.syncSupported)
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	//the saved flag is still returned
+	assert.Contains(t, rr.Body.String(), flagID)
+	assert.Contains(t, rr.Body.String(), "kv unavailable")
+	provisioner.AssertExpectations(t)
+	projectStore.AssertExpectations(t)
+}
+
+func TestCreateFlagHandler_SyncUnsupported(t *testing.T) {
+	reqBody, err := json.Marshal(&flag.Flag{Key: "flag1", Type: flag.STRING, Value: "test"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags?sync=true", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	app := &API{}
+	r := chi.NewRouter()
+	r.Use(app.syncSupported)
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "PROVISION_BUS=inprocess")
+}
+
+func TestCreateFlagHandler_Wait(t *testing.T) {
+	reqBody, err := json.Marshal(&flag.Flag{Key: "flag1", Type: flag.STRING, Value: "test"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags?wait=5s", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{ID: projectID, AccountID: accountID}
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	projectStore.On("Status", mock.Anything, projectID).Return(&project.Status{ProjectID: projectID, DesiredVersion: 2, ProvisionedVersion: 2, Live: true}, nil)
+	store := flag.NewMockStore()
+	store.On("Insert", mock.Anything, mock.Anything).Return(&flag.Flag{ID: flagID, ProjectID: projectID, AccountID: accountID, Key: "flag1", Type: flag.STRING, Value: "test"}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
+	app := &API{
+		Flag:        store,
+		Project:     projectStore,
+		Provisioner: provisioner,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Vex-Provisioned"))
+	projectStore.AssertExpectations(t)
+}
+
+func TestCreateFlagHandler_InvalidWait(t *testing.T) {
+	reqBody, err := json.Marshal(&flag.Flag{Key: "flag1", Type: flag.STRING, Value: "test"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags?wait=1h", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	app := &API{
+		Flag:    flag.NewMockStore(),
+		Project: project.NewMockStore(),
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCreateFlagHandler_ConfigTooLarge(t *testing.T) {
+	reqBody, err := json.Marshal(&flag.Flag{Key: "flag2", Type: flag.STRING, Value: strings.Repeat("a", 100)})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	store := flag.NewMockStore()
+	store.On("All", mock.Anything, projectID).Return([]*flag.Flag{
+		{ID: flagID, ProjectID: projectID, AccountID: accountID, Key: "flag1", Type: flag.STRING, Value: "test"},
+	}, nil)
+	app := &API{
+		Flag:          store,
+		Project:       projectStore,
+		Renderer:      provisioner2.NewRenderer(projectStore, store, nil),
+		MaxConfigSize: 200,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Contains(t, rr.Body.String(), "config is too large")
+	store.AssertExpectations(t)
+}
+
 func TestCreateFlagHandler_InvalidType(t *testing.T) {
 	f1 := &flag.Flag{
 		Key:   "flag1",
@@ -144,6 +265,55 @@ func TestCreateFlagHandler_InvalidValue(t *testing.T) {
 	store.AssertExpectations(t)
 }
 
+func TestCreateFlagHandler_NestedKeyConflict(t *testing.T) {
+	f1 := &flag.Flag{
+		Key:   "db.pool",
+		Type:  "NUMBER",
+		Value: "10",
+	}
+	reqBody, err := json.Marshal(f1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{
+		ID:          projectID,
+		AccountID:   accountID,
+		Name:        "test",
+		Description: "test",
+		RenderMode:  project.NESTED,
+		CreatedOn:   time.Time{},
+		ModifiedOn:  time.Time{},
+	}
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	store := flag.NewMockStore()
+	store.On("All", mock.Anything, projectID).Return([]*flag.Flag{
+		{
+			ID:         flagID,
+			ProjectID:  projectID,
+			AccountID:  accountID,
+			Key:        "db",
+			Type:       flag.STRING,
+			Value:      "test",
+			CreatedOn:  now,
+			ModifiedOn: now,
+		},
+	}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	app := &API{
+		Flag:        store,
+		Project:     projectStore,
+		Provisioner: provisioner,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+	store.AssertExpectations(t)
+}
+
 func TestReplaceFlagsHandler(t *testing.T) {
 	flags := []*flag.Flag{
 		{
@@ -174,6 +344,7 @@ func TestReplaceFlagsHandler(t *testing.T) {
 	projectStore := project.NewMockStore()
 	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
 	store := flag.NewMockStore()
+	store.On("All", mock.Anything, projectID).Return([]*flag.Flag{}, nil)
 	store.On("ReplaceFlags", mock.Anything, projectID, mock.Anything).Return([]*flag.Flag{
 		{
 			ID:         flagID,
@@ -309,6 +480,14 @@ func TestUpdateFlagHandler(t *testing.T) {
 	projectStore := project.NewMockStore()
 	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
 	store := flag.NewMockStore()
+	store.On("Get", mock.Anything, flagID).Return(&flag.Flag{
+		ID:        flagID,
+		ProjectID: projectID,
+		AccountID: accountID,
+		Key:       "flag1",
+		Type:      flag.STRING,
+		Value:     "old",
+	}, nil)
 	store.On("Update", mock.Anything, &flag.Flag{
 		ID:        flagID,
 		ProjectID: projectID,
@@ -328,16 +507,23 @@ func TestUpdateFlagHandler(t *testing.T) {
 	}, nil)
 	provisioner := provisioner2.NewMockProvisioner()
 	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
+	publisher := event.NewMockPublisher()
+	publisher.On("Publish", mock.Anything, mock.MatchedBy(func(e *event.Event) bool {
+		return e.Type == event.FlagUpdated && e.ProjectID == projectID &&
+			e.Before.(*flag.Flag).Value == "old" && e.After.(*flag.Flag).Value == "test"
+	})).Return(nil)
 	app := &API{
 		Flag:        store,
 		Project:     projectStore,
 		Provisioner: provisioner,
+		Publisher:   publisher,
 	}
 	r := chi.NewRouter()
 	r.Put("/accounts/{accountId}/projects/{projectId}/flags/{flagId}", app.UpdateFlag())
 	r.ServeHTTP(rr, req)
 	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
 	store.AssertExpectations(t)
+	publisher.AssertExpectations(t)
 }
 
 func TestDeleteFlagHandler(t *testing.T) {
@@ -356,6 +542,7 @@ func TestDeleteFlagHandler(t *testing.T) {
 	projectStore := project.NewMockStore()
 	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
 	store := flag.NewMockStore()
+	store.On("Get", mock.Anything, flagID).Return(&flag.Flag{ID: flagID, ProjectID: projectID, AccountID: accountID}, nil)
 	store.On("Delete", mock.Anything, flagID).Return(nil)
 	provisioner := provisioner2.NewMockProvisioner()
 	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
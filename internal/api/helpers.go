@@ -1,14 +1,20 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/provisioner"
 	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
 )
 
 type V1Response struct {
@@ -69,6 +75,22 @@ func projectId(r *http.Request) (string, error) {
 	return projectId, nil
 }
 
+func webhookId(r *http.Request) (string, error) {
+	webhookId := chi.URLParam(r, "webhookId")
+	if len(webhookId) != 36 {
+		return webhookId, ErrBadRequest.WithError(errors.New("invalid webhook id"))
+	}
+	return webhookId, nil
+}
+
+func deliveryId(r *http.Request) (string, error) {
+	deliveryId := chi.URLParam(r, "deliveryId")
+	if len(deliveryId) != 36 {
+		return deliveryId, ErrBadRequest.WithError(errors.New("invalid delivery id"))
+	}
+	return deliveryId, nil
+}
+
 func flagId(r *http.Request) (string, error) {
 	flagId := chi.URLParam(r, "flagId")
 	if len(flagId) != 36 {
@@ -145,3 +167,118 @@ func writeJSON(w http.ResponseWriter, status int, data any, success bool, errors
 	_, err = w.Write(j)
 	return err
 }
+
+func etag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches any of the hashes
+func etagMatches(header string, hashes ...string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "" {
+			continue
+		}
+		if tag == "*" {
+			return true
+		}
+		for _, h := range hashes {
+			if h != "" && tag == etag(h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provisionContext makes provisioning wait for the result when the request has ?sync=true
+func provisionContext(r *http.Request) context.Context {
+	if r.URL.Query().Get("sync") == "true" {
+		return provisioner.WithSync(r.Context())
+	}
+	return r.Context()
+}
+
+// syncSupported rejects ?sync=true requests unless changes are provisioned in process,
+// sending a change to a provision bus doesn't mean that it was provisioned
+func (api *API) syncSupported(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sync") == "true" && !api.SyncProvisioning {
+			writeErr(w, nil, ErrBadRequest.WithError(errors.New("sync=true is only supported with PROVISION_BUS=inprocess")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// provisionProject provisions a project after its flags changed. The project is read again for ?sync=true requests
+// so the version that was just written is provisioned and reported, not the version from before the change.
+func (api *API) provisionProject(r *http.Request, p *project.Project) error {
+	ctx := provisionContext(r)
+	if provisioner.IsSync(ctx) {
+		current, err := api.Project.Get(r.Context(), p.ID)
+		if err != nil {
+			return provisioned(r, err, p.ID, "could not get project to provision")
+		}
+		p = current
+	}
+	return provisioned(r, api.Provisioner.ProvisionProject(ctx, p), p.ID, "could not provision project")
+}
+
+// provisioned logs a provisioning error, the error is only returned for ?sync=true requests
+func provisioned(r *http.Request, err error, id, msg string) error {
+	if err == nil {
+		return nil
+	}
+	log.Warn().Str("id", id).Err(err).Msg(msg)
+	if r.URL.Query().Get("sync") == "true" {
+		return ErrProvisioning.WithError(err)
+	}
+	return nil
+}
+
+// MaxWait is the longest a request can wait for a change to be provisioned
+const MaxWait = time.Second * 30
+
+// waitDuration parses ?wait=10s, requests don't wait if it is empty
+func waitDuration(r *http.Request) (time.Duration, error) {
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(wait)
+	if err != nil || d < 0 || d > MaxWait {
+		return 0, ErrBadRequest.WithError(fmt.Errorf("wait must be a duration up to %s", MaxWait))
+	}
+	return d, nil
+}
+
+// waitProvisioned waits until the project is live or the wait expires and sets the Vex-Provisioned header
+func (api *API) waitProvisioned(w http.ResponseWriter, r *http.Request, projectId string, wait time.Duration) {
+	if wait == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	ticker := time.NewTicker(time.Millisecond * 250)
+	defer ticker.Stop()
+	live := false
+	for !live {
+		status, err := api.Project.Status(ctx, projectId)
+		if err != nil {
+			log.Warn().Err(err).Str("id", projectId).Msg("could not get project status")
+		} else {
+			live = status.Live
+		}
+		if live {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			w.Header().Set("Vex-Provisioned", "false")
+			return
+		case <-ticker.C:
+		}
+	}
+	w.Header().Set("Vex-Provisioned", "true")
+}
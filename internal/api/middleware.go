@@ -113,12 +113,22 @@ func AccountAuthorizer(tokenStore token.Store) func(next http.Handler) http.Hand
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, t)))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
+type contextKey string
+
+const tokenKey contextKey = "token"
+
+// requestToken returns the token that authorized the request, or nil for admin requests
+func requestToken(ctx context.Context) *token.Token {
+	t, _ := ctx.Value(tokenKey).(*token.Token)
+	return t
+}
+
 func CloudflareAccessVerifier(client AccessClient) func(next http.Handler) http.Handler {
 
 	return func(next http.Handler) http.Handler {
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"encoding/base64"
 	"net/http"
 
+	"github.com/broswen/vex/internal/event"
+	"github.com/broswen/vex/internal/flag"
 	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/secret"
 	"github.com/broswen/vex/internal/stats"
-	"github.com/rs/zerolog/log"
 )
 
 func (api *API) CreateProject() http.HandlerFunc {
@@ -23,6 +26,12 @@ func (api *API) CreateProject() http.HandlerFunc {
 		}
 		defer r.Body.Close()
 		p.AccountID = accountId
+
+		if err = project.Validate(*p); err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+
 		newProject, err := api.Project.Insert(r.Context(), p)
 
 		if err != nil {
@@ -30,6 +39,7 @@ func (api *API) CreateProject() http.HandlerFunc {
 			return
 		}
 		stats.ProjectCreated.Inc()
+		api.publish(r.Context(), event.New(event.ProjectCreated, newProject.AccountID, newProject.ID, nil, newProject))
 		err = writeOK(w, http.StatusOK, newProject)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -61,12 +71,45 @@ func (api *API) UpdateProject() http.HandlerFunc {
 		p.ID = projectId
 		p.AccountID = accountId
 
+		if err = project.Validate(*p); err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+
+		//existing flags must be valid nested keys before switching render modes
+		if p.RenderMode == project.NESTED {
+			flags, err := api.Flag.All(r.Context(), projectId)
+			if err != nil {
+				writeErr(w, nil, err)
+				return
+			}
+			if err = flag.ValidateNestedKeys(flags); err != nil {
+				writeErr(w, nil, ErrBadRequest.WithError(err))
+				return
+			}
+		}
+
+		before, err := api.Project.Get(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+
 		updatedProject, err := api.Project.Update(r.Context(), p)
 
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
+		api.publish(r.Context(), event.New(event.ProjectUpdated, updatedProject.AccountID, updatedProject.ID, before, updatedProject))
+
+		//changing the render mode changes the rendered config
+		if p.RenderMode != "" {
+			if err = provisioned(r, api.Provisioner.ProvisionProject(provisionContext(r), updatedProject), projectId, "could not provision project"); err != nil {
+				writeErr(w, updatedProject, err)
+				return
+			}
+		}
 		err = writeOK(w, http.StatusOK, updatedProject)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -118,21 +161,33 @@ func (api *API) GetProject() http.HandlerFunc {
 
 func (api *API) DeleteProject() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
 		projectId, err := projectId(r)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
-		err = api.Project.Delete(r.Context(), projectId)
+		before, err := api.Project.Get(r.Context(), projectId)
 		if err != nil {
 			writeErr(w, nil, err)
 			return
 		}
-		err = api.Provisioner.DeprovisionProject(r.Context(), &project.Project{ID: projectId})
+		err = api.Project.Delete(r.Context(), projectId)
 		if err != nil {
-			log.Warn().Str("id", projectId).Err(err).Msg("could not deprovision project")
+			writeErr(w, nil, err)
+			return
 		}
+		api.publish(r.Context(), event.New(event.ProjectDeleted, accountId, projectId, before, nil))
+		provisionErr := provisioned(r, api.Provisioner.DeprovisionProject(provisionContext(r), &project.Project{ID: projectId, AccountID: accountId}), projectId, "could not deprovision project")
 		stats.ProjectDeleted.Inc()
+		if provisionErr != nil {
+			writeErr(w, &struct{ id string }{id: projectId}, provisionErr)
+			return
+		}
 		err = writeOK(w, http.StatusOK, &struct{ id string }{id: projectId})
 		if err != nil {
 			writeErr(w, nil, err)
@@ -140,3 +195,170 @@ func (api *API) DeleteProject() http.HandlerFunc {
 		}
 	}
 }
+
+// GeneratePayloadKey generates a new key that SECRET flags are encrypted with in the rendered config.
+// The key is only returned once, generating a new key replaces the previous key.
+func (api *API) GeneratePayloadKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if api.Secrets == nil {
+			writeErr(w, nil, ErrSecretsDisabled)
+			return
+		}
+		key, err := secret.GenerateKey()
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		encryptedKey, err := api.Secrets.Encrypt(key)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		before, err := api.Project.Get(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p, err := api.Project.SetPayloadKey(r.Context(), projectId, encryptedKey)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		api.publish(r.Context(), event.New(event.ProjectUpdated, p.AccountID, p.ID, before, p))
+		provisionErr := provisioned(r, api.Provisioner.ProvisionProject(provisionContext(r), p), projectId, "could not provision project")
+		//the payload key is only returned once, so it is returned even if provisioning fails
+		data := &struct {
+			PayloadKey string `json:"payload_key"`
+		}{PayloadKey: base64.StdEncoding.EncodeToString(key)}
+		if provisionErr != nil {
+			writeErr(w, data, provisionErr)
+			return
+		}
+		err = writeOK(w, http.StatusOK, data)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// DeletePayloadKey removes the payload key of a project so SECRET flags are left out of the rendered config
+func (api *API) DeletePayloadKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		before, err := api.Project.Get(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p, err := api.Project.SetPayloadKey(r.Context(), projectId, "")
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		api.publish(r.Context(), event.New(event.ProjectUpdated, p.AccountID, p.ID, before, p))
+		provisionErr := provisioned(r, api.Provisioner.ProvisionProject(provisionContext(r), p), projectId, "could not provision project")
+		if provisionErr != nil {
+			writeErr(w, p, provisionErr)
+			return
+		}
+		err = writeOK(w, http.StatusOK, p)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+type ProjectVersion struct {
+	ProjectID string `json:"project_id"`
+	// Hash and HashV2 are the content hashes of the rendered v1 and v2 configs
+	Hash   string `json:"hash"`
+	HashV2 string `json:"hash_v2"`
+}
+
+// GetProjectVersion returns the content hashes of the rendered configs so clients can skip fetching unchanged configs.
+// The hashes are recorded with the project so polling doesn't render it, responds with 304 Not Modified if If-None-Match matches.
+func (api *API) GetProjectVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		hashes, err := api.Renderer.Hashes(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if hashes.AccountID != accountId {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+		//the etag covers both hashes because the response changes when either config changes
+		tag := flag.ContentHash([]byte(hashes.Hash + hashes.HashV2))
+		w.Header().Set("ETag", etag(tag))
+		if etagMatches(r.Header.Get("If-None-Match"), tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		err = writeOK(w, http.StatusOK, &ProjectVersion{
+			ProjectID: hashes.ProjectID,
+			Hash:      hashes.Hash,
+			HashV2:    hashes.HashV2,
+		})
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// GetProjectStatus returns the desired and provisioned versions of a project, the project is live once the edge serves the desired version
+func (api *API) GetProjectStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p, err := api.Project.Get(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if p.AccountID != accountId {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+		status, err := api.Project.Status(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, status)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
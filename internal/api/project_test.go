@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/broswen/vex/internal/flag"
 	"github.com/broswen/vex/internal/project"
 	provisioner2 "github.com/broswen/vex/internal/provisioner"
 	"github.com/go-chi/chi/v5"
@@ -110,6 +112,7 @@ func TestUpdateProjectHandler(t *testing.T) {
 	req.WithContext(context.Background())
 	rr := httptest.NewRecorder()
 	store := project.NewMockStore()
+	store.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID, Name: "old"}, nil)
 	store.On("Update", mock.Anything, &project.Project{
 		ID:          projectID,
 		AccountID:   accountID,
@@ -133,15 +136,70 @@ func TestUpdateProjectHandler(t *testing.T) {
 	store.AssertExpectations(t)
 }
 
+func TestUpdateProjectHandler_InvalidRenderMode(t *testing.T) {
+	p1 := &project.Project{
+		Name:        "test",
+		Description: "test project",
+		RenderMode:  "WRONG",
+	}
+	reqBody, err := json.Marshal(p1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPut, "/accounts/"+accountID+"/projects/"+projectID, bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	store := project.NewMockStore()
+	app := &API{
+		Project: store,
+	}
+	r := chi.NewRouter()
+	r.Put("/accounts/{accountId}/projects/{projectId}", app.UpdateProject())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+	store.AssertExpectations(t)
+}
+
+func TestUpdateProjectHandler_NestedKeyConflict(t *testing.T) {
+	p1 := &project.Project{
+		Name:        "test",
+		Description: "test project",
+		RenderMode:  project.NESTED,
+	}
+	reqBody, err := json.Marshal(p1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPut, "/accounts/"+accountID+"/projects/"+projectID, bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	//the conflict is past the first 1000 flags
+	flags := make([]*flag.Flag, 0)
+	for i := 0; i < 1000; i++ {
+		flags = append(flags, &flag.Flag{Key: fmt.Sprintf("flag%d", i), Type: flag.STRING, Value: "test"})
+	}
+	flags = append(flags, &flag.Flag{Key: "flag1.nested", Type: flag.STRING, Value: "test"})
+	flagStore := flag.NewMockStore()
+	flagStore.On("All", mock.Anything, projectID).Return(flags, nil)
+	store := project.NewMockStore()
+	app := &API{
+		Project: store,
+		Flag:    flagStore,
+	}
+	r := chi.NewRouter()
+	r.Put("/accounts/{accountId}/projects/{projectId}", app.UpdateProject())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+	store.AssertExpectations(t)
+}
+
 func TestDeleteProjectHandler(t *testing.T) {
 	req, err := http.NewRequest(http.MethodDelete, "/accounts/"+accountID+"/projects/"+projectID, nil)
 	assert.Nil(t, err)
 	req.WithContext(context.Background())
 	rr := httptest.NewRecorder()
 	store := project.NewMockStore()
+	store.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
 	store.On("Delete", mock.Anything, projectID).Return(nil)
 	provisioner := provisioner2.NewMockProvisioner()
-	provisioner.On("DeprovisionProject", mock.Anything, &project.Project{ID: projectID}).Return(nil)
+	provisioner.On("DeprovisionProject", mock.Anything, &project.Project{ID: projectID, AccountID: accountID}).Return(nil)
 	app := &API{
 		Project:     store,
 		Provisioner: provisioner,
@@ -152,3 +210,95 @@ func TestDeleteProjectHandler(t *testing.T) {
 	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
 	store.AssertExpectations(t)
 }
+
+func TestGetProjectVersionHandler(t *testing.T) {
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{
+		ID:         projectID,
+		AccountID:  accountID,
+		RenderMode: project.FLAT,
+		Version:    2,
+	}, nil)
+	//the hashes are stale so the project is rendered once and its configs are stored
+	projectStore.On("Hashes", mock.Anything, projectID).Return(&project.Hashes{
+		ProjectID:       projectID,
+		AccountID:       accountID,
+		Version:         2,
+		RenderedVersion: 1,
+		Hash:            "old",
+		HashV2:          "old",
+	}, nil).Once()
+	flags := []*flag.Flag{{ID: "1", ProjectID: projectID, AccountID: accountID, Key: "a", Type: flag.BOOLEAN, Value: "true"}}
+	rendered, err := flag.RenderConfig(flags)
+	assert.Nil(t, err)
+	hash := flag.ContentHash(rendered)
+	renderedV2, err := flag.RenderConfigV2(projectID, flags)
+	assert.Nil(t, err)
+	hashV2 := flag.ContentHash(renderedV2)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, projectID).Return(&flag.Snapshot{Version: 2, Flags: flags}, nil).Once()
+	projectStore.On("Configs", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID, Version: 2}, &project.Configs{Version: 1, Hash: "old", HashV2: "old"}, nil).Once()
+	projectStore.On("SetConfigs", mock.Anything, projectID, mock.MatchedBy(func(c *project.Configs) bool {
+		return c.Version == 2 && c.Hash == hash && c.HashV2 == hashV2
+	})).Return(nil).Once()
+	app := &API{
+		Renderer: provisioner2.NewRenderer(projectStore, flagStore, nil),
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/version", app.GetProjectVersion())
+
+	req, err := http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/version", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	assert.Contains(t, rr.Body.String(), hash)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	//current hashes are served without rendering
+	projectStore.On("Hashes", mock.Anything, projectID).Return(&project.Hashes{
+		ProjectID:       projectID,
+		AccountID:       accountID,
+		Version:         2,
+		RenderedVersion: 2,
+		Hash:            hash,
+		HashV2:          hashV2,
+	}, nil)
+	req, err = http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/version", nil)
+	assert.Nil(t, err)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusNotModified, rr.Code, "should return not modified")
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+
+	//the etag of the version isn't the etag of either config
+	req, err = http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/version", nil)
+	assert.Nil(t, err)
+	req.Header.Set("If-None-Match", `"`+hash+`"`)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	projectStore.AssertExpectations(t)
+	flagStore.AssertExpectations(t)
+}
+
+func TestGetProjectStatusHandler(t *testing.T) {
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	projectStore.On("Status", mock.Anything, projectID).Return(&project.Status{ProjectID: projectID, DesiredVersion: 2, ProvisionedVersion: 2, Live: true}, nil)
+	app := &API{
+		Project: projectStore,
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/status", app.GetProjectStatus())
+
+	req, err := http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/status", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	assert.Contains(t, rr.Body.String(), `"live":true`)
+	projectStore.AssertExpectations(t)
+}
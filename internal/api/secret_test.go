@@ -0,0 +1,329 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	provisioner2 "github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestCipher(t *testing.T) *secret.Cipher {
+	key, err := secret.GenerateKey()
+	assert.Nil(t, err)
+	c, err := secret.NewCipher(base64.StdEncoding.EncodeToString(key))
+	assert.Nil(t, err)
+	return c
+}
+
+func TestCreateFlagHandler_Secret(t *testing.T) {
+	f1 := &flag.Flag{
+		Key:   "api_key",
+		Type:  flag.SECRET,
+		Value: "abc123",
+	}
+	reqBody, err := json.Marshal(f1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{
+		ID:          projectID,
+		AccountID:   accountID,
+		Name:        "test",
+		Description: "test",
+		CreatedOn:   time.Time{},
+		ModifiedOn:  time.Time{},
+	}
+	secrets := newTestCipher(t)
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	store := flag.NewMockStore()
+	//value must be encrypted before it is stored
+	store.On("Insert", mock.Anything, mock.MatchedBy(func(f *flag.Flag) bool {
+		value, err := secrets.Decrypt(f.Value)
+		return err == nil && string(value) == "abc123"
+	})).Return(&flag.Flag{
+		ID:         flagID,
+		ProjectID:  projectID,
+		AccountID:  accountID,
+		Key:        "api_key",
+		Type:       flag.SECRET,
+		Value:      "encrypted",
+		CreatedOn:  now,
+		ModifiedOn: now,
+	}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
+	app := &API{
+		Flag:        store,
+		Project:     projectStore,
+		Provisioner: provisioner,
+		Secrets:     secrets,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	assert.Contains(t, rr.Body.String(), flag.SecretMask)
+	assert.NotContains(t, rr.Body.String(), "encrypted")
+	store.AssertExpectations(t)
+}
+
+func TestCreateFlagHandler_SecretsDisabled(t *testing.T) {
+	f1 := &flag.Flag{
+		Key:   "api_key",
+		Type:  flag.SECRET,
+		Value: "abc123",
+	}
+	reqBody, err := json.Marshal(f1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{
+		ID:        projectID,
+		AccountID: accountID,
+	}
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	store := flag.NewMockStore()
+	app := &API{
+		Flag:    store,
+		Project: projectStore,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags", app.CreateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+	store.AssertExpectations(t)
+}
+
+func TestRevealFlagHandler(t *testing.T) {
+	secrets := newTestCipher(t)
+	encrypted, err := secrets.Encrypt([]byte("abc123"))
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/projects/"+projectID+"/flags/"+flagID+"/reveal", nil)
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	store := flag.NewMockStore()
+	store.On("Get", mock.Anything, flagID).Return(&flag.Flag{
+		ID:         flagID,
+		ProjectID:  projectID,
+		AccountID:  accountID,
+		Key:        "api_key",
+		Type:       flag.SECRET,
+		Value:      encrypted,
+		CreatedOn:  now,
+		ModifiedOn: now,
+	}, nil)
+	app := &API{
+		Flag:    store,
+		Secrets: secrets,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/projects/{projectId}/flags/{flagId}/reveal", app.RevealFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	res := &struct {
+		Data *flag.Flag `json:"data"`
+	}{}
+	err = json.Unmarshal(rr.Body.Bytes(), res)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", res.Data.Value)
+	store.AssertExpectations(t)
+}
+
+func TestListFlagHandler_MasksSecrets(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/flags", nil)
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	store := flag.NewMockStore()
+	store.On("List", mock.Anything, projectID, int64(100), int64(0)).Return([]*flag.Flag{
+		{
+			ID:        flagID,
+			ProjectID: projectID,
+			AccountID: accountID,
+			Key:       "api_key",
+			Type:      flag.SECRET,
+			Value:     "encrypted",
+		},
+	}, nil)
+	app := &API{
+		Flag:    store,
+		Project: projectStore,
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/flags", app.ListFlags())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	assert.Contains(t, rr.Body.String(), flag.SecretMask)
+	assert.NotContains(t, rr.Body.String(), "encrypted")
+	store.AssertExpectations(t)
+}
+
+func TestUpdateFlagHandler_MaskedSecret(t *testing.T) {
+	f1 := &flag.Flag{
+		Key:   "api_key",
+		Type:  flag.SECRET,
+		Value: flag.SecretMask,
+	}
+	reqBody, err := json.Marshal(f1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPut, "/accounts/"+accountID+"/projects/"+projectID+"/flags/"+flagID, bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{
+		ID:        projectID,
+		AccountID: accountID,
+	}
+	secrets := newTestCipher(t)
+	encrypted, err := secrets.Encrypt([]byte("abc123"))
+	assert.Nil(t, err)
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	store := flag.NewMockStore()
+	store.On("Get", mock.Anything, flagID).Return(&flag.Flag{
+		ID:        flagID,
+		ProjectID: projectID,
+		AccountID: accountID,
+		Key:       "api_key",
+		Type:      flag.SECRET,
+		Value:     encrypted,
+	}, nil)
+	//the stored ciphertext is kept instead of encrypting the mask
+	store.On("Update", mock.Anything, mock.MatchedBy(func(f *flag.Flag) bool {
+		return f.Value == encrypted
+	})).Return(&flag.Flag{
+		ID:        flagID,
+		ProjectID: projectID,
+		AccountID: accountID,
+		Key:       "api_key",
+		Type:      flag.SECRET,
+		Value:     encrypted,
+	}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
+	app := &API{
+		Flag:        store,
+		Project:     projectStore,
+		Provisioner: provisioner,
+		Secrets:     secrets,
+	}
+	r := chi.NewRouter()
+	r.Put("/accounts/{accountId}/projects/{projectId}/flags/{flagId}", app.UpdateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	store.AssertExpectations(t)
+}
+
+func TestUpdateFlagHandler_MaskedSecretNotStored(t *testing.T) {
+	f1 := &flag.Flag{
+		Key:   "api_key",
+		Type:  flag.SECRET,
+		Value: flag.SecretMask,
+	}
+	reqBody, err := json.Marshal(f1)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPut, "/accounts/"+accountID+"/projects/"+projectID+"/flags/"+flagID, bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	store := flag.NewMockStore()
+	store.On("Get", mock.Anything, flagID).Return(&flag.Flag{
+		ID:        flagID,
+		ProjectID: projectID,
+		AccountID: accountID,
+		Key:       "api_key",
+		Type:      flag.STRING,
+		Value:     "test",
+	}, nil)
+	app := &API{
+		Flag:    store,
+		Project: projectStore,
+		Secrets: newTestCipher(t),
+	}
+	r := chi.NewRouter()
+	r.Put("/accounts/{accountId}/projects/{projectId}/flags/{flagId}", app.UpdateFlag())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+	store.AssertExpectations(t)
+}
+
+func TestReplaceFlagsHandler_MaskedSecret(t *testing.T) {
+	flags := []*flag.Flag{
+		{
+			Key:   "api_key",
+			Type:  flag.SECRET,
+			Value: flag.SecretMask,
+		},
+		{
+			Key:   "new_key",
+			Type:  flag.SECRET,
+			Value: "def456",
+		},
+	}
+	reqBody, err := json.Marshal(flags)
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPut, "/accounts/"+accountID+"/projects/"+projectID+"/flags", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	p1 := &project.Project{
+		ID:        projectID,
+		AccountID: accountID,
+	}
+	secrets := newTestCipher(t)
+	encrypted, err := secrets.Encrypt([]byte("abc123"))
+	assert.Nil(t, err)
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(p1, nil)
+	store := flag.NewMockStore()
+	store.On("All", mock.Anything, projectID).Return([]*flag.Flag{
+		{
+			ID:        flagID,
+			ProjectID: projectID,
+			AccountID: accountID,
+			Key:       "api_key",
+			Type:      flag.SECRET,
+			Value:     encrypted,
+		},
+	}, nil)
+	store.On("ReplaceFlags", mock.Anything, projectID, mock.MatchedBy(func(flags []*flag.Flag) bool {
+		value, err := secrets.Decrypt(flags[1].Value)
+		return flags[0].Value == encrypted && err == nil && string(value) == "def456"
+	})).Return([]*flag.Flag{}, nil)
+	provisioner := provisioner2.NewMockProvisioner()
+	provisioner.On("ProvisionProject", mock.Anything, p1).Return(nil)
+	app := &API{
+		Flag:        store,
+		Project:     projectStore,
+		Provisioner: provisioner,
+		Secrets:     secrets,
+	}
+	r := chi.NewRouter()
+	r.Put("/accounts/{accountId}/projects/{projectId}/flags", app.ReplaceFlags())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	store.AssertExpectations(t)
+}
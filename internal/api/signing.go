@@ -0,0 +1,27 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/broswen/vex/internal/signing"
+)
+
+// JWKS publishes the current and previous public keys that rendered configs are signed with
+func (api *API) JWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := api.SigningKey.List(r.Context(), 2)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		j, err := json.Marshal(signing.NewJWKS(keys))
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(j)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broswen/vex/internal/signing"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestJWKSHandler(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/api/.well-known/jwks.json", nil)
+	assert.Nil(t, err)
+	req.WithContext(context.Background())
+	rr := httptest.NewRecorder()
+	store := signing.NewMockStore()
+	store.On("List", mock.Anything, int64(2)).Return([]*signing.Key{
+		{
+			ID:         "key2",
+			PublicKey:  make(ed25519.PublicKey, ed25519.PublicKeySize),
+			CreatedOn:  now,
+			ModifiedOn: now,
+		},
+		{
+			ID:         "key1",
+			PublicKey:  make(ed25519.PublicKey, ed25519.PublicKeySize),
+			CreatedOn:  now,
+			ModifiedOn: now,
+		},
+	}, nil)
+	app := &API{
+		SigningKey: store,
+	}
+	r := chi.NewRouter()
+	r.Get("/api/.well-known/jwks.json", app.JWKS())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	jwks := signing.JWKS{}
+	err = json.Unmarshal(rr.Body.Bytes(), &jwks)
+	assert.Nil(t, err)
+	assert.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "key2", jwks.Keys[0].Kid)
+	store.AssertExpectations(t)
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// replayLimit is the number of missed events replayed per query when a client reconnects
+const replayLimit = 100
+
+var keepAliveInterval = time.Second * 30
+
+// StreamEvents streams the rendered config of a project as Server-Sent Events each time the project changes.
+// Clients that reconnect with Last-Event-ID receive the events they missed.
+func (api *API) StreamEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		projectId, err := projectId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		//the event id is the project version, which is assigned under the project row lock unlike the event serial
+		var lastVersion int64
+		if header := r.Header.Get("Last-Event-ID"); header != "" {
+			lastVersion, err = strconv.ParseInt(header, 10, 64)
+			if err != nil || lastVersion < 0 {
+				writeErr(w, nil, ErrBadRequest.WithError(errors.New("invalid Last-Event-ID")))
+				return
+			}
+		}
+		p, err := api.Project.Get(r.Context(), projectId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if p.AccountID != accountId {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeErr(w, nil, ErrInternalServer)
+			return
+		}
+
+		//subscribe before replaying so no events are missed in between
+		events, unsubscribe := api.Events.Subscribe(projectId)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		if lastVersion > 0 {
+			for {
+				missed, err := api.Events.Since(r.Context(), projectId, lastVersion, replayLimit)
+				if err != nil {
+					log.Error().Err(err).Str("id", projectId).Msg("could not replay config events")
+					return
+				}
+				for _, e := range missed {
+					if err = e.Write(w); err != nil {
+						return
+					}
+					lastVersion = e.Version
+				}
+				flusher.Flush()
+				if len(missed) < replayLimit {
+					break
+				}
+			}
+		}
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err = w.Write([]byte(": keep-alive\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+			case e, ok := <-events:
+				//the hub closes the channel if the client falls behind, the client reconnects with Last-Event-ID
+				if !ok {
+					return
+				}
+				//skip events that were already replayed
+				if e.Version <= lastVersion {
+					continue
+				}
+				if err = e.Write(w); err != nil {
+					return
+				}
+				lastVersion = e.Version
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stream"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	lines := make([]string, 0)
+	for {
+		line, err := r.ReadString('\n')
+		assert.Nil(t, err)
+		if line == "\n" {
+			return lines
+		}
+		lines = append(lines, line[:len(line)-1])
+	}
+}
+
+func TestStreamEventsHandler(t *testing.T) {
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	eventStore := stream.NewMockStore()
+	eventStore.On("ListSince", mock.Anything, projectID, int64(1), int64(replayLimit)).Return([]*stream.Event{
+		{ID: 7, Version: 2, ProjectID: projectID, AccountID: accountID, Type: stream.CONFIG, Config: []byte(`{"a":{"type":"STRING","value":"missed"}}`)},
+	}, nil)
+	hub := stream.NewHub(eventStore)
+	app := &API{
+		Project: projectStore,
+		Events:  hub,
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/events", app.StreamEvents())
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/accounts/"+accountID+"/projects/"+projectID+"/events", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := server.Client().Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	body := bufio.NewReader(res.Body)
+	//missed events are replayed
+	assert.Equal(t, []string{"id: 2", "event: config", `data: {"a":{"type":"STRING","value":"missed"}}`}, readEvent(t, body))
+
+	//events that were already replayed are skipped, events are ordered by version and not by id
+	hub.Broadcast(&stream.Event{ID: 8, Version: 2, ProjectID: projectID, Type: stream.CONFIG, Config: []byte(`{}`)})
+	hub.Broadcast(&stream.Event{ID: 6, Version: 3, ProjectID: projectID, Type: stream.CONFIG, Config: []byte(`{"a":{"type":"STRING","value":"live"}}`)})
+	assert.Equal(t, []string{"id: 3", "event: config", `data: {"a":{"type":"STRING","value":"live"}}`}, readEvent(t, body))
+	eventStore.AssertExpectations(t)
+}
+
+func TestStreamEventsHandler_WrongAccount(t *testing.T) {
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: "other"}, nil)
+	app := &API{
+		Project: projectStore,
+		Events:  stream.NewHub(stream.NewMockStore()),
+	}
+	r := chi.NewRouter()
+	r.Get("/accounts/{accountId}/projects/{projectId}/events", app.StreamEvents())
+	req, err := http.NewRequest(http.MethodGet, "/accounts/"+accountID+"/projects/"+projectID+"/events", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 
+	"github.com/broswen/vex/internal/event"
 	"github.com/broswen/vex/internal/stats"
 	"github.com/broswen/vex/internal/token"
 	"github.com/rs/zerolog/log"
@@ -43,10 +44,12 @@ func (api *API) GenerateToken() http.HandlerFunc {
 			return
 		}
 		stats.TokenCreated.Inc()
+		api.publish(r.Context(), event.New(event.TokenCreated, t.AccountID, "", nil, redactToken(t)))
 
-		err = api.Provisioner.ProvisionToken(r.Context(), t)
-		if err != nil {
-			log.Warn().Str("id", t.ID).Err(err).Msg("could not provision token")
+		provisionErr := provisioned(r, api.Provisioner.ProvisionToken(provisionContext(r), t), t.ID, "could not provision token")
+		if provisionErr != nil {
+			writeErr(w, t, provisionErr)
+			return
 		}
 		err = writeOK(w, http.StatusOK, t)
 		if err != nil {
@@ -76,18 +79,19 @@ func (api *API) RerollToken() http.HandlerFunc {
 			return
 		}
 		stats.TokenRolled.Inc()
+		api.publish(r.Context(), event.New(event.TokenUpdated, t.AccountID, "", redactToken(t), redactToken(updatedToken)))
 
-		err = api.Provisioner.ProvisionToken(r.Context(), updatedToken)
-		if err != nil {
-			log.Warn().Str("id", updatedToken.ID).Err(err).Msg("could not provision new token")
-		}
+		provisionErr := provisioned(r, api.Provisioner.ProvisionToken(provisionContext(r), updatedToken), updatedToken.ID, "could not provision new token")
 
 		//deprovision old token value
-		err = api.Provisioner.DeprovisionToken(r.Context(), t)
-		if err != nil {
-			log.Warn().Str("id", t.ID).Err(err).Msg("could not deprovision old token")
+		if err = provisioned(r, api.Provisioner.DeprovisionToken(provisionContext(r), t), t.ID, "could not deprovision old token"); err != nil && provisionErr == nil {
+			provisionErr = err
 		}
 
+		if provisionErr != nil {
+			writeErr(w, updatedToken, provisionErr)
+			return
+		}
 		err = writeOK(w, http.StatusOK, updatedToken)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -115,12 +119,13 @@ func (api *API) DeleteToken() http.HandlerFunc {
 			return
 		}
 		stats.TokenDeleted.Inc()
+		api.publish(r.Context(), event.New(event.TokenDeleted, t.AccountID, "", redactToken(t), nil))
 
-		err = api.Provisioner.DeprovisionToken(r.Context(), &token.Token{TokenHash: t.TokenHash})
-		if err != nil {
-			log.Warn().Str("id", t.ID).Err(err).Msg("could not deprovision token")
+		provisionErr := provisioned(r, api.Provisioner.DeprovisionToken(provisionContext(r), &token.Token{TokenHash: t.TokenHash}), t.ID, "could not deprovision token")
+		if provisionErr != nil {
+			writeErr(w, t, provisionErr)
+			return
 		}
-
 		err = writeOK(w, http.StatusOK, t)
 		if err != nil {
 			writeErr(w, nil, err)
@@ -128,3 +133,10 @@ func (api *API) DeleteToken() http.HandlerFunc {
 		}
 	}
 }
+
+// redactToken removes the plaintext token so it isn't sent in events
+func redactToken(t *token.Token) *token.Token {
+	redacted := *t
+	redacted.Token = ""
+	return &redacted
+}
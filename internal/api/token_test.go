@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"github.com/broswen/vex/internal/event"
 	provisioner2 "github.com/broswen/vex/internal/provisioner"
 	"github.com/broswen/vex/internal/token"
 	"github.com/go-chi/chi/v5"
@@ -42,15 +43,23 @@ func TestGenerateTokenHandler(t *testing.T) {
 		ModifiedOn: now,
 	}).Return(nil)
 
+	publisher := event.NewMockPublisher()
+	publisher.On("Publish", mock.Anything, mock.MatchedBy(func(e *event.Event) bool {
+		return e.Type == event.TokenCreated && e.Actor == "actor" && e.After.(*token.Token).Token == ""
+	})).Return(nil)
+
 	app := &API{
 		Token:       store,
 		Provisioner: provisioner,
+		Publisher:   publisher,
 	}
 	r := chi.NewRouter()
 	r.Post("/accounts/{accountId}/tokens", app.GenerateToken())
-	r.ServeHTTP(rr, req)
+	r.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), tokenKey, &token.Token{ID: "actor"})))
 	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	assert.Contains(t, rr.Body.String(), "abc123")
 	store.AssertExpectations(t)
+	publisher.AssertExpectations(t)
 }
 
 func TestRerollTokenHandler(t *testing.T) {
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/broswen/vex/internal/event"
+	"github.com/broswen/vex/internal/webhook"
+	"github.com/rs/zerolog/log"
+)
+
+func (api *API) ListWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p := pagination(r)
+		webhooks, err := api.Webhook.List(r.Context(), accountId, p.Limit, p.Offset)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, webhooks)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// CreateWebhook creates a webhook with a generated secret, the secret is only returned once.
+// The secret is encrypted at rest if the server has a secret key.
+func (api *API) CreateWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountId, err := accountId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		wh := &webhook.Webhook{}
+		err = readJSON(w, r, wh)
+		if err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+		defer r.Body.Close()
+		wh.AccountID = accountId
+
+		if err = webhook.Validate(*wh); err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+
+		signingSecret, err := webhook.NewSecret()
+		if err != nil {
+			writeErr(w, nil, ErrInternalServer)
+			return
+		}
+		wh.Secret = signingSecret
+		if api.Secrets != nil {
+			wh.Secret, err = api.Secrets.Encrypt([]byte(signingSecret))
+			if err != nil {
+				writeErr(w, nil, ErrInternalServer)
+				return
+			}
+		}
+
+		newWebhook, err := api.Webhook.Insert(r.Context(), wh)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		newWebhook.Secret = signingSecret
+		err = writeOK(w, http.StatusOK, newWebhook)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+func (api *API) GetWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, err := api.accountWebhook(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, wh)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+func (api *API) UpdateWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		existing, err := api.accountWebhook(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		wh := &webhook.Webhook{}
+		err = readJSON(w, r, wh)
+		if err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+		defer r.Body.Close()
+		wh.ID = existing.ID
+		wh.AccountID = existing.AccountID
+
+		if err = webhook.Validate(*wh); err != nil {
+			writeErr(w, nil, ErrBadRequest.WithError(err))
+			return
+		}
+
+		updatedWebhook, err := api.Webhook.Update(r.Context(), wh)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, updatedWebhook)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+func (api *API) DeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, err := api.accountWebhook(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = api.Webhook.Delete(r.Context(), wh.ID)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, &struct {
+			ID string `json:"id"`
+		}{ID: wh.ID})
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+func (api *API) ListWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, err := api.accountWebhook(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		p := pagination(r)
+		deliveries, err := api.Webhook.ListDeliveries(r.Context(), wh.ID, p.Limit, p.Offset)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, deliveries)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// RedeliverWebhook queues a delivery to be sent again, regardless of its status
+func (api *API) RedeliverWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, err := api.accountWebhook(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		deliveryId, err := deliveryId(r)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		d, err := api.Webhook.GetDelivery(r.Context(), deliveryId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		if d.WebhookID != wh.ID {
+			writeErr(w, nil, ErrNotFound)
+			return
+		}
+		d, err = api.Webhook.Redeliver(r.Context(), deliveryId)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+		err = writeOK(w, http.StatusOK, d)
+		if err != nil {
+			writeErr(w, nil, err)
+			return
+		}
+	}
+}
+
+// accountWebhook gets the webhook in the path and checks that it belongs to the account in the path
+func (api *API) accountWebhook(r *http.Request) (*webhook.Webhook, error) {
+	accountId, err := accountId(r)
+	if err != nil {
+		return nil, err
+	}
+	webhookId, err := webhookId(r)
+	if err != nil {
+		return nil, err
+	}
+	wh, err := api.Webhook.Get(r.Context(), webhookId)
+	if err != nil {
+		return nil, err
+	}
+	if wh.AccountID != accountId {
+		return nil, ErrNotFound
+	}
+	return wh, nil
+}
+
+// publish publishes an event if a publisher is configured, errors are logged and don't fail the request
+func (api *API) publish(ctx context.Context, e *event.Event) {
+	if api.Publisher == nil {
+		return
+	}
+	if t := requestToken(ctx); t != nil {
+		e.Actor = t.ID
+	}
+	if err := api.Publisher.Publish(ctx, e); err != nil {
+		log.Warn().Str("id", e.ID).Str("type", string(e.Type)).Err(err).Msg("could not publish event")
+	}
+}
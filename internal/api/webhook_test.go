@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broswen/vex/internal/event"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var webhookID = "4b1b8a2c-9c3e-4a54-a0a4-63e2a3c2a1f0"
+var deliveryID = "0f6f3b8e-1b9a-4c4e-8d0c-3d9f8e2b7a61"
+
+func TestCreateWebhookHandler(t *testing.T) {
+	reqBody, err := json.Marshal(&webhook.Webhook{URL: "https://example.com/hook", EventTypes: []event.Type{event.FlagUpdated}})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/webhooks", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	store := webhook.NewMockStore()
+	store.On("Insert", mock.Anything, mock.MatchedBy(func(w *webhook.Webhook) bool {
+		return w.AccountID == accountID && w.URL == "https://example.com/hook" && len(w.Secret) == 64
+	})).Return(&webhook.Webhook{ID: webhookID, AccountID: accountID, URL: "https://example.com/hook", Secret: "secret"}, nil)
+	app := &API{
+		Webhook: store,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/webhooks", app.CreateWebhook())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	store.AssertExpectations(t)
+}
+
+func TestCreateWebhookHandler_EncryptedSecret(t *testing.T) {
+	reqBody, err := json.Marshal(&webhook.Webhook{URL: "https://example.com/hook"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/webhooks", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	secrets := newTestCipher(t)
+	var stored string
+	store := webhook.NewMockStore()
+	store.On("Insert", mock.Anything, mock.MatchedBy(func(w *webhook.Webhook) bool {
+		stored = w.Secret
+		return secret.IsEncrypted(w.Secret)
+	})).Return(&webhook.Webhook{ID: webhookID, AccountID: accountID, URL: "https://example.com/hook"}, nil)
+	app := &API{
+		Webhook: store,
+		Secrets: secrets,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/webhooks", app.CreateWebhook())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	store.AssertExpectations(t)
+
+	//the plaintext secret is returned once
+	res := struct {
+		Data webhook.Webhook `json:"data"`
+	}{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	plaintext, err := secrets.Decrypt(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, string(plaintext), res.Data.Secret)
+}
+
+func TestCreateWebhookHandler_InternalURL(t *testing.T) {
+	reqBody, err := json.Marshal(&webhook.Webhook{URL: "https://169.254.169.254/latest/meta-data"})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/webhooks", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	app := &API{
+		Webhook: webhook.NewMockStore(),
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/webhooks", app.CreateWebhook())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+}
+
+func TestCreateWebhookHandler_InvalidEventType(t *testing.T) {
+	reqBody, err := json.Marshal(&webhook.Webhook{URL: "https://example.com/hook", EventTypes: []event.Type{"flag.renamed"}})
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/webhooks", bytes.NewReader(reqBody))
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	app := &API{
+		Webhook: webhook.NewMockStore(),
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/webhooks", app.CreateWebhook())
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusBadRequest, rr.Code, "should return bad request")
+}
+
+func TestRedeliverWebhookHandler(t *testing.T) {
+	store := webhook.NewMockStore()
+	store.On("Get", mock.Anything, webhookID).Return(&webhook.Webhook{ID: webhookID, AccountID: accountID}, nil)
+	store.On("GetDelivery", mock.Anything, deliveryID).Return(&webhook.Delivery{ID: deliveryID, WebhookID: webhookID, Status: webhook.FAILED}, nil)
+	store.On("Redeliver", mock.Anything, deliveryID).Return(&webhook.Delivery{ID: deliveryID, WebhookID: webhookID, Status: webhook.PENDING}, nil)
+	app := &API{
+		Webhook: store,
+	}
+	r := chi.NewRouter()
+	r.Post("/accounts/{accountId}/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", app.RedeliverWebhook())
+	req, err := http.NewRequest(http.MethodPost, "/accounts/"+accountID+"/webhooks/"+webhookID+"/deliveries/"+deliveryID+"/redeliver", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equalf(t, http.StatusOK, rr.Code, "should return ok")
+	store.AssertExpectations(t)
+}
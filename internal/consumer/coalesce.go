@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBatch is the most messages that are collected in a window
+const maxBatch = 500
+
+// Coalesce collects messages for the window, a burst of provisioning messages for the same project is handled once
+func (c *Consumer) Coalesce(window time.Duration) {
+	c.window = window
+}
+
+// consumeCoalesced handles the messages of a claim in batches that start with the first message after a window
+func (c *Consumer) consumeCoalesced(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	pending := make([]*sarama.ConsumerMessage, 0)
+	var flush <-chan time.Time
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if len(pending) == 0 {
+				flush = time.After(c.window)
+			}
+			pending = append(pending, message)
+			if len(pending) < maxBatch {
+				continue
+			}
+		case <-flush:
+		case <-session.Context().Done():
+			return nil
+		}
+		for _, message := range coalesce(pending, c.coalesceTopics) {
+			if ok, err := c.consume(session, message); !ok {
+				return err
+			}
+		}
+		pending = pending[:0]
+		flush = nil
+	}
+}
+
+// coalesce keeps the last message for each key in the topics and every other message, in order.
+// Skipped messages are marked when the later message for the same key is marked.
+func coalesce(messages []*sarama.ConsumerMessage, topics map[string]bool) []*sarama.ConsumerMessage {
+	last := make(map[string]int)
+	for i, message := range messages {
+		if topics[message.Topic] && len(message.Key) > 0 {
+			last[message.Topic+"/"+string(message.Key)] = i
+		}
+	}
+	kept := make([]*sarama.ConsumerMessage, 0, len(messages))
+	for i, message := range messages {
+		if topics[message.Topic] && len(message.Key) > 0 && last[message.Topic+"/"+string(message.Key)] != i {
+			stats.ProvisionCoalesced.Inc()
+			log.Debug().Str("topic", message.Topic).Str("key", string(message.Key)).Int64("offset", message.Offset).Msg("coalesced message")
+			continue
+		}
+		kept = append(kept, message)
+	}
+	return kept
+}
@@ -0,0 +1,308 @@
+package consumer
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/rs/zerolog/log"
+)
+
+func NewConsumer(skip bool) *Consumer {
+	return &Consumer{
+		ready:       make(chan bool),
+		skip:        skip,
+		handlers:    make(map[string]MessageHandler),
+		attempts:    5,
+		backoff:     time.Second,
+		maxBackoff:  time.Second * 30,
+		sequences:   make(map[string]sequence),
+		sequenceTTL: time.Hour,
+	}
+}
+
+type MessageHandler func(message *sarama.ConsumerMessage) error
+
+type sequence struct {
+	value   int64
+	handled time.Time
+}
+
+type Consumer struct {
+	ready chan bool
+	// whether in dev mode and shouldn't actually provision anything
+	skip     bool
+	handlers map[string]MessageHandler
+	// attempts is how many times a message is handled before it is dead lettered,
+	// the backoff between attempts doubles up to maxBackoff
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// messages that fail every attempt are sent to the dead letter topic, they are only logged if producer is nil
+	producer        sarama.SyncProducer
+	deadLetterTopic string
+	// provisioner handles provisioning events, a CompositeProvisioner routes them per account
+	provisioner provisioner.Provisioner
+	// sequences is the highest sequence handled for each project, projects without events for sequenceTTL are forgotten
+	mu          sync.Mutex
+	sequences   map[string]sequence
+	sequenceTTL time.Duration
+	swept       time.Time
+	// messages are collected for the window and provisioning messages for the same project are coalesced, disabled if 0
+	window time.Duration
+	// coalesceTopics are the topics whose messages are coalesced by key, every message provisions the latest state of the project
+	coalesceTopics map[string]bool
+}
+
+// Retry sets how many times a message is handled and the backoff between attempts
+func (c *Consumer) Retry(attempts int, backoff, maxBackoff time.Duration) {
+	c.attempts = attempts
+	c.backoff = backoff
+	c.maxBackoff = maxBackoff
+}
+
+// DeadLetter sends messages that fail every attempt to the topic
+func (c *Consumer) DeadLetter(producer sarama.SyncProducer, topic string) {
+	c.producer = producer
+	c.deadLetterTopic = topic
+}
+
+// Ready is closed when the consumer group session is set up
+func (c *Consumer) Ready() <-chan bool {
+	return c.ready
+}
+
+// Reset must be called before consuming again after a rebalance
+func (c *Consumer) Reset() {
+	c.ready = make(chan bool)
+}
+
+func (c *Consumer) Handle(message *sarama.ConsumerMessage) error {
+	for k, f := range c.handlers {
+		if message.Topic == k {
+			if c.skip {
+				log.Debug().Str("topic", message.Topic).Str("value", string(message.Value)).Msg("provisioning skipped")
+				return nil
+			}
+			return f(message)
+		}
+	}
+	return errors.New("no matching handler: " + message.Topic)
+}
+
+// handleWithRetry handles a message until it succeeds, every attempt fails or the context is done
+func (c *Consumer) handleWithRetry(ctx context.Context, message *sarama.ConsumerMessage) (int, error) {
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := c.Handle(message)
+		if err == nil {
+			return attempt, nil
+		}
+		if attempt >= c.attempts {
+			return attempt, err
+		}
+		stats.ConsumerRetried.Inc()
+		log.Warn().Err(err).Str("topic", message.Topic).Int64("offset", message.Offset).Int("attempt", attempt).Dur("backoff", backoff).Msg("retrying message")
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *Consumer) HandleFunc(topic string, f MessageHandler) {
+	c.handlers[topic] = f
+}
+
+// topicEvents are the event types of messages from before envelopes, in the order of the TOPICS list
+var topicEvents = []provisioner.EventType{
+	provisioner.PROVISION_PROJECT,
+	provisioner.DEPROVISION_PROJECT,
+	provisioner.PROVISION_TOKEN,
+	provisioner.DEPROVISION_TOKEN,
+}
+
+// topicTypes maps the configured provisioning topics to the event type of messages from before envelopes
+func topicTypes(topics []string) (map[string]provisioner.EventType, error) {
+	if len(topics) != len(topicEvents) {
+		return nil, fmt.Errorf("expected %d provisioning topics, got %d", len(topicEvents), len(topics))
+	}
+	types := make(map[string]provisioner.EventType, len(topics))
+	for i, topic := range topics {
+		types[topic] = topicEvents[i]
+	}
+	return types, nil
+}
+
+// HandleProvisioner handles the provisioning topics with a provisioner, topics are the provision, deprovision,
+// provision token and deprovision token topics in that order
+func (c *Consumer) HandleProvisioner(p provisioner.Provisioner, topics []string) error {
+	types, err := topicTypes(topics)
+	if err != nil {
+		return err
+	}
+	c.provisioner = p
+	c.coalesceTopics = map[string]bool{topics[0]: true}
+	for topic, t := range types {
+		t := t
+		c.HandleFunc(topic, func(message *sarama.ConsumerMessage) error {
+			e, err := decodeMessage(t, message)
+			if err != nil {
+				return err
+			}
+			return c.handleEnvelope(e)
+		})
+	}
+	return nil
+}
+
+// decodeMessage decodes the envelope of a message, messages without the envelope header only contain the id or token hash
+func decodeMessage(t provisioner.EventType, message *sarama.ConsumerMessage) (*provisioner.Envelope, error) {
+	for _, h := range message.Headers {
+		if string(h.Key) == provisioner.EnvelopeHeader {
+			return provisioner.DecodeEnvelope(message.Value)
+		}
+	}
+	e := &provisioner.Envelope{Type: t, Timestamp: message.Timestamp}
+	switch t {
+	case provisioner.PROVISION_PROJECT, provisioner.DEPROVISION_PROJECT:
+		e.ProjectID = string(message.Value)
+	case provisioner.PROVISION_TOKEN:
+		e.TokenID = string(message.Value)
+	case provisioner.DEPROVISION_TOKEN:
+		e.TokenHash = hex.EncodeToString(message.Value)
+	}
+	return e, nil
+}
+
+func (c *Consumer) handleEnvelope(e *provisioner.Envelope) error {
+	if c.stale(e) {
+		log.Debug().Str("id", e.ProjectID).Int64("sequence", e.Sequence).Msg("skipping stale event")
+		stats.StaleSkipped.Inc()
+		return nil
+	}
+	p := c.provisioner
+	ctx := provisioner.WithReason(context.Background(), e.Reason)
+	switch e.Type {
+	case provisioner.PROVISION_PROJECT:
+		log.Debug().Str("id", e.ProjectID).Str("reason", e.Reason).Msg("provisioning project")
+		stats.ProjectProvisioned.Inc()
+		if err := p.ProvisionProject(ctx, e.Project()); err != nil {
+			return err
+		}
+		c.handled(e)
+		return nil
+	case provisioner.DEPROVISION_PROJECT:
+		log.Debug().Str("id", e.ProjectID).Str("reason", e.Reason).Msg("deprovisioning project")
+		stats.ProjectDeprovisioned.Inc()
+		return p.DeprovisionProject(ctx, e.Project())
+	case provisioner.PROVISION_TOKEN:
+		log.Debug().Str("id", e.TokenID).Str("reason", e.Reason).Msg("provisioning token")
+		stats.ProjectProvisioned.Inc()
+		t, err := e.Token()
+		if err != nil {
+			return err
+		}
+		return p.ProvisionToken(ctx, t)
+	case provisioner.DEPROVISION_TOKEN:
+		log.Debug().Str("token_hash", e.TokenHash).Str("reason", e.Reason).Msg("deprovisioning token")
+		stats.ProjectDeprovisioned.Inc()
+		t, err := e.Token()
+		if err != nil {
+			return err
+		}
+		return p.DeprovisionToken(ctx, t)
+	}
+	return errors.New("unknown event type: " + string(e.Type))
+}
+
+// stale is true for project events with a lower sequence than an event that was already handled,
+// provisioning renders the latest flags so the newer event already provisioned its changes
+func (c *Consumer) stale(e *provisioner.Envelope) bool {
+	if e.Type != provisioner.PROVISION_PROJECT || e.Sequence == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.Sequence < c.sequences[e.ProjectID].value
+}
+
+func (c *Consumer) handled(e *provisioner.Envelope) {
+	if e.Sequence == 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.sequences[e.ProjectID]; e.Sequence > s.value {
+		c.sequences[e.ProjectID] = sequence{value: e.Sequence, handled: now}
+	}
+	if now.Sub(c.swept) > c.sequenceTTL {
+		c.sweep(now)
+	}
+}
+
+// sweep forgets projects whose last event was handled before the ttl, an event that is delayed longer than that is provisioned again
+func (c *Consumer) sweep(now time.Time) {
+	for id, s := range c.sequences {
+		if now.Sub(s.handled) > c.sequenceTTL {
+			delete(c.sequences, id)
+		}
+	}
+	c.swept = now
+}
+
+func (c *Consumer) Setup(sarama.ConsumerGroupSession) error {
+	close(c.ready)
+	return nil
+}
+
+func (c *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if c.window > 0 {
+		return c.consumeCoalesced(session, claim)
+	}
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if ok, err := c.consume(session, message); !ok {
+				return err
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// consume handles and marks a message, it returns false if the message wasn't handled because the session ended or couldn't be dead lettered
+func (c *Consumer) consume(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) (bool, error) {
+	attempts, err := c.handleWithRetry(session.Context(), message)
+	if err != nil {
+		// the message is consumed again by the next session
+		if session.Context().Err() != nil {
+			return false, nil
+		}
+		if err = c.deadLetter(message, attempts, err); err != nil {
+			return false, err
+		}
+	}
+	session.MarkMessage(message, "")
+	return true, nil
+}
@@ -0,0 +1,158 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConsumer_handleWithRetry(t *testing.T) {
+	c := NewConsumer(false)
+	c.Retry(3, time.Millisecond, time.Millisecond*2)
+	calls := 0
+	c.HandleFunc("vex-provision", func(message *sarama.ConsumerMessage) error {
+		calls++
+		if calls < 2 {
+			return errors.New("cloudflare unavailable")
+		}
+		return nil
+	})
+	attempts, err := c.handleWithRetry(context.Background(), &sarama.ConsumerMessage{Topic: "vex-provision"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	calls = -10
+	attempts, err = c.handleWithRetry(context.Background(), &sarama.ConsumerMessage{Topic: "vex-provision"})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestConsumer_deadLetter(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		sent = m
+		return nil
+	})
+	c := NewConsumer(false)
+	c.DeadLetter(producer, "vex-dlq")
+	message := &sarama.ConsumerMessage{Topic: "vex-provision", Partition: 1, Offset: 42, Key: []byte("p1"), Value: []byte("p1")}
+	err := c.deadLetter(message, 5, errors.New("cloudflare unavailable"))
+	assert.NoError(t, err)
+	assert.NoError(t, producer.Close())
+
+	assert.Equal(t, "vex-dlq", sent.Topic)
+	headers := make(map[string]string)
+	for _, h := range sent.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal(t, "vex-provision", headers[HeaderTopic])
+	assert.Equal(t, "42", headers[HeaderOffset])
+	assert.Equal(t, "5", headers[HeaderAttempts])
+	assert.Equal(t, "cloudflare unavailable", headers[HeaderError])
+
+	// replaying removes the dead letter headers and sends it back to the original topic
+	dlqHeaders := make([]*sarama.RecordHeader, 0, len(sent.Headers))
+	for i := range sent.Headers {
+		dlqHeaders = append(dlqHeaders, &sent.Headers[i])
+	}
+	replay, ok := NewReplayMessage(&sarama.ConsumerMessage{Topic: "vex-dlq", Key: []byte("p1"), Value: []byte("p1"), Headers: dlqHeaders})
+	assert.True(t, ok)
+	assert.Equal(t, "vex-provision", replay.Topic)
+	assert.Empty(t, replay.Headers)
+	assert.Equal(t, sarama.ByteEncoder("p1"), replay.Value)
+}
+
+func TestReplayer_Done(t *testing.T) {
+	r := NewReplayer(nil, map[int32]int64{0: 10, 1: 0})
+	r.finish(1)
+	select {
+	case <-r.Done():
+		t.Fatal("partition 0 isn't replayed")
+	default:
+	}
+	r.finish(0)
+	<-r.Done()
+}
+
+func TestConsumer_HandleProvisioner(t *testing.T) {
+	p := provisioner.NewMockProvisioner()
+	c := NewConsumer(false)
+	err := c.HandleProvisioner(p, []string{"vex-provision"})
+	assert.Error(t, err)
+	err = c.HandleProvisioner(p, []string{"vex-provision", "vex-deprovision", "vex-provision-token", "custom-deprovision-token"})
+	assert.NoError(t, err)
+
+	// messages from before envelopes only have the id, their type comes from the position of the topic in TOPICS
+	p.On("ProvisionProject", mock.Anything, &project.Project{ID: "p1"}).Return(nil).Once()
+	err = c.Handle(&sarama.ConsumerMessage{Topic: "vex-provision", Value: []byte("p1")})
+	assert.NoError(t, err)
+	p.On("DeprovisionToken", mock.Anything, &token.Token{TokenHash: []byte{0xab}}).Return(nil).Once()
+	err = c.Handle(&sarama.ConsumerMessage{Topic: "custom-deprovision-token", Value: []byte{0xab}})
+	assert.NoError(t, err)
+
+	envelope := func(e *provisioner.Envelope) *sarama.ConsumerMessage {
+		e.Version = provisioner.EnvelopeVersion
+		value, err := json.Marshal(e)
+		assert.NoError(t, err)
+		return &sarama.ConsumerMessage{
+			Topic:   "vex-provision",
+			Value:   value,
+			Headers: []*sarama.RecordHeader{{Key: []byte(provisioner.EnvelopeHeader), Value: []byte("1")}},
+		}
+	}
+	p.On("ProvisionProject", mock.Anything, &project.Project{ID: "p1", AccountID: "a1", Version: 5}).Return(nil).Once()
+	err = c.Handle(envelope(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, AccountID: "a1", ProjectID: "p1", Sequence: 5, Reason: "flags"}))
+	assert.NoError(t, err)
+
+	// an older sequence is skipped
+	err = c.Handle(envelope(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, AccountID: "a1", ProjectID: "p1", Sequence: 4}))
+	assert.NoError(t, err)
+
+	p.AssertExpectations(t)
+}
+
+func TestConsumer_sweep(t *testing.T) {
+	c := NewConsumer(false)
+	c.handled(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p1", Sequence: 5})
+	c.handled(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p2", Sequence: 3})
+	assert.True(t, c.stale(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p1", Sequence: 4}))
+
+	// p1 is handled again after the ttl, p2 isn't and is forgotten
+	c.sequences["p2"] = sequence{value: 3, handled: time.Now().Add(-time.Hour * 2)}
+	c.swept = time.Time{}
+	c.handled(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p1", Sequence: 6})
+	assert.Len(t, c.sequences, 1)
+	assert.False(t, c.stale(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p2", Sequence: 2}))
+	assert.True(t, c.stale(&provisioner.Envelope{Type: provisioner.PROVISION_PROJECT, ProjectID: "p1", Sequence: 5}))
+}
+
+func TestCoalesce(t *testing.T) {
+	c := NewConsumer(false)
+	err := c.HandleProvisioner(provisioner.NewMockProvisioner(), []string{"custom-provision", "vex-deprovision", "vex-provision-token", "vex-deprovision-token"})
+	assert.NoError(t, err)
+	messages := []*sarama.ConsumerMessage{
+		{Topic: "custom-provision", Key: []byte("p1"), Offset: 0},
+		{Topic: "custom-provision", Key: []byte("p2"), Offset: 1},
+		{Topic: "vex-provision-token", Key: []byte("t1"), Offset: 2},
+		{Topic: "custom-provision", Key: []byte("p1"), Offset: 3},
+		{Topic: "vex-provision-token", Key: []byte("t1"), Offset: 4},
+		{Topic: "custom-provision", Key: []byte("p1"), Offset: 5},
+	}
+	offsets := make([]int64, 0)
+	for _, m := range coalesce(messages, c.coalesceTopics) {
+		offsets = append(offsets, m.Offset)
+	}
+	// the last message for p1 on the configured provision topic wins, token messages aren't coalesced
+	assert.Equal(t, []int64{1, 2, 4, 5}, offsets)
+}
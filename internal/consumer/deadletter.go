@@ -0,0 +1,184 @@
+package consumer
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/rs/zerolog/log"
+)
+
+// headers added to dead lettered messages, they are removed when the message is replayed
+const (
+	HeaderPrefix    = "vex-dlq-"
+	HeaderTopic     = HeaderPrefix + "topic"
+	HeaderPartition = HeaderPrefix + "partition"
+	HeaderOffset    = HeaderPrefix + "offset"
+	HeaderAttempts  = HeaderPrefix + "attempts"
+	HeaderError     = HeaderPrefix + "error"
+	HeaderTime      = HeaderPrefix + "time"
+)
+
+// deadLetter sends a message that failed every attempt to the dead letter topic with the error attached
+func (c *Consumer) deadLetter(message *sarama.ConsumerMessage, attempts int, err error) error {
+	log.Error().Err(err).Str("topic", message.Topic).Int64("offset", message.Offset).Int("attempts", attempts).Msg("could not handle message")
+	if c.producer == nil {
+		return nil
+	}
+	_, _, perr := c.producer.SendMessage(NewDeadLetterMessage(c.deadLetterTopic, message, attempts, err))
+	if perr != nil {
+		log.Error().Err(perr).Str("topic", c.deadLetterTopic).Msg("could not dead letter message")
+		return perr
+	}
+	stats.DeadLettered.Inc()
+	return nil
+}
+
+// NewDeadLetterMessage copies a message to the dead letter topic with headers for where it came from and why it failed
+func NewDeadLetterMessage(topic string, message *sarama.ConsumerMessage, attempts int, err error) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+6)
+	for _, h := range message.Headers {
+		headers = append(headers, *h)
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderTopic), Value: []byte(message.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderPartition), Value: []byte(strconv.FormatInt(int64(message.Partition), 10))},
+		sarama.RecordHeader{Key: []byte(HeaderOffset), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(HeaderAttempts), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(HeaderError), Value: []byte(err.Error())},
+		sarama.RecordHeader{Key: []byte(HeaderTime), Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+	return &sarama.ProducerMessage{
+		Topic:     topic,
+		Key:       sarama.ByteEncoder(message.Key),
+		Value:     sarama.ByteEncoder(message.Value),
+		Headers:   headers,
+		Timestamp: time.Now(),
+	}
+}
+
+// NewReplayMessage copies a dead lettered message back to the topic it came from, ok is false if the topic is unknown
+func NewReplayMessage(message *sarama.ConsumerMessage) (*sarama.ProducerMessage, bool) {
+	var topic string
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers))
+	for _, h := range message.Headers {
+		if string(h.Key) == HeaderTopic {
+			topic = string(h.Value)
+		}
+		if strings.HasPrefix(string(h.Key), HeaderPrefix) {
+			continue
+		}
+		headers = append(headers, *h)
+	}
+	if topic == "" {
+		return nil, false
+	}
+	return &sarama.ProducerMessage{
+		Topic:     topic,
+		Key:       sarama.ByteEncoder(message.Key),
+		Value:     sarama.ByteEncoder(message.Value),
+		Headers:   headers,
+		Timestamp: time.Now(),
+	}, true
+}
+
+// Replayer sends dead lettered messages back to the topic they came from.
+// It stops at the end offsets of the dead letter topic when it started, so messages that fail again aren't replayed in a loop.
+type Replayer struct {
+	producer sarama.SyncProducer
+	// until is the end offset of each partition of the dead letter topic
+	until   map[int32]int64
+	mu      sync.Mutex
+	pending map[int32]bool
+	done    chan struct{}
+}
+
+func NewReplayer(producer sarama.SyncProducer, until map[int32]int64) *Replayer {
+	pending := make(map[int32]bool)
+	for partition := range until {
+		pending[partition] = true
+	}
+	r := &Replayer{
+		producer: producer,
+		until:    until,
+		pending:  pending,
+		done:     make(chan struct{}),
+	}
+	if len(pending) == 0 {
+		close(r.done)
+	}
+	return r
+}
+
+// Done is closed when every partition was replayed up to its end offset
+func (r *Replayer) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Replayer) finish(partition int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.pending[partition] {
+		return
+	}
+	delete(r.pending, partition)
+	if len(r.pending) == 0 {
+		close(r.done)
+	}
+}
+
+func (r *Replayer) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (r *Replayer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (r *Replayer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	until := r.until[claim.Partition()]
+	if claim.InitialOffset() >= until {
+		r.finish(claim.Partition())
+		return nil
+	}
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if message.Offset >= until {
+				r.finish(claim.Partition())
+				return nil
+			}
+			if err := r.Replay(message); err != nil {
+				return err
+			}
+			session.MarkMessage(message, "")
+			if message.Offset+1 >= until {
+				r.finish(claim.Partition())
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Replay sends a dead lettered message back to the topic it came from, messages without a topic are skipped
+func (r *Replayer) Replay(message *sarama.ConsumerMessage) error {
+	replay, ok := NewReplayMessage(message)
+	if !ok {
+		log.Warn().Int32("partition", message.Partition).Int64("offset", message.Offset).Msg("dead lettered message has no topic")
+		return nil
+	}
+	if _, _, err := r.producer.SendMessage(replay); err != nil {
+		return err
+	}
+	stats.Replayed.Inc()
+	log.Debug().Str("topic", replay.Topic).Int64("offset", message.Offset).Msg("replayed message")
+	return nil
+}
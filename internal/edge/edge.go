@@ -0,0 +1,146 @@
+package edge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/provisioner"
+	"github.com/rs/zerolog/log"
+)
+
+// Handler serves rendered configs from kv stores the same way the Cloudflare Worker does.
+// Configs are requested with /{projectId} or /v2/{projectId} and a bearer token for the project account.
+type Handler struct {
+	projects kv.Store
+	tokens   kv.Store
+}
+
+func NewHandler(projects, tokens kv.Store) *Handler {
+	return &Handler{
+		projects: projects,
+		tokens:   tokens,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	//v2 configs are requested with /v2/{projectId} and stored under the same key
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	projectId := strings.TrimPrefix(key, "v2/")
+
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+	hash := sha256.Sum256([]byte(token))
+	tokenAccount, err := h.tokens.Get(r.Context(), hex.EncodeToString(hash[:]))
+	if err != nil {
+		if !errors.As(err, &kv.ErrKeyNotFound{}) {
+			log.Error().Err(err).Msg("could not get token")
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if len(projectId) != 36 {
+		http.Error(w, "invalid project id", http.StatusBadRequest)
+		return
+	}
+	config, err := h.projects.Get(r.Context(), key)
+	if err != nil && !errors.As(err, &kv.ErrKeyNotFound{}) {
+		log.Error().Err(err).Str("key", key).Msg("could not get config")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	metadata := provisioner.Metadata{}
+	if config != nil && len(config.Metadata) > 0 {
+		if err := json.Unmarshal(config.Metadata, &metadata); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("invalid config metadata")
+		}
+	}
+
+	//reject if the token account doesn't match the project account, missing configs are rejected too so project ids can't be enumerated
+	if metadata.AccountID == "" || metadata.AccountID != string(tokenAccount.Value) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	//the content hash is used as the etag so pollers can skip unchanged configs
+	if metadata.Hash != "" {
+		etag := `"` + metadata.Hash + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	value := config.Value
+	//large configs are stored as a manifest of shards
+	if metadata.Shards > 0 {
+		value, err = h.assemble(r, config.Value)
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("could not assemble sharded config")
+			//the shards were replaced by a newer config while they were read
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "config is being updated", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	//signed configs include the signature and key id so clients can verify them against the published keys
+	if metadata.Signature != "" && metadata.KeyID != "" {
+		w.Header().Set("X-Vex-Signature", metadata.Signature)
+		w.Header().Set("X-Vex-Key-Id", metadata.KeyID)
+	}
+	w.Write(value)
+}
+
+// assemble reads the shards in a manifest and checks that they add up to the config with the manifest hash
+func (h *Handler) assemble(r *http.Request, value []byte) ([]byte, error) {
+	manifest := provisioner.Manifest{}
+	if err := json.Unmarshal(value, &manifest); err != nil {
+		return nil, err
+	}
+	config := make([]byte, 0, manifest.Size)
+	for _, key := range manifest.Shards {
+		shard, err := h.projects.Get(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		config = append(config, shard.Value...)
+	}
+	hash := sha256.Sum256(config)
+	if hex.EncodeToString(hash[:]) != manifest.Hash {
+		return nil, errors.New("shards don't match the manifest hash")
+	}
+	return config, nil
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return parts[1]
+}
+
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
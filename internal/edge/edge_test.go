@@ -0,0 +1,119 @@
+package edge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/provisioner"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	accountID = "cb6049d9-7720-4442-89be-f9500c72a73b"
+	projectID = "ed7f9f1c-4416-4f2f-8ff1-cfe10c8d14e0"
+	tokenID   = "da863681-2f59-432d-848d-a64fbfbeab51"
+)
+
+func provision(t *testing.T, projects, tokens kv.Store) *provisioner.KVProvisioner {
+	projectStore := project.NewMockStore()
+	projectStore.On("Configs", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, &project.Configs{}, nil)
+	projectStore.On("Get", mock.Anything, projectID).Return(&project.Project{ID: projectID, AccountID: accountID}, nil)
+	projectStore.On("SetConfigs", mock.Anything, projectID, mock.Anything).Return(nil)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, projectID).Return(&flag.Snapshot{Flags: []*flag.Flag{
+		{Key: "feature1", Type: flag.BOOLEAN, Value: "true"},
+	}}, nil)
+	tokenHash := sha256.Sum256([]byte("abc123"))
+	tokenStore := token.NewMockStore()
+	tokenStore.On("Get", mock.Anything, tokenID).Return(&token.Token{ID: tokenID, AccountID: accountID, TokenHash: tokenHash[:]}, nil)
+
+	p := provisioner.NewKVProvisioner(projects, tokens, provisioner.NewRenderer(projectStore, flagStore, nil), tokenStore, nil)
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: projectID}))
+	assert.Nil(t, p.ProvisionToken(context.Background(), &token.Token{ID: tokenID}))
+	return p
+}
+
+func get(h http.Handler, path, token string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandler(t *testing.T) {
+	projects, tokens := kv.NewMemoryStore(), kv.NewMemoryStore()
+	p := provision(t, projects, tokens)
+	h := NewHandler(projects, tokens)
+
+	rr := get(h, "/"+projectID, "abc123")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "{\"feature1\":{\"value\":\"true\",\"type\":\"BOOLEAN\"}}\n", rr.Body.String())
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	rr = get(h, "/"+projectID, "abc123", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	rr = get(h, "/v2/"+projectID, "abc123")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), projectID)
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/"+projectID, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/"+projectID, "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, get(h, "/1", "abc123").Code)
+
+	//tokens can't read projects from other accounts
+	otherHash := sha256.Sum256([]byte("other"))
+	assert.Nil(t, tokens.Put(context.Background(), hex.EncodeToString(otherHash[:]), &kv.Entry{Value: []byte("other-account")}))
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/"+projectID, "other").Code)
+
+	assert.Nil(t, p.DeprovisionProject(context.Background(), &project.Project{ID: projectID}))
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/"+projectID, "abc123").Code)
+
+	tokenHash := sha256.Sum256([]byte("abc123"))
+	assert.Nil(t, p.DeprovisionToken(context.Background(), &token.Token{TokenHash: tokenHash[:]}))
+	_, err := tokens.Get(context.Background(), hex.EncodeToString(tokenHash[:]))
+	assert.ErrorAs(t, err, &kv.ErrKeyNotFound{})
+}
+
+func TestHandler_Sharded(t *testing.T) {
+	projects, tokens := kv.NewMemoryStore(), kv.NewMemoryStore()
+	p := provision(t, projects, tokens)
+	h := NewHandler(projects, tokens)
+	p.Shard(16)
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: projectID}))
+
+	rr := get(h, "/"+projectID, "abc123")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "{\"feature1\":{\"value\":\"true\",\"type\":\"BOOLEAN\"}}\n", rr.Body.String())
+	hash := strings.Trim(rr.Header().Get("ETag"), `"`)
+	shard, err := projects.Get(context.Background(), provisioner.ShardKey(projectID, hash, 0))
+	assert.Nil(t, err)
+	assert.Len(t, shard.Value, 16)
+
+	//a missing shard is reported as a config that is being updated
+	assert.Nil(t, projects.Delete(context.Background(), provisioner.ShardKey(projectID, hash, 1)))
+	rr = get(h, "/"+projectID, "abc123")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	assert.Nil(t, p.DeprovisionProject(context.Background(), &project.Project{ID: projectID}))
+	_, err = projects.Get(context.Background(), provisioner.ShardKey(projectID, hash, 0))
+	assert.ErrorAs(t, err, &kv.ErrKeyNotFound{})
+}
@@ -0,0 +1,122 @@
+package event
+
+import (
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+)
+
+const (
+	SpecVersion = "1.0"
+	// TypePrefix namespaces event types in CloudEvents, eg. com.broswen.vex.flag.updated
+	TypePrefix = "com.broswen.vex."
+	// ContentType is the content type of CloudEvents in structured mode
+	ContentType = "application/cloudevents+json"
+)
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Data      `json:"data"`
+}
+
+type Data struct {
+	AccountID string `json:"account_id"`
+	ProjectID string `json:"project_id,omitempty"`
+	Before    any    `json:"before"`
+	After     any    `json:"after"`
+	Actor     string `json:"actor,omitempty"`
+}
+
+// NewCloudEvent converts an event, the source is the account or project that the resource belongs to
+func NewCloudEvent(e *Event) *CloudEvent {
+	source := "/accounts/" + e.AccountID
+	if e.ProjectID != "" {
+		source += "/projects/" + e.ProjectID
+	}
+	return &CloudEvent{
+		SpecVersion:     SpecVersion,
+		ID:              e.ID,
+		Source:          source,
+		Type:            TypePrefix + string(e.Type),
+		Subject:         subject(e),
+		Time:            e.CreatedOn,
+		DataContentType: "application/json",
+		Data: Data{
+			AccountID: e.AccountID,
+			ProjectID: e.ProjectID,
+			Before:    e.Before,
+			After:     e.After,
+			Actor:     e.Actor,
+		},
+	}
+}
+
+// subject is the id of the changed resource
+func subject(e *Event) string {
+	for _, v := range []any{e.After, e.Before} {
+		switch r := v.(type) {
+		case *account.Account:
+			return r.ID
+		case *project.Project:
+			return r.ID
+		case *flag.Flag:
+			return r.ID
+		case *token.Token:
+			return r.ID
+		}
+	}
+	return ""
+}
+
+// Split splits a flag.replaced event into an event for each flag that was created, updated or deleted.
+// Other events are returned as is.
+func Split(e *Event) []*Event {
+	if e.Type != FlagsReplaced {
+		return []*Event{e}
+	}
+	before, _ := e.Before.([]*flag.Flag)
+	after, _ := e.After.([]*flag.Flag)
+	old := make(map[string]*flag.Flag, len(before))
+	for _, f := range before {
+		old[f.Key] = f
+	}
+	events := make([]*Event, 0)
+	split := func(t Type, before, after *flag.Flag) {
+		s := New(t, e.AccountID, e.ProjectID, nil, nil)
+		if before != nil {
+			s.Before = before
+		}
+		if after != nil {
+			s.After = after
+		}
+		s.Actor = e.Actor
+		s.CreatedOn = e.CreatedOn
+		events = append(events, s)
+	}
+	for _, f := range after {
+		o, ok := old[f.Key]
+		switch {
+		case !ok:
+			split(FlagCreated, nil, f)
+		case o.Type != f.Type || o.Value != f.Value:
+			split(FlagUpdated, o, f)
+		}
+		delete(old, f.Key)
+	}
+	for _, f := range before {
+		if _, ok := old[f.Key]; ok {
+			split(FlagDeleted, f, nil)
+		}
+	}
+	return events
+}
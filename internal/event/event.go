@@ -0,0 +1,97 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+type Type string
+
+const (
+	AccountCreated Type = "account.created"
+	AccountUpdated Type = "account.updated"
+	AccountDeleted Type = "account.deleted"
+	ProjectCreated Type = "project.created"
+	ProjectUpdated Type = "project.updated"
+	ProjectDeleted Type = "project.deleted"
+	FlagCreated    Type = "flag.created"
+	FlagUpdated    Type = "flag.updated"
+	FlagDeleted    Type = "flag.deleted"
+	FlagsReplaced  Type = "flag.replaced"
+	TokenCreated   Type = "token.created"
+	TokenUpdated   Type = "token.updated"
+	TokenDeleted   Type = "token.deleted"
+)
+
+var Types = []Type{
+	AccountCreated, AccountUpdated, AccountDeleted,
+	ProjectCreated, ProjectUpdated, ProjectDeleted,
+	FlagCreated, FlagUpdated, FlagDeleted, FlagsReplaced,
+	TokenCreated, TokenUpdated, TokenDeleted,
+}
+
+func ValidType(t Type) bool {
+	for _, v := range Types {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Event describes a change to an account, project, flag or token.
+// Before and After are the resource before and after the change, Before is null for creates and After is null for deletes.
+type Event struct {
+	ID        string `json:"id"`
+	Type      Type   `json:"type"`
+	AccountID string `json:"account_id"`
+	// ProjectID is empty for account and token events
+	ProjectID string `json:"project_id,omitempty"`
+	Before    any    `json:"before"`
+	After     any    `json:"after"`
+	// Actor is the id of the token that made the change, it is empty for changes made through the admin api
+	Actor     string    `json:"actor,omitempty"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+func New(t Type, accountId, projectId string, before, after any) *Event {
+	return &Event{
+		ID:        newID(),
+		Type:      t,
+		AccountID: accountId,
+		ProjectID: projectId,
+		Before:    before,
+		After:     after,
+		CreatedOn: time.Now().UTC(),
+	}
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, e *Event) error
+}
+
+// Multi publishes events to every publisher and returns the first error
+type Multi []Publisher
+
+func (m Multi) Publish(ctx context.Context, e *Event) error {
+	var err error
+	for _, p := range m {
+		if perr := p.Publish(ctx, e); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// newID returns a random version 4 UUID
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
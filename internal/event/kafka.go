@@ -0,0 +1,69 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+)
+
+// KafkaPublisher publishes events to a topic as CloudEvents, keyed by project id so changes to a project stay ordered.
+// Account and token events are keyed by account id.
+type KafkaPublisher struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func NewKafkaPublisher(topic, broker string) (*KafkaPublisher, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "vex-changes"
+	version, err := sarama.ParseKafkaVersion("3.1.0")
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+	config.Producer.Return.Errors = true
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	producer, err := sarama.NewSyncProducer([]string{broker}, config)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaPublisher{
+		topic:    topic,
+		producer: producer,
+	}, nil
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, e *Event) error {
+	messages := make([]*sarama.ProducerMessage, 0)
+	for _, s := range Split(e) {
+		value, err := json.Marshal(NewCloudEvent(s))
+		if err != nil {
+			return err
+		}
+		key := s.ProjectID
+		if key == "" {
+			key = s.AccountID
+		}
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic: p.topic,
+			Key:   sarama.StringEncoder(key),
+			Value: sarama.ByteEncoder(value),
+			Headers: []sarama.RecordHeader{
+				{Key: []byte("content-type"), Value: []byte(ContentType)},
+			},
+			Timestamp: s.CreatedOn,
+		})
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return p.producer.SendMessages(messages)
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.producer.Close()
+}
@@ -0,0 +1,79 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	before := []*flag.Flag{
+		{ID: "1", Key: "a", Type: flag.STRING, Value: "a"},
+		{ID: "2", Key: "b", Type: flag.STRING, Value: "b"},
+		{ID: "3", Key: "c", Type: flag.STRING, Value: "c"},
+	}
+	after := []*flag.Flag{
+		{ID: "4", Key: "a", Type: flag.STRING, Value: "a"},
+		{ID: "5", Key: "b", Type: flag.STRING, Value: "changed"},
+		{ID: "6", Key: "d", Type: flag.BOOLEAN, Value: "true"},
+	}
+	e := New(FlagsReplaced, "account", "project", before, after)
+	e.Actor = "token"
+	events := Split(e)
+	assert.Len(t, events, 3)
+	assert.Equal(t, FlagUpdated, events[0].Type)
+	assert.Equal(t, "b", events[0].After.(*flag.Flag).Key)
+	assert.Equal(t, FlagCreated, events[1].Type)
+	assert.Equal(t, "d", events[1].After.(*flag.Flag).Key)
+	assert.Nil(t, events[1].Before)
+	assert.Equal(t, FlagDeleted, events[2].Type)
+	assert.Equal(t, "c", events[2].Before.(*flag.Flag).Key)
+	assert.Nil(t, events[2].After)
+	for _, s := range events {
+		assert.Equal(t, "project", s.ProjectID)
+		assert.Equal(t, "token", s.Actor)
+	}
+
+	e = New(FlagCreated, "account", "project", nil, after[0])
+	assert.Equal(t, []*Event{e}, Split(e))
+}
+
+func TestKafkaPublisher_Publish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	p := &KafkaPublisher{topic: "vex-changes", producer: producer}
+
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		key, _ := m.Key.Encode()
+		assert.Equal(t, "project", string(key))
+		assert.Equal(t, ContentType, string(m.Headers[0].Value))
+		value, _ := m.Value.Encode()
+		ce := map[string]any{}
+		assert.Nil(t, json.Unmarshal(value, &ce))
+		assert.Equal(t, "1.0", ce["specversion"])
+		assert.Equal(t, "com.broswen.vex.flag.updated", ce["type"])
+		assert.Equal(t, "/accounts/account/projects/project", ce["source"])
+		assert.Equal(t, "1", ce["subject"])
+		data := ce["data"].(map[string]any)
+		assert.Equal(t, "token", data["actor"])
+		assert.Equal(t, "old", data["before"].(map[string]any)["value"])
+		assert.Equal(t, "new", data["after"].(map[string]any)["value"])
+		return nil
+	})
+	e := New(FlagUpdated, "account", "project", &flag.Flag{ID: "1", Value: "old"}, &flag.Flag{ID: "1", Value: "new"})
+	e.Actor = "token"
+	assert.Nil(t, p.Publish(context.Background(), e))
+
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		key, _ := m.Key.Encode()
+		assert.Equal(t, "account", string(key))
+		return nil
+	})
+	assert.Nil(t, p.Publish(context.Background(), New(TokenDeleted, "account", "", &token.Token{ID: "1"}, nil)))
+	assert.Nil(t, producer.Close())
+}
@@ -0,0 +1,20 @@
+package event
+
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockPublisher struct {
+	mock.Mock
+}
+
+func NewMockPublisher() *MockPublisher {
+	return &MockPublisher{}
+}
+
+func (m *MockPublisher) Publish(ctx context.Context, e *Event) error {
+	args := m.Called(ctx, e)
+	return args.Error(0)
+}
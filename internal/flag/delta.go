@@ -0,0 +1,108 @@
+package flag
+
+import "sort"
+
+type ChangeType string
+
+const (
+	CREATED ChangeType = "CREATED"
+	UPDATED ChangeType = "UPDATED"
+	DELETED ChangeType = "DELETED"
+)
+
+// Change records that a flag key changed in a project version
+type Change struct {
+	ProjectID string     `json:"project_id"`
+	Version   int64      `json:"version"`
+	Key       string     `json:"key"`
+	Type      ChangeType `json:"type"`
+}
+
+// Snapshot is every flag of a project and the project versions they were read at
+type Snapshot struct {
+	Version       int64
+	PrunedVersion int64
+	Flags         []*Flag
+}
+
+// Delta is the difference between the config at Since and the config at Version.
+// If Full is true the delta couldn't be computed and Added contains the full config.
+type Delta struct {
+	ProjectID string            `json:"project_id"`
+	Since     int64             `json:"since"`
+	Version   int64             `json:"version"`
+	Full      bool              `json:"full"`
+	Added     map[string]FlagV2 `json:"added"`
+	Changed   map[string]FlagV2 `json:"changed"`
+	Removed   []string          `json:"removed"`
+}
+
+// FullDelta returns a delta with every flag added
+func FullDelta(projectId string, version int64, flags []*Flag) (*Delta, error) {
+	d := &Delta{
+		ProjectID: projectId,
+		Version:   version,
+		Full:      true,
+		Added:     make(map[string]FlagV2),
+		Changed:   make(map[string]FlagV2),
+		Removed:   make([]string, 0),
+	}
+	var err error
+	for _, f := range flags {
+		d.Added[f.Key], err = newFlagV2(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// NewDelta computes the delta from the changes after since, ordered by version, and the current flags.
+// A key was present at since unless its first change created it, and is present now if it's in flags.
+// Hidden are the keys of SECRET flags that are left out of the config, they are only left out of the delta if they didn't
+// exist at since. A hidden key that changed could have been in the client's config, eg. a STRING flag that became a SECRET,
+// so the full config is returned instead of reporting that it was removed.
+func NewDelta(projectId string, since, version int64, changes []*Change, flags []*Flag, hidden []string) (*Delta, error) {
+	d := &Delta{
+		ProjectID: projectId,
+		Since:     since,
+		Version:   version,
+		Added:     make(map[string]FlagV2),
+		Changed:   make(map[string]FlagV2),
+		Removed:   make([]string, 0),
+	}
+	existed := make(map[string]bool)
+	for _, c := range changes {
+		if _, ok := existed[c.Key]; !ok {
+			existed[c.Key] = c.Type != CREATED
+		}
+	}
+	for _, key := range hidden {
+		if existed[key] {
+			return FullDelta(projectId, version, flags)
+		}
+	}
+	current := make(map[string]*Flag, len(flags))
+	for _, f := range flags {
+		current[f.Key] = f
+	}
+	for key, before := range existed {
+		f, ok := current[key]
+		switch {
+		case ok:
+			v, err := newFlagV2(f)
+			if err != nil {
+				return nil, err
+			}
+			if before {
+				d.Changed[key] = v
+			} else {
+				d.Added[key] = v
+			}
+		case before:
+			d.Removed = append(d.Removed, key)
+		}
+	}
+	sort.Strings(d.Removed)
+	return d, nil
+}
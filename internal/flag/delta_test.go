@@ -0,0 +1,67 @@
+package flag
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDelta(t *testing.T) {
+	changes := []*Change{
+		{Version: 2, Key: "changed", Type: UPDATED},
+		{Version: 2, Key: "added", Type: CREATED},
+		{Version: 3, Key: "removed", Type: DELETED},
+		{Version: 3, Key: "temporary", Type: CREATED},
+		{Version: 4, Key: "temporary", Type: DELETED},
+		{Version: 4, Key: "recreated", Type: DELETED},
+		{Version: 5, Key: "recreated", Type: CREATED},
+	}
+	flags := []*Flag{
+		{Key: "changed", Type: BOOLEAN, Value: "true"},
+		{Key: "added", Type: NUMBER, Value: "1"},
+		{Key: "recreated", Type: STRING, Value: "a"},
+		{Key: "unchanged", Type: STRING, Value: "b"},
+	}
+	d, err := NewDelta("1", 1, 5, changes, flags, nil)
+	assert.Nil(t, err)
+	assert.False(t, d.Full)
+	assert.Equal(t, int64(1), d.Since)
+	assert.Equal(t, int64(5), d.Version)
+	assert.Equal(t, map[string]FlagV2{
+		"added": {Type: NUMBER, Value: json.Number("1")},
+	}, d.Added)
+	assert.Equal(t, map[string]FlagV2{
+		"changed":   {Type: BOOLEAN, Value: true},
+		"recreated": {Type: STRING, Value: "a"},
+	}, d.Changed)
+	assert.Equal(t, []string{"removed"}, d.Removed)
+}
+
+func TestNewDelta_Secret(t *testing.T) {
+	flags := []*Flag{
+		{Key: "feature1", Type: STRING, Value: "a"},
+	}
+	//a secret that was created since the client's version is left out
+	d, err := NewDelta("1", 1, 2, []*Change{{Version: 2, Key: "api_key", Type: CREATED}}, flags, []string{"api_key"})
+	assert.Nil(t, err)
+	assert.False(t, d.Full)
+	assert.Empty(t, d.Added)
+	assert.Empty(t, d.Removed)
+
+	//a STRING flag that became a SECRET still exists, so the full config is returned instead of removing it
+	d, err = NewDelta("1", 1, 2, []*Change{{Version: 2, Key: "api_key", Type: UPDATED}}, flags, []string{"api_key"})
+	assert.Nil(t, err)
+	assert.True(t, d.Full)
+	assert.Equal(t, map[string]FlagV2{"feature1": {Type: STRING, Value: "a"}}, d.Added)
+	assert.Empty(t, d.Removed)
+}
+
+func TestFullDelta(t *testing.T) {
+	d, err := FullDelta("1", 5, []*Flag{{Key: "a", Type: STRING, Value: "b"}})
+	assert.Nil(t, err)
+	assert.True(t, d.Full)
+	assert.Equal(t, map[string]FlagV2{"a": {Type: STRING, Value: "b"}}, d.Added)
+	assert.Empty(t, d.Changed)
+	assert.Empty(t, d.Removed)
+}
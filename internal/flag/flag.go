@@ -2,8 +2,14 @@ package flag
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,8 +19,13 @@ const (
 	STRING  Type = "STRING"
 	BOOLEAN Type = "BOOLEAN"
 	NUMBER  Type = "NUMBER"
+	// SECRET values are encrypted at rest and masked when listed
+	SECRET Type = "SECRET"
 )
 
+// SecretMask replaces the value of SECRET flags in responses
+const SecretMask = "********"
+
 type Flag struct {
 	ID         string    `json:"id"`
 	ProjectID  string    `json:"project_id" db:"project_id"`
@@ -45,11 +56,12 @@ func Validate(f Flag) error {
 			return ErrInvalidData{"invalid value for boolean flag"}
 		}
 	case NUMBER:
-		_, err := strconv.ParseFloat(f.Value, 64)
-		if err != nil {
+		//NaN and Inf parse but can't be rendered as JSON numbers
+		v, err := strconv.ParseFloat(f.Value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
 			return ErrInvalidData{"invalid value for number flag"}
 		}
-	case STRING:
+	case STRING, SECRET:
 	case "":
 		return ErrInvalidData{"flag type must not be empty"}
 	default:
@@ -58,14 +70,26 @@ func Validate(f Flag) error {
 	return nil
 }
 
+// Mask returns a copy of a SECRET flag with the value replaced by SecretMask, other flags are returned as is
+func Mask(f *Flag) *Flag {
+	if f.Type != SECRET {
+		return f
+	}
+	masked := *f
+	masked.Value = SecretMask
+	return &masked
+}
+
 type JsonFlag struct {
 	Value string `json:"value"`
 	Type  Type   `json:"type"`
 }
 
+// RenderConfig renders flags as a map keyed by flag key.
+// encoding/json sorts map keys, so the same set of flags always renders the same bytes.
 func RenderConfig(flags []*Flag) ([]byte, error) {
 	config := make(map[string]JsonFlag)
-	for _, f := range flags {
+	for _, f := range sortFlags(flags) {
 		config[f.Key] = JsonFlag{
 			Value: f.Value,
 			Type:  f.Type,
@@ -75,3 +99,150 @@ func RenderConfig(flags []*Flag) ([]byte, error) {
 	err := json.NewEncoder(b).Encode(config)
 	return b.Bytes(), err
 }
+
+// RenderNestedConfig splits each flag key on "." and renders the flags as nested objects,
+// so "db.pool.max" is rendered as {"db":{"pool":{"max":{...}}}}
+func RenderNestedConfig(flags []*Flag) ([]byte, error) {
+	if err := ValidateNestedKeys(flags); err != nil {
+		return nil, err
+	}
+	config := make(map[string]any)
+	for _, f := range sortFlags(flags) {
+		parts := strings.Split(f.Key, ".")
+		node := config
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = JsonFlag{
+			Value: f.Value,
+			Type:  f.Type,
+		}
+	}
+	b := bytes.NewBuffer([]byte{})
+	err := json.NewEncoder(b).Encode(config)
+	return b.Bytes(), err
+}
+
+// ValidateNestedKeys checks that a set of flag keys can be rendered as nested objects.
+// A key can't have empty path segments and can't be a prefix path of another key, like "db" and "db.pool".
+func ValidateNestedKeys(flags []*Flag) error {
+	keys := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		if keys[f.Key] {
+			return ErrInvalidData{fmt.Sprintf("flag key %q is not unique", f.Key)}
+		}
+		keys[f.Key] = true
+	}
+	for _, f := range flags {
+		parts := strings.Split(f.Key, ".")
+		for i, part := range parts {
+			if part == "" {
+				return ErrInvalidData{fmt.Sprintf("flag key %q has an empty path segment", f.Key)}
+			}
+			if prefix := strings.Join(parts[:i], "."); i > 0 && keys[prefix] {
+				return ErrInvalidData{fmt.Sprintf("flag key %q conflicts with %q", f.Key, prefix)}
+			}
+		}
+	}
+	return nil
+}
+
+// SchemaVersionV2 is the schema version of configs rendered with RenderConfigV2
+const SchemaVersionV2 = 2
+
+type ConfigV2 struct {
+	SchemaVersion int               `json:"schema_version"`
+	ProjectID     string            `json:"project_id"`
+	Version       string            `json:"version"`
+	Flags         map[string]FlagV2 `json:"flags"`
+}
+
+type FlagV2 struct {
+	Type       Type      `json:"type"`
+	Value      any       `json:"value"`
+	ModifiedOn time.Time `json:"modified_on"`
+}
+
+// TypedValue converts the raw string value of a flag into the native value for its type
+func TypedValue(f *Flag) (any, error) {
+	switch f.Type {
+	case BOOLEAN:
+		return strconv.ParseBool(f.Value)
+	case NUMBER:
+		// keep the original representation if it's already a valid JSON number
+		if json.Valid([]byte(f.Value)) {
+			return json.Number(f.Value), nil
+		}
+		return strconv.ParseFloat(f.Value, 64)
+	default:
+		return f.Value, nil
+	}
+}
+
+// ConfigVersion is a hash of the flag keys, types and values of a project.
+// It changes whenever the contents of the rendered config change.
+func ConfigVersion(flags []*Flag) (string, error) {
+	rendered, err := RenderConfig(flags)
+	if err != nil {
+		return "", err
+	}
+	return ContentHash(rendered), nil
+}
+
+// ContentHash is the hex encoded SHA-256 hash of a rendered config
+func ContentHash(rendered []byte) string {
+	hash := sha256.Sum256(rendered)
+	return hex.EncodeToString(hash[:])
+}
+
+// sortFlags returns a copy of flags sorted by key
+func sortFlags(flags []*Flag) []*Flag {
+	sorted := make([]*Flag, len(flags))
+	copy(sorted, flags)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// newFlagV2 converts a flag to its v2 representation with a native JSON value
+func newFlagV2(f *Flag) (FlagV2, error) {
+	value, err := TypedValue(f)
+	if err != nil {
+		return FlagV2{}, ErrInvalidData{fmt.Sprintf("invalid value for flag %q", f.Key)}
+	}
+	return FlagV2{
+		Type:       f.Type,
+		Value:      value,
+		ModifiedOn: f.ModifiedOn,
+	}, nil
+}
+
+// RenderConfigV2 renders flags with native JSON booleans and numbers, along with the project id,
+// config version and the modified_on timestamp of each flag.
+func RenderConfigV2(projectId string, flags []*Flag) ([]byte, error) {
+	version, err := ConfigVersion(flags)
+	if err != nil {
+		return nil, err
+	}
+	config := ConfigV2{
+		SchemaVersion: SchemaVersionV2,
+		ProjectID:     projectId,
+		Version:       version,
+		Flags:         make(map[string]FlagV2),
+	}
+	for _, f := range sortFlags(flags) {
+		config.Flags[f.Key], err = newFlagV2(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := bytes.NewBuffer([]byte{})
+	err = json.NewEncoder(b).Encode(config)
+	return b.Bytes(), err
+}
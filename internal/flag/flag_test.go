@@ -56,6 +56,33 @@ func TestValidate(t *testing.T) {
 			},
 			err: ErrInvalidData{"invalid value for number flag"},
 		},
+		{
+			flag: Flag{
+				ProjectID: "1",
+				Key:       "test",
+				Type:      "NUMBER",
+				Value:     "NaN",
+			},
+			err: ErrInvalidData{"invalid value for number flag"},
+		},
+		{
+			flag: Flag{
+				ProjectID: "1",
+				Key:       "test",
+				Type:      "NUMBER",
+				Value:     "Inf",
+			},
+			err: ErrInvalidData{"invalid value for number flag"},
+		},
+		{
+			flag: Flag{
+				ProjectID: "1",
+				Key:       "test",
+				Type:      "NUMBER",
+				Value:     "-Infinity",
+			},
+			err: ErrInvalidData{"invalid value for number flag"},
+		},
 		{
 			flag: Flag{
 				ProjectID: "1",
@@ -120,3 +147,153 @@ func TestRenderConfig(t *testing.T) {
 		assert.Equalf(t, tc.json, j, "expected %s but got %s", tc.json, j)
 	}
 }
+
+func TestRenderNestedConfig(t *testing.T) {
+	tests := []struct {
+		flags []*Flag
+		json  []byte
+		err   error
+	}{
+		{
+			flags: []*Flag{
+				{Key: "db.pool.max", Type: "NUMBER", Value: "10"},
+				{Key: "db.host", Type: "STRING", Value: "localhost"},
+				{Key: "feature1", Type: "BOOLEAN", Value: "true"},
+			},
+			json: []byte("{\"db\":{\"host\":{\"value\":\"localhost\",\"type\":\"STRING\"},\"pool\":{\"max\":{\"value\":\"10\",\"type\":\"NUMBER\"}}},\"feature1\":{\"value\":\"true\",\"type\":\"BOOLEAN\"}}\n"),
+		},
+		{
+			flags: []*Flag{
+				{Key: "db", Type: "STRING", Value: "test"},
+				{Key: "db.pool", Type: "STRING", Value: "test"},
+			},
+			err: ErrInvalidData{"flag key \"db.pool\" conflicts with \"db\""},
+		},
+	}
+	for _, tc := range tests {
+		j, err := RenderNestedConfig(tc.flags)
+		assert.ErrorIs(t, err, tc.err)
+		assert.Equalf(t, tc.json, j, "expected %s but got %s", tc.json, j)
+	}
+}
+
+func TestValidateNestedKeys(t *testing.T) {
+	tests := []struct {
+		keys []string
+		err  error
+	}{
+		{
+			keys: []string{"db.pool.max", "db.pool.min", "db-host", "feature1"},
+			err:  nil,
+		},
+		{
+			keys: []string{"db.pool", "db-host", "db"},
+			err:  ErrInvalidData{"flag key \"db.pool\" conflicts with \"db\""},
+		},
+		{
+			keys: []string{"db.pool.max", "db.pool"},
+			err:  ErrInvalidData{"flag key \"db.pool.max\" conflicts with \"db.pool\""},
+		},
+		{
+			keys: []string{"db..max"},
+			err:  ErrInvalidData{"flag key \"db..max\" has an empty path segment"},
+		},
+		{
+			keys: []string{".db"},
+			err:  ErrInvalidData{"flag key \".db\" has an empty path segment"},
+		},
+		{
+			keys: []string{"db", "db"},
+			err:  ErrInvalidData{"flag key \"db\" is not unique"},
+		},
+	}
+	for _, tc := range tests {
+		flags := make([]*Flag, 0)
+		for _, k := range tc.keys {
+			flags = append(flags, &Flag{Key: k, Type: "STRING", Value: "test"})
+		}
+		err := ValidateNestedKeys(flags)
+		assert.ErrorIs(t, err, tc.err)
+	}
+}
+
+func TestRenderConfigV2(t *testing.T) {
+	modifiedOn := time.Date(2022, 8, 15, 2, 57, 56, 0, time.UTC)
+	flags := []*Flag{
+		{
+			ID:         "1",
+			ProjectID:  "2",
+			AccountID:  "3",
+			ModifiedOn: modifiedOn,
+			Key:        "feature1",
+			Type:       "STRING",
+			Value:      "test",
+		},
+		{
+			ID:         "2",
+			ProjectID:  "2",
+			AccountID:  "3",
+			ModifiedOn: modifiedOn,
+			Key:        "feature2",
+			Type:       "BOOLEAN",
+			Value:      "true",
+		},
+		{
+			ID:         "3",
+			ProjectID:  "2",
+			AccountID:  "3",
+			ModifiedOn: modifiedOn,
+			Key:        "feature3",
+			Type:       "NUMBER",
+			Value:      "123.45",
+		},
+	}
+	version, err := ConfigVersion(flags)
+	assert.Nil(t, err)
+	j, err := RenderConfigV2("2", flags)
+	assert.Nil(t, err)
+	expected := []byte("{\"schema_version\":2,\"project_id\":\"2\",\"version\":\"" + version + "\",\"flags\":{\"feature1\":{\"type\":\"STRING\",\"value\":\"test\",\"modified_on\":\"2022-08-15T02:57:56Z\"},\"feature2\":{\"type\":\"BOOLEAN\",\"value\":true,\"modified_on\":\"2022-08-15T02:57:56Z\"},\"feature3\":{\"type\":\"NUMBER\",\"value\":123.45,\"modified_on\":\"2022-08-15T02:57:56Z\"}}}\n")
+	assert.Equalf(t, expected, j, "expected %s but got %s", expected, j)
+
+	//version only changes when the flag contents change
+	flags[0].ModifiedOn = time.Now()
+	sameVersion, err := ConfigVersion(flags)
+	assert.Nil(t, err)
+	assert.Equal(t, version, sameVersion)
+	flags[0].Value = "changed"
+	newVersion, err := ConfigVersion(flags)
+	assert.Nil(t, err)
+	assert.NotEqual(t, version, newVersion)
+}
+
+func TestMask(t *testing.T) {
+	f := &Flag{Key: "api_key", Type: SECRET, Value: "encrypted"}
+	masked := Mask(f)
+	assert.Equal(t, SecretMask, masked.Value)
+	assert.Equal(t, "encrypted", f.Value)
+
+	f2 := &Flag{Key: "feature1", Type: STRING, Value: "test"}
+	assert.Equal(t, f2, Mask(f2))
+}
+
+func TestRenderConfig_Deterministic(t *testing.T) {
+	flags := []*Flag{
+		{Key: "feature3", Type: "NUMBER", Value: "123"},
+		{Key: "feature1", Type: "STRING", Value: "test"},
+		{Key: "feature2", Type: "BOOLEAN", Value: "true"},
+	}
+	reversed := []*Flag{flags[2], flags[1], flags[0]}
+
+	j1, err := RenderConfig(flags)
+	assert.Nil(t, err)
+	j2, err := RenderConfig(reversed)
+	assert.Nil(t, err)
+	assert.Equal(t, j1, j2)
+	assert.Equal(t, ContentHash(j1), ContentHash(j2))
+
+	v1, err := RenderConfigV2("1", flags)
+	assert.Nil(t, err)
+	v2, err := RenderConfigV2("1", reversed)
+	assert.Nil(t, err)
+	assert.Equal(t, v1, v2)
+}
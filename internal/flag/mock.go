@@ -42,3 +42,18 @@ func (m *MockStore) ReplaceFlags(ctx context.Context, projectId string, flags []
 	args := m.Called(ctx, projectId, flags)
 	return args.Get(0).([]*Flag), args.Error(1)
 }
+
+func (m *MockStore) ChangesSince(ctx context.Context, projectId string, since, until int64) ([]*Change, error) {
+	args := m.Called(ctx, projectId, since, until)
+	return args.Get(0).([]*Change), args.Error(1)
+}
+
+func (m *MockStore) All(ctx context.Context, projectId string) ([]*Flag, error) {
+	args := m.Called(ctx, projectId)
+	return args.Get(0).([]*Flag), args.Error(1)
+}
+
+func (m *MockStore) Snapshot(ctx context.Context, projectId string) (*Snapshot, error) {
+	args := m.Called(ctx, projectId)
+	return args.Get(0).(*Snapshot), args.Error(1)
+}
@@ -2,8 +2,13 @@ package flag
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/outbox"
+	"github.com/broswen/vex/internal/project"
+	"github.com/jackc/pgx/v4"
 	"github.com/rs/zerolog/log"
+	"sort"
 )
 
 type Store interface {
@@ -13,18 +18,31 @@ type Store interface {
 	Get(ctx context.Context, id string) (*Flag, error)
 	Delete(ctx context.Context, id string) error
 	ReplaceFlags(ctx context.Context, projectId string, flags []*Flag) ([]*Flag, error)
+	ChangesSince(ctx context.Context, projectId string, since, until int64) ([]*Change, error)
+	All(ctx context.Context, projectId string) ([]*Flag, error)
+	Snapshot(ctx context.Context, projectId string) (*Snapshot, error)
 }
 
+// historyLimit is the number of project versions that flag changes are kept for
+const historyLimit = 1000
+
 type PostgresStore struct {
 	db *db.Database
+	// render is optional, configs are rendered by the provisioner when they aren't current if it is nil
+	render project.ConfigRenderer
 }
 
 func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
 	return &PostgresStore{db: database}, nil
 }
 
+// RenderWith renders and stores the configs of a project in the same transaction as its flags
+func (store *PostgresStore) RenderWith(render project.ConfigRenderer) {
+	store.render = render
+}
+
 func (store *PostgresStore) List(ctx context.Context, projectId string, limit, offset int64) ([]*Flag, error) {
-	rows, err := store.db.Query(ctx, `SELECT id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on FROM flag WHERE project_id = $1 OFFSET $2 LIMIT $3;`, projectId, offset, limit)
+	rows, err := store.db.Query(ctx, `SELECT id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on FROM flag WHERE project_id = $1 ORDER BY flag_key OFFSET $2 LIMIT $3;`, projectId, offset, limit)
 	err = db.PgError(err)
 	if err != nil {
 		switch err {
@@ -51,40 +69,87 @@ func (store *PostgresStore) List(ctx context.Context, projectId string, limit, o
 
 func (store *PostgresStore) Insert(ctx context.Context, f *Flag) (*Flag, error) {
 	newFlag := &Flag{}
-	err := db.PgError(store.db.QueryRow(ctx, `INSERT INTO flag (flag_key, flag_type, flag_value, project_id, account_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return newFlag, storeError(db.PgError(err))
+	}
+	defer tx.Rollback(ctx)
+
+	err = db.PgError(tx.QueryRow(ctx, `INSERT INTO flag (flag_key, flag_type, flag_value, project_id, account_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
 		f.Key, f.Type, f.Value, f.ProjectID, f.AccountID).Scan(&newFlag.ID, &newFlag.Key, &newFlag.Type, &newFlag.Value, &newFlag.ProjectID, &newFlag.AccountID, &newFlag.CreatedOn, &newFlag.ModifiedOn))
 	if err != nil {
-		switch err {
-		case db.ErrNotFound:
-			return newFlag, ErrFlagNotFound{err.Error()}
-		case db.ErrKeyNotUnique:
-			return newFlag, ErrKeyNotUnique{err.Error()}
-		case db.ErrInvalidData:
-			return newFlag, ErrInvalidData{err.Error()}
-		default:
-			return newFlag, ErrUnknown{err}
-		}
+		return newFlag, storeError(err)
+	}
+	err = recordChanges(ctx, tx, newFlag.ProjectID, []*Change{{Key: newFlag.Key, Type: CREATED}})
+	if err != nil {
+		return newFlag, err
+	}
+	err = updateConfigDoc(ctx, tx, newFlag.ProjectID, []*Flag{newFlag}, nil)
+	if err != nil {
+		return newFlag, err
 	}
-	return newFlag, nil
+	err = project.WriteConfigs(ctx, tx, newFlag.ProjectID, store.render)
+	if err != nil {
+		return newFlag, err
+	}
+	return newFlag, storeError(db.PgError(tx.Commit(ctx)))
 }
 
 func (store *PostgresStore) Update(ctx context.Context, f *Flag) (*Flag, error) {
 	updatedFlag := &Flag{}
-	err := db.PgError(store.db.QueryRow(ctx, `UPDATE flag SET flag_key = $2, flag_type = $3, flag_value = $4, project_id = $5, account_id = $6 WHERE id = $1 RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return updatedFlag, storeError(db.PgError(err))
+	}
+	defer tx.Rollback(ctx)
+
+	old := &Flag{}
+	err = db.PgError(tx.QueryRow(ctx, `SELECT flag_key, flag_type, flag_value, project_id FROM flag WHERE id = $1 FOR UPDATE;`, f.ID).
+		Scan(&old.Key, &old.Type, &old.Value, &old.ProjectID))
+	if err != nil {
+		return updatedFlag, storeError(err)
+	}
+
+	err = db.PgError(tx.QueryRow(ctx, `UPDATE flag SET flag_key = $2, flag_type = $3, flag_value = $4, project_id = $5, account_id = $6 WHERE id = $1 RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
 		f.ID, f.Key, f.Type, f.Value, f.ProjectID, f.AccountID).Scan(&updatedFlag.ID, &updatedFlag.Key, &updatedFlag.Type, &updatedFlag.Value, &updatedFlag.ProjectID, &updatedFlag.AccountID, &updatedFlag.CreatedOn, &updatedFlag.ModifiedOn))
 	if err != nil {
-		switch err {
-		case db.ErrNotFound:
-			return updatedFlag, ErrFlagNotFound{err.Error()}
-		case db.ErrKeyNotUnique:
-			return updatedFlag, ErrKeyNotUnique{err.Error()}
-		case db.ErrInvalidData:
-			return updatedFlag, ErrInvalidData{err.Error()}
-		default:
-			return updatedFlag, ErrUnknown{err}
+		return updatedFlag, storeError(err)
+	}
+
+	switch {
+	case old.ProjectID != updatedFlag.ProjectID:
+		err = recordChanges(ctx, tx, old.ProjectID, []*Change{{Key: old.Key, Type: DELETED}})
+		if err == nil {
+			err = recordChanges(ctx, tx, updatedFlag.ProjectID, []*Change{{Key: updatedFlag.Key, Type: CREATED}})
+		}
+	case old.Key != updatedFlag.Key:
+		err = recordChanges(ctx, tx, updatedFlag.ProjectID, []*Change{{Key: old.Key, Type: DELETED}, {Key: updatedFlag.Key, Type: CREATED}})
+	case old.Type != updatedFlag.Type || old.Value != updatedFlag.Value:
+		err = recordChanges(ctx, tx, updatedFlag.ProjectID, []*Change{{Key: updatedFlag.Key, Type: UPDATED}})
+	}
+	if err != nil {
+		return updatedFlag, err
+	}
+
+	var deleted []string
+	if old.ProjectID != updatedFlag.ProjectID {
+		err = updateConfigDoc(ctx, tx, old.ProjectID, nil, []string{old.Key})
+		if err == nil {
+			err = project.WriteConfigs(ctx, tx, old.ProjectID, store.render)
 		}
+	} else if old.Key != updatedFlag.Key {
+		deleted = []string{old.Key}
+	}
+	if err == nil {
+		err = updateConfigDoc(ctx, tx, updatedFlag.ProjectID, []*Flag{updatedFlag}, deleted)
 	}
-	return updatedFlag, nil
+	if err == nil {
+		err = project.WriteConfigs(ctx, tx, updatedFlag.ProjectID, store.render)
+	}
+	if err != nil {
+		return updatedFlag, err
+	}
+	return updatedFlag, storeError(db.PgError(tx.Commit(ctx)))
 }
 
 func (store *PostgresStore) Get(ctx context.Context, id string) (*Flag, error) {
@@ -108,38 +173,42 @@ func (store *PostgresStore) Get(ctx context.Context, id string) (*Flag, error) {
 }
 
 func (store *PostgresStore) Delete(ctx context.Context, id string) error {
-	res, err := store.db.Exec(ctx, `DELETE FROM flag WHERE id = $1;`, id)
-	err = db.PgError(err)
-	if res.RowsAffected() == 0 && err == nil {
-		return ErrFlagNotFound{db.ErrNotFound.Error()}
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return storeError(db.PgError(err))
 	}
+	defer tx.Rollback(ctx)
 
+	var projectId, key string
+	err = db.PgError(tx.QueryRow(ctx, `DELETE FROM flag WHERE id = $1 RETURNING project_id, flag_key;`, id).Scan(&projectId, &key))
 	if err != nil {
-		switch err {
-		case db.ErrNotFound:
-			return ErrFlagNotFound{err.Error()}
-		case db.ErrKeyNotUnique:
-			return ErrKeyNotUnique{err.Error()}
-		case db.ErrInvalidData:
-			return ErrInvalidData{err.Error()}
-		default:
-			return ErrUnknown{err}
-		}
+		return storeError(err)
 	}
-	return nil
+	err = recordChanges(ctx, tx, projectId, []*Change{{Key: key, Type: DELETED}})
+	if err != nil {
+		return err
+	}
+	err = updateConfigDoc(ctx, tx, projectId, nil, []string{key})
+	if err != nil {
+		return err
+	}
+	err = project.WriteConfigs(ctx, tx, projectId, store.render)
+	if err != nil {
+		return err
+	}
+	return storeError(db.PgError(tx.Commit(ctx)))
 }
 
 func (store *PostgresStore) ReplaceFlags(ctx context.Context, projectId string, flags []*Flag) ([]*Flag, error) {
 	tx, err := store.db.Begin(ctx)
-	err = db.PgError(err)
 	if err != nil {
-		return nil, ErrUnknown{err}
+		return nil, storeError(db.PgError(err))
 	}
 	defer func() {
 		if err != nil {
 			log.Err(err).Str("project_id", projectId).Msg("rolling back replace flags transaction")
-			tx.Rollback(ctx)
 		}
+		tx.Rollback(ctx)
 	}()
 
 	_, err = tx.Exec(ctx, `SELECT * FROM project WHERE id = $1 FOR UPDATE;`, projectId)
@@ -149,34 +218,213 @@ func (store *PostgresStore) ReplaceFlags(ctx context.Context, projectId string,
 		return nil, ErrUnknown{err}
 	}
 
-	_, err = tx.Exec(ctx, `DELETE FROM flag WHERE project_id = $1;`, projectId)
+	rows, err := tx.Query(ctx, `DELETE FROM flag WHERE project_id = $1 RETURNING flag_key, flag_type, flag_value;`, projectId)
 	err = db.PgError(err)
 	if err != nil {
 		log.Err(err).Msg("")
 		return nil, ErrUnknown{err}
 	}
+	oldFlags := make(map[string]*Flag)
+	for rows.Next() {
+		f := &Flag{}
+		if err = rows.Scan(&f.Key, &f.Type, &f.Value); err != nil {
+			rows.Close()
+			return nil, ErrUnknown{err}
+		}
+		oldFlags[f.Key] = f
+	}
+	rows.Close()
+	if err = db.PgError(rows.Err()); err != nil {
+		return nil, ErrUnknown{err}
+	}
 
 	newFlags := make([]*Flag, 0)
+	changes := make([]*Change, 0)
 	for _, f := range flags {
 		newFlag := &Flag{}
-		err := db.PgError(tx.QueryRow(ctx, `INSERT INTO flag (flag_key, flag_type, flag_value, project_id, account_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
+		err = db.PgError(tx.QueryRow(ctx, `INSERT INTO flag (flag_key, flag_type, flag_value, project_id, account_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, flag_key, flag_type, flag_value, project_id, account_id, created_on, modified_on;`,
 			f.Key, f.Type, f.Value, f.ProjectID, f.AccountID).Scan(&newFlag.ID, &newFlag.Key, &newFlag.Type, &newFlag.Value, &newFlag.ProjectID, &newFlag.AccountID, &newFlag.CreatedOn, &newFlag.ModifiedOn))
 		if err != nil {
 			log.Err(err).Msg("")
-			switch err {
-			case db.ErrNotFound:
-				return newFlags, ErrFlagNotFound{err.Error()}
-			case db.ErrKeyNotUnique:
-				return newFlags, ErrKeyNotUnique{err.Error()}
-			case db.ErrInvalidData:
-				return newFlags, ErrInvalidData{err.Error()}
-			default:
-				return newFlags, ErrUnknown{err}
-			}
+			return newFlags, storeError(err)
 		}
 		newFlags = append(newFlags, newFlag)
+
+		old, ok := oldFlags[newFlag.Key]
+		switch {
+		case !ok:
+			changes = append(changes, &Change{Key: newFlag.Key, Type: CREATED})
+		case old.Type != newFlag.Type || old.Value != newFlag.Value:
+			changes = append(changes, &Change{Key: newFlag.Key, Type: UPDATED})
+		}
+		delete(oldFlags, newFlag.Key)
+	}
+	for key := range oldFlags {
+		changes = append(changes, &Change{Key: key, Type: DELETED})
+	}
+
+	if err = recordChanges(ctx, tx, projectId, changes); err != nil {
+		return nil, err
+	}
+	if err = replaceConfigDoc(ctx, tx, projectId, newFlags); err != nil {
+		return nil, err
+	}
+	if err = project.WriteConfigs(ctx, tx, projectId, store.render); err != nil {
+		return nil, err
+	}
+	return newFlags, storeError(db.PgError(tx.Commit(ctx)))
+}
+
+// ChangesSince returns the flag changes of a project after since up to and including until, ordered by version
+func (store *PostgresStore) ChangesSince(ctx context.Context, projectId string, since, until int64) ([]*Change, error) {
+	rows, err := store.db.Query(ctx, `SELECT project_id, version, flag_key, change_type FROM flag_change WHERE project_id = $1 AND version > $2 AND version <= $3 ORDER BY version;`, projectId, since, until)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	changes := make([]*Change, 0)
+	for rows.Next() {
+		c := &Change{}
+		err = rows.Scan(&c.ProjectID, &c.Version, &c.Key, &c.Type)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		changes = append(changes, c)
 	}
+	return changes, nil
+}
 
-	tx.Commit(ctx)
-	return newFlags, nil
+// All returns every flag of a project, sorted by key, from the flag document in project_config
+func (store *PostgresStore) All(ctx context.Context, projectId string) ([]*Flag, error) {
+	var doc []byte
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT flags FROM project_config WHERE project_id = $1;`, projectId).Scan(&doc))
+	if err == db.ErrNotFound {
+		//projects without flags don't have a flag document yet
+		return make([]*Flag, 0), nil
+	}
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return ParseConfigDoc(doc)
+}
+
+// Snapshot returns every flag of a project, sorted by key, with the project versions in a single statement
+// so the flags are exactly the ones of the version
+func (store *PostgresStore) Snapshot(ctx context.Context, projectId string) (*Snapshot, error) {
+	s := &Snapshot{}
+	var doc []byte
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT p.version, p.pruned_version, coalesce(c.flags, '{}'::jsonb) FROM project p LEFT JOIN project_config c ON c.project_id = p.id WHERE p.id = $1;`,
+		projectId).Scan(&s.Version, &s.PrunedVersion, &doc))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	s.Flags, err = ParseConfigDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseConfigDoc returns the flags of a flag document sorted by key
+func ParseConfigDoc(doc []byte) ([]*Flag, error) {
+	flags := make(map[string]*Flag)
+	if err := json.Unmarshal(doc, &flags); err != nil {
+		return nil, ErrUnknown{err}
+	}
+	fs := make([]*Flag, 0, len(flags))
+	for _, f := range flags {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].Key < fs[j].Key
+	})
+	return fs, nil
+}
+
+// updateConfigDoc sets flags and removes the deleted keys in the flag document of a project
+func updateConfigDoc(ctx context.Context, tx pgx.Tx, projectId string, flags []*Flag, deleted []string) error {
+	doc, err := configDoc(flags)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		deleted = []string{}
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO project_config (project_id, flags) VALUES ($1, $2) ON CONFLICT (project_id) DO UPDATE SET flags = (project_config.flags - $3::text[]) || excluded.flags, modified_on = now();`, projectId, doc, deleted)
+	return storeError(db.PgError(err))
+}
+
+// replaceConfigDoc replaces the flag document of a project with flags
+func replaceConfigDoc(ctx context.Context, tx pgx.Tx, projectId string, flags []*Flag) error {
+	doc, err := configDoc(flags)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO project_config (project_id, flags) VALUES ($1, $2) ON CONFLICT (project_id) DO UPDATE SET flags = excluded.flags, modified_on = now();`, projectId, doc)
+	return storeError(db.PgError(err))
+}
+
+func configDoc(flags []*Flag) ([]byte, error) {
+	doc := make(map[string]*Flag, len(flags))
+	for _, f := range flags {
+		doc[f.Key] = f
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, ErrUnknown{err}
+	}
+	return b, nil
+}
+
+// recordChanges increments the project version and records the changed flag keys in the same transaction as the flags.
+// Changes older than historyLimit versions are pruned. The project is provisioned through the outbox.
+func recordChanges(ctx context.Context, tx pgx.Tx, projectId string, changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var version, prunedVersion int64
+	var accountId string
+	err := db.PgError(tx.QueryRow(ctx, `UPDATE project SET version = version + 1 WHERE id = $1 RETURNING version, pruned_version, account_id;`, projectId).Scan(&version, &prunedVersion, &accountId))
+	if err != nil {
+		return storeError(err)
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.PROVISION_PROJECT, ProjectID: projectId, AccountID: accountId, Version: version, Reason: "flags"})
+	if err != nil {
+		return storeError(err)
+	}
+	for _, c := range changes {
+		c.ProjectID = projectId
+		c.Version = version
+		_, err = tx.Exec(ctx, `INSERT INTO flag_change (project_id, version, flag_key, change_type) VALUES ($1, $2, $3, $4);`, projectId, version, c.Key, c.Type)
+		if err = db.PgError(err); err != nil {
+			return storeError(err)
+		}
+	}
+	if prune := version - historyLimit; prune > prunedVersion {
+		_, err = tx.Exec(ctx, `DELETE FROM flag_change WHERE project_id = $1 AND version <= $2;`, projectId, prune)
+		if err = db.PgError(err); err != nil {
+			return storeError(err)
+		}
+		_, err = tx.Exec(ctx, `UPDATE project SET pruned_version = $2 WHERE id = $1;`, projectId, prune)
+		if err = db.PgError(err); err != nil {
+			return storeError(err)
+		}
+	}
+	return nil
+}
+
+func storeError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case db.ErrNotFound:
+		return ErrFlagNotFound{err.Error()}
+	case db.ErrKeyNotUnique:
+		return ErrKeyNotUnique{err.Error()}
+	case db.ErrInvalidData:
+		return ErrInvalidData{err.Error()}
+	default:
+		return ErrUnknown{err}
+	}
 }
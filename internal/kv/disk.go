@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MetadataSuffix is appended to the file name of a value for the metadata sidecar file of the previous layout,
+// which is still read for files without an envelope
+const MetadataSuffix = ".meta.json"
+
+// envelopePrefix starts every file that holds a value with its metadata, it is followed by the metadata length and a newline
+const envelopePrefix = "vex1 "
+
+// DiskStore stores each value with its metadata in a file under a directory, keys with slashes are stored in sub directories.
+// Files are written to a temp file and renamed, so readers never see a partial write or a value with the metadata of another.
+type DiskStore struct {
+	dir string
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) path(key string) (string, error) {
+	if key == "" || strings.HasSuffix(key, MetadataSuffix) || filepath.IsAbs(key) || filepath.Clean(key) != key || strings.HasPrefix(key, "..") {
+		return "", ErrInvalidKey{"invalid key: " + key}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *DiskStore) Get(ctx context.Context, key string) (*Entry, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrKeyNotFound{key + " not found"}
+		}
+		return nil, err
+	}
+	if e, ok := openEnvelope(data); ok {
+		return e, nil
+	}
+	metadata, err := os.ReadFile(path + MetadataSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return &Entry{Value: data, Metadata: metadata}, nil
+}
+
+// Put replaces the value and metadata of a key in a single file
+func (s *DiskStore) Put(ctx context.Context, key string, e *Entry) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFile(path, envelope(e)); err != nil {
+		return err
+	}
+	//the sidecar of the previous layout isn't read anymore
+	if err := os.Remove(path + MetadataSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// envelope returns the file contents for an entry: the prefix, the metadata length, a newline, the metadata and the value
+func envelope(e *Entry) []byte {
+	header := envelopePrefix + strconv.Itoa(len(e.Metadata)) + "\n"
+	data := make([]byte, 0, len(header)+len(e.Metadata)+len(e.Value))
+	data = append(data, header...)
+	data = append(data, e.Metadata...)
+	return append(data, e.Value...)
+}
+
+// openEnvelope returns the entry of file contents, it returns false for files of the previous layout that only hold the value
+func openEnvelope(data []byte) (*Entry, bool) {
+	if !bytes.HasPrefix(data, []byte(envelopePrefix)) {
+		return nil, false
+	}
+	rest := data[len(envelopePrefix):]
+	i := bytes.IndexByte(rest, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	n, err := strconv.Atoi(string(rest[:i]))
+	rest = rest[i+1:]
+	if err != nil || n < 0 || n > len(rest) {
+		return nil, false
+	}
+	e := &Entry{Value: rest[n:]}
+	if n > 0 {
+		e.Metadata = rest[:n]
+	}
+	return e, true
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{path, path + MetadataSuffix} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile atomically replaces the file at path
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,17 @@
+package kv
+
+type ErrKeyNotFound struct {
+	Message string
+}
+
+func (e ErrKeyNotFound) Error() string {
+	return e.Message
+}
+
+type ErrInvalidKey struct {
+	Message string
+}
+
+func (e ErrInvalidKey) Error() string {
+	return e.Message
+}
@@ -0,0 +1,19 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Entry is a value and the metadata stored with it, like a Workers KV pair
+type Entry struct {
+	Value    []byte
+	Metadata json.RawMessage
+}
+
+// Store is a key value namespace that provisioned configs and tokens are read from by the edge server
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, error)
+	Put(ctx context.Context, key string, e *Entry) error
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,77 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	_, err := s.Get(ctx, "v2/1")
+	assert.ErrorAs(t, err, &ErrKeyNotFound{})
+
+	err = s.Put(ctx, "v2/1", &Entry{Value: []byte("config"), Metadata: json.RawMessage(`{"account_id":"2"}`)})
+	assert.Nil(t, err)
+	e, err := s.Get(ctx, "v2/1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("config"), e.Value)
+	assert.JSONEq(t, `{"account_id":"2"}`, string(e.Metadata))
+
+	err = s.Put(ctx, "v2/1", &Entry{Value: []byte("updated")})
+	assert.Nil(t, err)
+	e, err = s.Get(ctx, "v2/1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("updated"), e.Value)
+	assert.Empty(t, e.Metadata)
+
+	err = s.Delete(ctx, "v2/1")
+	assert.Nil(t, err)
+	_, err = s.Get(ctx, "v2/1")
+	assert.ErrorAs(t, err, &ErrKeyNotFound{})
+	//deleting a missing key isn't an error
+	assert.Nil(t, s.Delete(ctx, "v2/1"))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	testStore(t, s)
+
+	assert.Nil(t, s.Put(context.Background(), "1", &Entry{Value: []byte("config"), Metadata: json.RawMessage(`{}`)}))
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	names := make([]string, 0)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	//temp files are renamed and the metadata is in the same file as the value
+	assert.ElementsMatch(t, []string{"1", "v2"}, names)
+
+	//files of the previous layout have a metadata sidecar file
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2"), []byte("legacy"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2"+MetadataSuffix), []byte(`{"account_id":"2"}`), 0o644))
+	e, err := s.Get(context.Background(), "2")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), e.Value)
+	assert.JSONEq(t, `{"account_id":"2"}`, string(e.Metadata))
+	assert.Nil(t, s.Put(context.Background(), "2", &Entry{Value: []byte("new")}))
+	_, err = os.Stat(filepath.Join(dir, "2"+MetadataSuffix))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, key := range []string{"", "../1", "/1", "a/../../1", "1" + MetadataSuffix} {
+		err = s.Put(context.Background(), key, &Entry{})
+		assert.ErrorAs(t, err, &ErrInvalidKey{}, key)
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "1"))
+	assert.True(t, os.IsNotExist(err))
+}
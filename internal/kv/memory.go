@@ -0,0 +1,45 @@
+package kv
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps entries in memory, it starts empty and is filled by provisioning events
+type MemoryStore struct {
+	mu      sync.RWMutex
+	entries map[string]*Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]*Entry),
+	}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, ErrKeyNotFound{key + " not found"}
+	}
+	return e, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, e *Entry) error {
+	if key == "" {
+		return ErrInvalidKey{"key must not be empty"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = e
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
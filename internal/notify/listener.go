@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+	"github.com/rs/zerolog/log"
+)
+
+type Handler func(ctx context.Context, e *Event) error
+
+// lease is how long claimed events are hidden from other replicas of the consumer
+const lease = time.Minute * 2
+
+// Listener handles provisioning events. It handles the events queued for the consumer when it starts
+// and then waits for notifications, so events sent while it was down aren't lost.
+type Listener struct {
+	store    Store
+	consumer string
+	handler  Handler
+	batch    int64
+	// poll is how often events are checked for without a notification
+	poll time.Duration
+}
+
+func NewListener(store Store, consumer string, handler Handler) *Listener {
+	return &Listener{
+		store:    store,
+		consumer: consumer,
+		handler:  handler,
+		batch:    100,
+		poll:     time.Second * 30,
+	}
+}
+
+// Run listens for events until the context is done, reconnecting on errors
+func (l *Listener) Run(ctx context.Context, database *db.Database) error {
+	for {
+		err := l.listen(ctx, database)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Error().Err(err).Msg("error listening for provision events")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (l *Listener) listen(ctx context.Context, database *db.Database) error {
+	conn, err := database.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	// only one replica per consumer handles events, the others wait for the lock
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", l.consumer); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", l.consumer)
+	if _, err = conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "UNLISTEN "+Channel)
+
+	if err = l.store.Register(ctx, l.consumer); err != nil {
+		return err
+	}
+	log.Debug().Str("consumer", l.consumer).Msg("listening for provision events")
+	for {
+		if err = l.CatchUp(ctx); err != nil {
+			return err
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, l.poll)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && waitCtx.Err() == nil {
+			return err
+		}
+	}
+}
+
+// CatchUp claims and handles the unhandled events of the consumer, oldest first.
+// Events that fail are logged and skipped like failed kafka messages.
+func (l *Listener) CatchUp(ctx context.Context) error {
+	for {
+		events, err := l.store.Claim(ctx, l.consumer, l.batch, lease)
+		if err != nil {
+			return err
+		}
+		ids := make([]int64, 0, len(events))
+		for _, e := range events {
+			if err := l.handler(ctx, e); err != nil {
+				log.Error().Err(err).Int64("id", e.ID).Str("type", string(e.Type)).Msg("could not handle provision event")
+			}
+			ids = append(ids, e.ID)
+		}
+		if len(ids) > 0 {
+			if err := l.store.Handled(ctx, l.consumer, ids); err != nil {
+				return err
+			}
+		}
+		if int64(len(events)) < l.batch {
+			return nil
+		}
+	}
+}
+
+// Prune deletes handled events older than the retention every interval until the context is done
+func (l *Listener) Prune(ctx context.Context, retention, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			n, err := l.store.Prune(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.Error().Err(err).Msg("could not prune provision events")
+				continue
+			}
+			log.Debug().Int64("count", n).Msg("pruned provision events")
+		}
+	}
+}
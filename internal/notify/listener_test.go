@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestListener_CatchUp(t *testing.T) {
+	store := NewMockStore()
+	handled := make([]int64, 0)
+	l := NewListener(store, "test", func(ctx context.Context, e *Event) error {
+		handled = append(handled, e.ID)
+		if e.ID == 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	l.batch = 2
+	//event 1 was committed after event 3, it is still claimed
+	store.On("Claim", mock.Anything, "test", int64(2), lease).Return([]*Event{{ID: 2}, {ID: 3}}, nil).Once()
+	store.On("Claim", mock.Anything, "test", int64(2), lease).Return([]*Event{{ID: 1}}, nil).Once()
+	store.On("Handled", mock.Anything, "test", []int64{2, 3}).Return(nil)
+	store.On("Handled", mock.Anything, "test", []int64{1}).Return(nil)
+
+	assert.Nil(t, l.CatchUp(context.Background()))
+	//failed events are skipped
+	assert.Equal(t, []int64{2, 3, 1}, handled)
+	store.AssertExpectations(t)
+
+	//nothing is marked handled when there are no events
+	store.On("Claim", mock.Anything, "test", int64(2), lease).Return([]*Event{}, nil).Once()
+	assert.Nil(t, l.CatchUp(context.Background()))
+	store.AssertNumberOfCalls(t, "Handled", 2)
+}
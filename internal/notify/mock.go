@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) Insert(ctx context.Context, e *Event) (*Event, error) {
+	args := m.Called(ctx, e)
+	return args.Get(0).(*Event), args.Error(1)
+}
+
+func (m *MockStore) Register(ctx context.Context, consumer string) error {
+	args := m.Called(ctx, consumer)
+	return args.Error(0)
+}
+
+func (m *MockStore) Claim(ctx context.Context, consumer string, limit int64, lease time.Duration) ([]*Event, error) {
+	args := m.Called(ctx, consumer, limit, lease)
+	return args.Get(0).([]*Event), args.Error(1)
+}
+
+func (m *MockStore) Handled(ctx context.Context, consumer string, ids []int64) error {
+	args := m.Called(ctx, consumer, ids)
+	return args.Error(0)
+}
+
+func (m *MockStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	args := m.Called(ctx, before)
+	return args.Get(0).(int64), args.Error(1)
+}
@@ -0,0 +1,29 @@
+package notify
+
+import (
+	"time"
+)
+
+// Channel is notified with the id of every inserted event
+const Channel = "provision_event"
+
+type Type string
+
+const (
+	PROVISION_PROJECT   Type = "PROVISION_PROJECT"
+	DEPROVISION_PROJECT Type = "DEPROVISION_PROJECT"
+	PROVISION_TOKEN     Type = "PROVISION_TOKEN"
+	DEPROVISION_TOKEN   Type = "DEPROVISION_TOKEN"
+)
+
+// Event is a provisioning event sent through postgres, it carries the same values as the kafka provisioning topics
+type Event struct {
+	ID        int64
+	Type      Type
+	ProjectID string
+	AccountID string
+	TokenID   string
+	// TokenHash is set for DEPROVISION_TOKEN because the token is deleted
+	TokenHash []byte
+	CreatedOn time.Time
+}
@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+)
+
+type Store interface {
+	Insert(ctx context.Context, e *Event) (*Event, error)
+	Register(ctx context.Context, consumer string) error
+	Claim(ctx context.Context, consumer string, limit int64, lease time.Duration) ([]*Event, error)
+	Handled(ctx context.Context, consumer string, ids []int64) error
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+func (store *PostgresStore) Insert(ctx context.Context, e *Event) (*Event, error) {
+	inserted := &Event{}
+	err := store.db.QueryRow(ctx, `INSERT INTO provision_event (event_type, project_id, account_id, token_id, token_hash) VALUES ($1, $2, $3, $4, $5) RETURNING id, event_type, coalesce(project_id::text, ''), coalesce(account_id::text, ''), coalesce(token_id::text, ''), token_hash, created_on;`,
+		e.Type, nullable(e.ProjectID), nullable(e.AccountID), nullable(e.TokenID), e.TokenHash).
+		Scan(&inserted.ID, &inserted.Type, &inserted.ProjectID, &inserted.AccountID, &inserted.TokenID, &inserted.TokenHash, &inserted.CreatedOn)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// Claim returns the oldest unhandled events of the consumer, oldest first, and hides them from other replicas for the lease.
+// Events that aren't marked handled before the lease ends are claimed again.
+func (store *PostgresStore) Claim(ctx context.Context, consumer string, limit int64, lease time.Duration) ([]*Event, error) {
+	rows, err := store.db.Query(ctx, `UPDATE provision_event_delivery d SET available_on = now() + make_interval(secs => $3) FROM provision_event e
+		WHERE e.id = d.event_id AND d.consumer = $1 AND d.event_id IN (
+			SELECT event_id FROM provision_event_delivery WHERE consumer = $1 AND handled_on IS NULL AND available_on <= now() ORDER BY event_id LIMIT $2 FOR UPDATE SKIP LOCKED
+		) RETURNING e.id, e.event_type, coalesce(e.project_id::text, ''), coalesce(e.account_id::text, ''), coalesce(e.token_id::text, ''), e.token_hash, e.created_on;`,
+		consumer, limit, lease.Seconds())
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]*Event, 0)
+	for rows.Next() {
+		e := &Event{}
+		err = rows.Scan(&e.ID, &e.Type, &e.ProjectID, &e.AccountID, &e.TokenID, &e.TokenHash, &e.CreatedOn)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err = db.PgError(rows.Err()); err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+// Handled marks claimed events as handled by the consumer
+func (store *PostgresStore) Handled(ctx context.Context, consumer string, ids []int64) error {
+	_, err := store.db.Exec(ctx, `UPDATE provision_event_delivery SET handled_on = now() WHERE consumer = $1 AND event_id = ANY($2);`, consumer, ids)
+	return db.PgError(err)
+}
+
+// Register adds a consumer group, events are queued for it from then on
+func (store *PostgresStore) Register(ctx context.Context, consumer string) error {
+	_, err := store.db.Exec(ctx, `INSERT INTO provision_cursor (consumer, event_id) VALUES ($1, (SELECT coalesce(max(id), 0) FROM provision_event))
+		ON CONFLICT (consumer) DO NOTHING;`, consumer)
+	return db.PgError(err)
+}
+
+// Prune deletes events created before the time that every consumer has handled
+func (store *PostgresStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res, err := store.db.Exec(ctx, `DELETE FROM provision_event e WHERE created_on < $1
+		AND NOT EXISTS (SELECT 1 FROM provision_event_delivery d WHERE d.event_id = e.id AND d.handled_on IS NULL);`, before)
+	err = db.PgError(err)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
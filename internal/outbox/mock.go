@@ -0,0 +1,31 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Message, error) {
+	args := m.Called(ctx, limit, lease)
+	return args.Get(0).([]*Message), args.Error(1)
+}
+
+func (m *MockStore) Delete(ctx context.Context, id int64) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockStore) Retry(ctx context.Context, id int64, after time.Duration) error {
+	args := m.Called(ctx, id, after)
+	return args.Error(0)
+}
@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+	"github.com/jackc/pgx/v4"
+)
+
+// Channel is notified with the id of every written message
+const Channel = "provision_outbox"
+
+type Type string
+
+const (
+	PROVISION_PROJECT   Type = "PROVISION_PROJECT"
+	DEPROVISION_PROJECT Type = "DEPROVISION_PROJECT"
+	PROVISION_TOKEN     Type = "PROVISION_TOKEN"
+	DEPROVISION_TOKEN   Type = "DEPROVISION_TOKEN"
+)
+
+// Message is a provisioning event that is waiting to be sent to the provision bus
+type Message struct {
+	ID        int64
+	Type      Type
+	ProjectID string
+	AccountID string
+	TokenID   string
+	// TokenHash is set for DEPROVISION_TOKEN because the token is deleted
+	TokenHash []byte
+	// Version is the project version after the change
+	Version int64
+	// Reason is what changed, eg. flags or token.rerolled
+	Reason string
+	// Attempts is the number of times sending the message failed
+	Attempts  int
+	CreatedOn time.Time
+}
+
+// Write adds a message to the outbox in the transaction of the change it provisions,
+// so the message is only sent if the change is committed
+func Write(ctx context.Context, tx pgx.Tx, m *Message) error {
+	_, err := tx.Exec(ctx, `INSERT INTO provision_outbox (event_type, project_id, account_id, token_id, token_hash, version, reason) VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		m.Type, nullable(m.ProjectID), nullable(m.AccountID), nullable(m.TokenID), m.TokenHash, m.Version, m.Reason)
+	return db.PgError(err)
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,121 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/rs/zerolog/log"
+)
+
+type Handler func(ctx context.Context, m *Message) error
+
+// Relay sends outbox messages to the provision bus. Messages are deleted after they are sent,
+// so every committed change is sent at least once even if the bus or the server was down.
+type Relay struct {
+	store   Store
+	handler Handler
+	batch   int64
+	// lease is how long a claimed message is hidden from other relays
+	lease time.Duration
+	// poll is how often messages are checked for without a notification
+	poll time.Duration
+	// backoff is the delay before the first retry of a failed message, it doubles up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func NewRelay(store Store, handler Handler) *Relay {
+	return &Relay{
+		store:      store,
+		handler:    handler,
+		batch:      100,
+		lease:      time.Minute,
+		poll:       time.Second * 10,
+		backoff:    time.Second,
+		maxBackoff: time.Minute * 5,
+	}
+}
+
+// Run relays messages until the context is done, reconnecting on errors
+func (r *Relay) Run(ctx context.Context, database *db.Database) error {
+	for {
+		err := r.listen(ctx, database)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Error().Err(err).Msg("error relaying outbox messages")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Relay) listen(ctx context.Context, database *db.Database) error {
+	conn, err := database.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err = conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "UNLISTEN "+Channel)
+
+	for {
+		if err = r.Drain(ctx); err != nil {
+			return err
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, r.poll)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && waitCtx.Err() == nil {
+			return err
+		}
+	}
+}
+
+// Drain sends every available message. Failed messages are retried with a backoff by a later Drain.
+func (r *Relay) Drain(ctx context.Context) error {
+	for {
+		messages, err := r.store.Claim(ctx, r.batch, r.lease)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := r.handler(ctx, m); err != nil {
+				stats.OutboxRetried.Inc()
+				after := r.retryAfter(m.Attempts)
+				log.Warn().Err(err).Int64("id", m.ID).Str("type", string(m.Type)).Int("attempts", m.Attempts+1).Dur("after", after).Msg("could not relay outbox message")
+				if err = r.store.Retry(ctx, m.ID, after); err != nil {
+					return err
+				}
+				continue
+			}
+			stats.OutboxRelayed.Inc()
+			if err := r.store.Delete(ctx, m.ID); err != nil {
+				return err
+			}
+		}
+		if int64(len(messages)) < r.batch {
+			return nil
+		}
+	}
+}
+
+func (r *Relay) retryAfter(attempts int) time.Duration {
+	after := r.backoff
+	for i := 0; i < attempts && after < r.maxBackoff; i++ {
+		after *= 2
+	}
+	if after > r.maxBackoff {
+		return r.maxBackoff
+	}
+	return after
+}
@@ -0,0 +1,40 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRelay_Drain(t *testing.T) {
+	store := NewMockStore()
+	sent := &Message{ID: 1, Type: PROVISION_PROJECT, ProjectID: "p1"}
+	failed := &Message{ID: 2, Type: PROVISION_TOKEN, TokenID: "t1", Attempts: 2}
+	store.On("Claim", mock.Anything, int64(100), time.Minute).Return([]*Message{sent, failed}, nil)
+	store.On("Delete", mock.Anything, int64(1)).Return(nil)
+	store.On("Retry", mock.Anything, int64(2), time.Second*4).Return(nil)
+
+	handled := make([]int64, 0)
+	relay := NewRelay(store, func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.ID)
+		if m.ID == 2 {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	})
+	err := relay.Drain(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, handled)
+	store.AssertExpectations(t)
+}
+
+func TestRelay_retryAfter(t *testing.T) {
+	relay := NewRelay(NewMockStore(), nil)
+	assert.Equal(t, time.Second, relay.retryAfter(0))
+	assert.Equal(t, time.Second*8, relay.retryAfter(3))
+	assert.Equal(t, time.Minute*5, relay.retryAfter(20))
+}
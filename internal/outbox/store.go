@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+)
+
+type Store interface {
+	Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Message, error)
+	Delete(ctx context.Context, id int64) error
+	Retry(ctx context.Context, id int64, after time.Duration) error
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+// Claim returns the oldest available messages, oldest first, and hides them from other relays for the lease.
+// Messages that aren't deleted before the lease ends are claimed again.
+func (store *PostgresStore) Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Message, error) {
+	rows, err := store.db.Query(ctx, `UPDATE provision_outbox SET available_on = now() + make_interval(secs => $2) WHERE id IN (
+			SELECT id FROM provision_outbox WHERE available_on <= now() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		) RETURNING id, event_type, coalesce(project_id::text, ''), coalesce(account_id::text, ''), coalesce(token_id::text, ''), token_hash, version, reason, attempts, created_on;`,
+		limit, lease.Seconds())
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]*Message, 0)
+	for rows.Next() {
+		m := &Message{}
+		err = rows.Scan(&m.ID, &m.Type, &m.ProjectID, &m.AccountID, &m.TokenID, &m.TokenHash, &m.Version, &m.Reason, &m.Attempts, &m.CreatedOn)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err = db.PgError(rows.Err()); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+// Delete removes a message after it was sent
+func (store *PostgresStore) Delete(ctx context.Context, id int64) error {
+	_, err := store.db.Exec(ctx, `DELETE FROM provision_outbox WHERE id = $1;`, id)
+	return db.PgError(err)
+}
+
+// Retry records a failed attempt and makes the message available again after the duration
+func (store *PostgresStore) Retry(ctx context.Context, id int64, after time.Duration) error {
+	_, err := store.db.Exec(ctx, `UPDATE provision_outbox SET attempts = attempts + 1, available_on = now() + make_interval(secs => $2) WHERE id = $1;`, id, after.Seconds())
+	return db.PgError(err)
+}
@@ -2,6 +2,7 @@ package project
 
 import (
 	"context"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -34,7 +35,42 @@ func (m *MockStore) List(ctx context.Context, accountId string, limit, offset in
 	return args.Get(0).([]*Project), args.Error(1)
 }
 
+func (m *MockStore) ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Project, error) {
+	args := m.Called(ctx, accountId, createdOn, id, limit)
+	return args.Get(0).([]*Project), args.Error(1)
+}
+
 func (m *MockStore) Delete(ctx context.Context, id string) error {
 	args := m.Called(ctx, id)
 	return args.Error(0)
 }
+
+func (m *MockStore) SetPayloadKey(ctx context.Context, projectId, payloadKey string) (*Project, error) {
+	args := m.Called(ctx, projectId, payloadKey)
+	return args.Get(0).(*Project), args.Error(1)
+}
+
+func (m *MockStore) Status(ctx context.Context, projectId string) (*Status, error) {
+	args := m.Called(ctx, projectId)
+	return args.Get(0).(*Status), args.Error(1)
+}
+
+func (m *MockStore) SetProvisionedVersion(ctx context.Context, projectId string, version int64) error {
+	args := m.Called(ctx, projectId, version)
+	return args.Error(0)
+}
+
+func (m *MockStore) Hashes(ctx context.Context, projectId string) (*Hashes, error) {
+	args := m.Called(ctx, projectId)
+	return args.Get(0).(*Hashes), args.Error(1)
+}
+
+func (m *MockStore) Configs(ctx context.Context, projectId string) (*Project, *Configs, error) {
+	args := m.Called(ctx, projectId)
+	return args.Get(0).(*Project), args.Get(1).(*Configs), args.Error(2)
+}
+
+func (m *MockStore) SetConfigs(ctx context.Context, projectId string, c *Configs) error {
+	args := m.Called(ctx, projectId, c)
+	return args.Error(0)
+}
@@ -2,11 +2,83 @@ package project
 
 import "time"
 
+type RenderMode string
+
+const (
+	// FLAT renders the project config as a single map keyed by flag key
+	FLAT RenderMode = "FLAT"
+	// NESTED splits flag keys on "." and renders the project config as nested objects
+	NESTED RenderMode = "NESTED"
+)
+
 type Project struct {
-	ID          string    `json:"id"`
-	AccountID   string    `json:"account_id" db:"account_id"`
-	Name        string    `json:"name" db:"project_name"`
-	Description string    `json:"description" db:"project_description"`
-	CreatedOn   time.Time `json:"created_on" db:"created_on"`
-	ModifiedOn  time.Time `json:"modified_on" db:"modified_on"`
+	ID          string     `json:"id"`
+	AccountID   string     `json:"account_id" db:"account_id"`
+	Name        string     `json:"name" db:"project_name"`
+	Description string     `json:"description" db:"project_description"`
+	RenderMode  RenderMode `json:"render_mode" db:"render_mode"`
+	// PayloadKey is the encrypted key used to include SECRET flags in the rendered config
+	PayloadKey string `json:"-" db:"payload_key"`
+	// EncryptedPayload is true if SECRET flags are encrypted with the payload key and included in the rendered config
+	EncryptedPayload bool `json:"encrypted_payload"`
+	// Version is incremented every time the flags, render mode or payload key of the project change
+	Version int64 `json:"version" db:"version"`
+	// PrunedVersion is the latest version whose flag changes were deleted, deltas can only be computed after it
+	PrunedVersion int64     `json:"-" db:"pruned_version"`
+	CreatedOn     time.Time `json:"created_on" db:"created_on"`
+	ModifiedOn    time.Time `json:"modified_on" db:"modified_on"`
+}
+
+// Status is the version of a project that should be provisioned and the version that the provisioner last wrote to the edge
+type Status struct {
+	ProjectID          string     `json:"project_id"`
+	DesiredVersion     int64      `json:"desired_version"`
+	ProvisionedVersion int64      `json:"provisioned_version"`
+	ProvisionedOn      *time.Time `json:"provisioned_on"`
+	// Live is true if the edge is serving the desired version
+	Live bool `json:"live"`
+}
+
+// Hashes are the content hashes of the configs last rendered for a project, they are current if RenderedVersion is Version
+type Hashes struct {
+	ProjectID       string
+	AccountID       string
+	Version         int64
+	RenderedVersion int64
+	Hash            string
+	HashV2          string
+}
+
+// Current reports whether the hashes were rendered for the current project version
+func (h *Hashes) Current() bool {
+	return h.Hash != "" && h.RenderedVersion == h.Version
+}
+
+// Configs are the configs rendered for a version of a project and their content hashes,
+// they are stored with the flag document and current if Version is the project version
+type Configs struct {
+	Version  int64
+	Config   []byte
+	ConfigV2 []byte
+	Hash     string
+	HashV2   string
+}
+
+// Current reports whether the configs were rendered for the current version of p
+func (c *Configs) Current(p *Project) bool {
+	return c.Hash != "" && c.Version == p.Version
+}
+
+// ConfigRenderer renders the configs of a project from its flag document
+type ConfigRenderer func(p *Project, flags []byte) (*Configs, error)
+
+func Validate(p Project) error {
+	switch p.RenderMode {
+	case FLAT, NESTED:
+	case "":
+		// empty render mode defaults to FLAT on insert and is left unchanged on update
+	default:
+		return ErrInvalidData{"invalid render mode"}
+	}
+	return nil
 }
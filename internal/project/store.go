@@ -3,26 +3,69 @@ package project
 import (
 	"context"
 	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/outbox"
+	"github.com/jackc/pgx/v4"
+	"time"
 )
 
 type Store interface {
 	List(ctx context.Context, accountId string, limit, offset int64) ([]*Project, error)
+	ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Project, error)
 	Insert(ctx context.Context, p *Project) (*Project, error)
 	Update(ctx context.Context, p *Project) (*Project, error)
 	Get(ctx context.Context, projectId string) (*Project, error)
 	Delete(ctx context.Context, projectId string) error
+	SetPayloadKey(ctx context.Context, projectId, payloadKey string) (*Project, error)
+	Status(ctx context.Context, projectId string) (*Status, error)
+	SetProvisionedVersion(ctx context.Context, projectId string, version int64) error
+	Hashes(ctx context.Context, projectId string) (*Hashes, error)
+	Configs(ctx context.Context, projectId string) (*Project, *Configs, error)
+	SetConfigs(ctx context.Context, projectId string, c *Configs) error
 }
 
 type PostgresStore struct {
 	db *db.Database
+	// render is optional, configs are rendered by the provisioner when they aren't current if it is nil
+	render ConfigRenderer
 }
 
 func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
 	return &PostgresStore{db: database}, nil
 }
 
+// RenderWith renders and stores the configs of a project when its render mode or payload key change
+func (store *PostgresStore) RenderWith(render ConfigRenderer) {
+	store.render = render
+}
+
 func (store *PostgresStore) List(ctx context.Context, accountId string, limit, offset int64) ([]*Project, error) {
-	rows, err := store.db.Query(ctx, `SELECT id, account_id, project_name, project_description, created_on, modified_on FROM project WHERE account_id = $1 OFFSET $2 LIMIT $3;`, accountId, offset, limit)
+	rows, err := store.db.Query(ctx, `SELECT id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on FROM project WHERE account_id = $1 ORDER BY created_on, id OFFSET $2 LIMIT $3;`, accountId, offset, limit)
+	err = db.PgError(err)
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			return nil, ErrProjectNotFound{err.Error()}
+		default:
+			return nil, ErrUnknown{err}
+		}
+	}
+	defer rows.Close()
+	ps := make([]*Project, 0)
+	for rows.Next() {
+		p := &Project{}
+		err = rows.Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &p.CreatedOn, &p.ModifiedOn)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		p.EncryptedPayload = p.PayloadKey != ""
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// ListAfter lists the projects of an account ordered by (created_on, id) that sort after the given cursor
+func (store *PostgresStore) ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Project, error) {
+	rows, err := store.db.Query(ctx, `SELECT id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on FROM project WHERE account_id = $1 AND (created_on, id) > ($2, $3::uuid) ORDER BY created_on, id LIMIT $4;`, accountId, createdOn, id, limit)
 	err = db.PgError(err)
 	if err != nil {
 		switch err {
@@ -36,10 +79,11 @@ func (store *PostgresStore) List(ctx context.Context, accountId string, limit, o
 	ps := make([]*Project, 0)
 	for rows.Next() {
 		p := &Project{}
-		err = rows.Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.CreatedOn, &p.ModifiedOn)
+		err = rows.Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &p.CreatedOn, &p.ModifiedOn)
 		if err != nil {
 			return nil, ErrUnknown{err}
 		}
+		p.EncryptedPayload = p.PayloadKey != ""
 		ps = append(ps, p)
 	}
 	return ps, nil
@@ -47,8 +91,12 @@ func (store *PostgresStore) List(ctx context.Context, accountId string, limit, o
 
 func (store *PostgresStore) Insert(ctx context.Context, p *Project) (*Project, error) {
 	newProject := &Project{}
-	err := db.PgError(store.db.QueryRow(ctx, `INSERT INTO project (account_id, project_name, project_description) VALUES ($1, $2, $3) RETURNING id, account_id, project_name, project_description, created_on, modified_on;`,
-		p.AccountID, p.Name, p.Description).Scan(&newProject.ID, &newProject.AccountID, &newProject.Name, &newProject.Description, &newProject.CreatedOn, &newProject.ModifiedOn))
+	renderMode := p.RenderMode
+	if renderMode == "" {
+		renderMode = FLAT
+	}
+	err := db.PgError(store.db.QueryRow(ctx, `INSERT INTO project (account_id, project_name, project_description, render_mode) VALUES ($1, $2, $3, $4) RETURNING id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on;`,
+		p.AccountID, p.Name, p.Description, renderMode).Scan(&newProject.ID, &newProject.AccountID, &newProject.Name, &newProject.Description, &newProject.RenderMode, &newProject.PayloadKey, &newProject.Version, &newProject.PrunedVersion, &newProject.CreatedOn, &newProject.ModifiedOn))
 
 	if err != nil {
 		switch err {
@@ -61,31 +109,44 @@ func (store *PostgresStore) Insert(ctx context.Context, p *Project) (*Project, e
 		}
 	}
 
+	newProject.EncryptedPayload = newProject.PayloadKey != ""
 	return newProject, nil
 }
 
+// Update updates the name, description and render mode of a project,
+// changing the render mode increments the project version and provisions the project
 func (store *PostgresStore) Update(ctx context.Context, p *Project) (*Project, error) {
 	newProject := &Project{}
-	err := db.PgError(store.db.QueryRow(ctx, `UPDATE project SET project_name = $2, project_description = $3 WHERE id = $1 RETURNING id, account_id, project_name, project_description, created_on, modified_on;`,
-		p.ID, p.Name, p.Description).Scan(&newProject.ID, &newProject.AccountID, &newProject.Name, &newProject.Description, &newProject.CreatedOn, &newProject.ModifiedOn))
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return newProject, storeError(db.PgError(err))
+	}
+	defer tx.Rollback(ctx)
 
+	err = db.PgError(tx.QueryRow(ctx, `UPDATE project SET project_name = $2, project_description = $3, render_mode = coalesce(nullif($4, ''), render_mode),
+		version = version + (CASE WHEN $4 <> '' AND $4 <> render_mode THEN 1 ELSE 0 END) WHERE id = $1 RETURNING id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on;`,
+		p.ID, p.Name, p.Description, p.RenderMode).Scan(&newProject.ID, &newProject.AccountID, &newProject.Name, &newProject.Description, &newProject.RenderMode, &newProject.PayloadKey, &newProject.Version, &newProject.PrunedVersion, &newProject.CreatedOn, &newProject.ModifiedOn))
 	if err != nil {
-		switch err {
-		case db.ErrNotFound:
-			return newProject, ErrProjectNotFound{err.Error()}
-		case db.ErrInvalidData:
-			return newProject, ErrInvalidData{err.Error()}
-		default:
-			return newProject, ErrUnknown{err}
+		return newProject, storeError(err)
+	}
+	newProject.EncryptedPayload = newProject.PayloadKey != ""
+
+	if p.RenderMode != "" {
+		err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.PROVISION_PROJECT, ProjectID: newProject.ID, AccountID: newProject.AccountID, Version: newProject.Version, Reason: "render_mode"})
+		if err != nil {
+			return newProject, storeError(err)
+		}
+		if err = WriteConfigs(ctx, tx, newProject.ID, store.render); err != nil {
+			return newProject, err
 		}
 	}
-	return newProject, nil
+	return newProject, storeError(db.PgError(tx.Commit(ctx)))
 }
 
 func (store *PostgresStore) Get(ctx context.Context, projectId string) (*Project, error) {
 	p := &Project{}
-	err := db.PgError(store.db.QueryRow(ctx, `SELECT id, account_id, project_name, project_description, created_on, modified_on FROM project WHERE id = $1;`,
-		projectId).Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.CreatedOn, &p.ModifiedOn))
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on FROM project WHERE id = $1;`,
+		projectId).Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &p.CreatedOn, &p.ModifiedOn))
 
 	if err != nil {
 		switch err {
@@ -97,25 +158,156 @@ func (store *PostgresStore) Get(ctx context.Context, projectId string) (*Project
 			return p, ErrUnknown{err}
 		}
 	}
+	p.EncryptedPayload = p.PayloadKey != ""
 	return p, nil
 }
 
+// Delete deletes a project and deprovisions it through the outbox
 func (store *PostgresStore) Delete(ctx context.Context, projectId string) error {
-	res, err := store.db.Exec(ctx, `DELETE FROM project WHERE id = $1;`, projectId)
-	err = db.PgError(err)
-	if res.RowsAffected() == 0 && err == nil {
-		return ErrProjectNotFound{db.ErrNotFound.Error()}
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return storeError(db.PgError(err))
 	}
+	defer tx.Rollback(ctx)
 
+	var accountId string
+	err = db.PgError(tx.QueryRow(ctx, `DELETE FROM project WHERE id = $1 RETURNING account_id;`, projectId).Scan(&accountId))
 	if err != nil {
-		switch err {
-		case db.ErrNotFound:
-			return ErrProjectNotFound{err.Error()}
-		case db.ErrInvalidData:
-			return ErrInvalidData{err.Error()}
-		default:
-			return ErrUnknown{err}
-		}
+		return storeError(err)
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.DEPROVISION_PROJECT, ProjectID: projectId, AccountID: accountId, Reason: "project.deleted"})
+	if err != nil {
+		return storeError(err)
+	}
+	return storeError(db.PgError(tx.Commit(ctx)))
+}
+
+// SetPayloadKey sets the encrypted payload key of a project, an empty key excludes SECRET flags from the rendered config.
+// The payload key changes which SECRET flags are rendered, so the project version is incremented
+// and the flag change history is reset to force clients to sync the full config.
+func (store *PostgresStore) SetPayloadKey(ctx context.Context, projectId, payloadKey string) (*Project, error) {
+	p := &Project{}
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return p, storeError(db.PgError(err))
+	}
+	defer tx.Rollback(ctx)
+
+	err = db.PgError(tx.QueryRow(ctx, `UPDATE project SET payload_key = $2, version = version + 1, pruned_version = version + 1 WHERE id = $1 RETURNING id, account_id, project_name, project_description, render_mode, payload_key, version, pruned_version, created_on, modified_on;`,
+		projectId, payloadKey).Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &p.CreatedOn, &p.ModifiedOn))
+	if err != nil {
+		return p, storeError(err)
+	}
+	p.EncryptedPayload = p.PayloadKey != ""
+
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.PROVISION_PROJECT, ProjectID: p.ID, AccountID: p.AccountID, Version: p.Version, Reason: "payload_key"})
+	if err != nil {
+		return p, storeError(err)
+	}
+	if err = WriteConfigs(ctx, tx, p.ID, store.render); err != nil {
+		return p, err
+	}
+	return p, storeError(db.PgError(tx.Commit(ctx)))
+}
+
+// Status returns the desired and provisioned versions of a project
+func (store *PostgresStore) Status(ctx context.Context, projectId string) (*Status, error) {
+	s := &Status{}
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT id, version, provisioned_version, provisioned_on FROM project WHERE id = $1;`,
+		projectId).Scan(&s.ProjectID, &s.DesiredVersion, &s.ProvisionedVersion, &s.ProvisionedOn))
+	if err != nil {
+		return s, storeError(err)
+	}
+	s.Live = s.ProvisionedVersion >= s.DesiredVersion
+	return s, nil
+}
+
+// SetProvisionedVersion records that the provisioner wrote a version of the project, older versions are ignored
+func (store *PostgresStore) SetProvisionedVersion(ctx context.Context, projectId string, version int64) error {
+	_, err := store.db.Exec(ctx, `UPDATE project SET provisioned_version = $2, provisioned_on = now() WHERE id = $1 AND provisioned_version <= $2;`, projectId, version)
+	return storeError(db.PgError(err))
+}
+
+// Hashes returns the project version and the content hashes of the configs last rendered for it
+func (store *PostgresStore) Hashes(ctx context.Context, projectId string) (*Hashes, error) {
+	h := &Hashes{}
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT id, account_id, version, rendered_version, config_hash, config_hash_v2 FROM project WHERE id = $1;`,
+		projectId).Scan(&h.ProjectID, &h.AccountID, &h.Version, &h.RenderedVersion, &h.Hash, &h.HashV2))
+	return h, storeError(err)
+}
+
+// Configs returns a project and the configs stored for it in a single statement
+func (store *PostgresStore) Configs(ctx context.Context, projectId string) (*Project, *Configs, error) {
+	p := &Project{}
+	c := &Configs{}
+	err := db.PgError(store.db.QueryRow(ctx, `SELECT p.id, p.account_id, p.project_name, p.project_description, p.render_mode, p.payload_key, p.version, p.pruned_version, p.created_on, p.modified_on,
+		coalesce(c.rendered_version, 0), coalesce(c.config, ''::bytea), coalesce(c.config_v2, ''::bytea), coalesce(c.config_hash, ''), coalesce(c.config_hash_v2, '')
+		FROM project p LEFT JOIN project_config c ON c.project_id = p.id WHERE p.id = $1;`,
+		projectId).Scan(&p.ID, &p.AccountID, &p.Name, &p.Description, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &p.CreatedOn, &p.ModifiedOn,
+		&c.Version, &c.Config, &c.ConfigV2, &c.Hash, &c.HashV2))
+	if err != nil {
+		return nil, nil, storeError(err)
+	}
+	p.EncryptedPayload = p.PayloadKey != ""
+	return p, c, nil
+}
+
+// SetConfigs stores the configs rendered for a version of the project, older versions are ignored
+func (store *PostgresStore) SetConfigs(ctx context.Context, projectId string, c *Configs) error {
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return storeError(db.PgError(err))
+	}
+	defer tx.Rollback(ctx)
+
+	if err = writeConfigs(ctx, tx, projectId, c); err != nil {
+		return err
+	}
+	return storeError(db.PgError(tx.Commit(ctx)))
+}
+
+// WriteConfigs renders the configs of a project from its flag document and stores them in the same transaction
+// as the change to the flags, render mode or payload key. Nothing is stored if render is nil.
+func WriteConfigs(ctx context.Context, tx pgx.Tx, projectId string, render ConfigRenderer) error {
+	if render == nil {
+		return nil
+	}
+	p := &Project{}
+	var flags []byte
+	err := db.PgError(tx.QueryRow(ctx, `SELECT p.id, p.account_id, p.render_mode, p.payload_key, p.version, p.pruned_version, coalesce(c.flags, '{}'::jsonb) FROM project p LEFT JOIN project_config c ON c.project_id = p.id WHERE p.id = $1;`,
+		projectId).Scan(&p.ID, &p.AccountID, &p.RenderMode, &p.PayloadKey, &p.Version, &p.PrunedVersion, &flags))
+	if err != nil {
+		return storeError(err)
+	}
+	c, err := render(p, flags)
+	if err != nil {
+		return err
+	}
+	return writeConfigs(ctx, tx, projectId, c)
+}
+
+// writeConfigs stores configs with the flag document and records their hashes on the project, older versions are ignored
+func writeConfigs(ctx context.Context, tx pgx.Tx, projectId string, c *Configs) error {
+	_, err := tx.Exec(ctx, `INSERT INTO project_config (project_id, rendered_version, config, config_v2, config_hash, config_hash_v2) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project_id) DO UPDATE SET rendered_version = excluded.rendered_version, config = excluded.config, config_v2 = excluded.config_v2,
+		config_hash = excluded.config_hash, config_hash_v2 = excluded.config_hash_v2 WHERE project_config.rendered_version <= excluded.rendered_version;`,
+		projectId, c.Version, c.Config, c.ConfigV2, c.Hash, c.HashV2)
+	if err = db.PgError(err); err != nil {
+		return storeError(err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE project SET rendered_version = $2, config_hash = $3, config_hash_v2 = $4 WHERE id = $1 AND rendered_version <= $2;`, projectId, c.Version, c.Hash, c.HashV2)
+	return storeError(db.PgError(err))
+}
+
+func storeError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case db.ErrNotFound:
+		return ErrProjectNotFound{err.Error()}
+	case db.ErrInvalidData:
+		return ErrInvalidData{err.Error()}
+	default:
+		return ErrUnknown{err}
 	}
-	return nil
 }
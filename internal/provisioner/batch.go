@@ -0,0 +1,233 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+const (
+	// maxBatchPairs is the most keys a Workers KV bulk request accepts
+	maxBatchPairs = 10000
+	// maxBatchBytes stays under the 100MB limit of a Workers KV bulk request
+	maxBatchBytes = 90 * 1024 * 1024
+)
+
+// ErrCloudflare is returned when the Cloudflare API responds without success
+type ErrCloudflare struct {
+	Errors   []cloudflare.ResponseInfo
+	Messages []cloudflare.ResponseInfo
+}
+
+func (e ErrCloudflare) Error() string {
+	return fmt.Sprintf("cloudflare request failed: errors: %v, messages: %v", e.Errors, e.Messages)
+}
+
+// checkResponse returns the request error, or ErrCloudflare if the response isn't successful
+func checkResponse(resp cloudflare.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return ErrCloudflare{Errors: resp.Errors, Messages: resp.Messages}
+	}
+	return nil
+}
+
+// kvAPI writes and deletes Workers KV keys in bulk
+type kvAPI interface {
+	WriteWorkersKVBulk(ctx context.Context, namespaceID string, kvs cloudflare.WorkersKVBulkWriteRequest) (cloudflare.Response, error)
+	DeleteWorkersKVBulk(ctx context.Context, namespaceID string, keys []string) (cloudflare.Response, error)
+}
+
+// kvBatcher gathers the writes and deletes for a namespace for a window after the first one and sends them in bulk requests.
+// Callers wait until their batch is sent and get their result. Batches are sent one at a time in the order they were started,
+// so a later write to a key is never overwritten by an earlier one. Writes and deletes are sent as they come if the window is 0.
+type kvBatcher struct {
+	api         kvAPI
+	namespaceID string
+	window      time.Duration
+	mu          sync.Mutex
+	pending     *kvBatch
+	// last is closed when the latest batch has been sent
+	last chan struct{}
+}
+
+func newKVBatcher(api kvAPI, namespaceID string) *kvBatcher {
+	return &kvBatcher{
+		api:         api,
+		namespaceID: namespaceID,
+	}
+}
+
+// kvBatch holds the latest write or delete for each key, in the order the keys were first added
+type kvBatch struct {
+	keys    []string
+	writes  map[string]*cloudflare.WorkersKVPair
+	deletes map[string]bool
+	size    int
+	// calls are the callers waiting for the batch
+	calls []*kvCall
+	// prev is closed when the batch before this one has been sent, sent when this one has
+	prev chan struct{}
+	sent chan struct{}
+}
+
+func newKVBatch() *kvBatch {
+	return &kvBatch{
+		keys:    make([]string, 0),
+		writes:  make(map[string]*cloudflare.WorkersKVPair),
+		deletes: make(map[string]bool),
+		sent:    make(chan struct{}),
+	}
+}
+
+// kvCall is the writes or deletes of one caller and their result
+type kvCall struct {
+	apply func(batch *kvBatch)
+	done  chan struct{}
+	err   error
+}
+
+func (b *kvBatch) write(pair *cloudflare.WorkersKVPair) {
+	if b.writes[pair.Key] == nil && !b.deletes[pair.Key] {
+		b.keys = append(b.keys, pair.Key)
+	}
+	delete(b.deletes, pair.Key)
+	b.writes[pair.Key] = pair
+	b.size += len(pair.Key) + len(pair.Value)
+}
+
+func (b *kvBatch) delete(key string) {
+	if b.writes[key] == nil && !b.deletes[key] {
+		b.keys = append(b.keys, key)
+	}
+	delete(b.writes, key)
+	b.deletes[key] = true
+	b.size += len(key)
+}
+
+// fits reports whether count keys of size bytes can be added, an empty batch fits anything
+func (b *kvBatch) fits(count, size int) bool {
+	return len(b.keys) == 0 || (len(b.keys)+count <= maxBatchPairs && b.size+size <= maxBatchBytes)
+}
+
+// Write writes the pairs with the pending batch
+func (b *kvBatcher) Write(ctx context.Context, pairs ...*cloudflare.WorkersKVPair) error {
+	size := 0
+	for _, pair := range pairs {
+		size += len(pair.Key) + len(pair.Value)
+	}
+	return b.add(ctx, len(pairs), size, func(batch *kvBatch) {
+		for _, pair := range pairs {
+			batch.write(pair)
+		}
+	})
+}
+
+// Delete deletes the keys with the pending batch
+func (b *kvBatcher) Delete(ctx context.Context, keys ...string) error {
+	size := 0
+	for _, key := range keys {
+		size += len(key)
+	}
+	return b.add(ctx, len(keys), size, func(batch *kvBatch) {
+		for _, key := range keys {
+			batch.delete(key)
+		}
+	})
+}
+
+func (b *kvBatcher) add(ctx context.Context, count, size int, fn func(batch *kvBatch)) error {
+	if count == 0 {
+		return nil
+	}
+	if b.window == 0 {
+		batch := newKVBatch()
+		fn(batch)
+		return b.send(ctx, batch)
+	}
+	b.mu.Lock()
+	//a full batch is sent right away and the pairs start a new one
+	if b.pending != nil && !b.pending.fits(count, size) {
+		full := b.pending
+		b.pending = nil
+		go b.flush(full)
+	}
+	if b.pending == nil {
+		b.pending = newKVBatch()
+		batch := b.pending
+		batch.prev = b.last
+		b.last = batch.sent
+		time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			if b.pending != batch {
+				//already sent because it was full
+				b.mu.Unlock()
+				return
+			}
+			b.pending = nil
+			b.mu.Unlock()
+			b.flush(batch)
+		})
+	}
+	call := &kvCall{apply: fn, done: make(chan struct{})}
+	b.pending.calls = append(b.pending.calls, call)
+	fn(b.pending)
+	b.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+// flush sends a batch that is shared by several callers after the batch before it and wakes them up with their result.
+// If a bulk request fails the writes and deletes of each caller are sent again on their own, in order,
+// so callers only get an error for their own keys.
+func (b *kvBatcher) flush(batch *kvBatch) {
+	defer close(batch.sent)
+	if batch.prev != nil {
+		<-batch.prev
+	}
+	err := b.send(context.Background(), batch)
+	for _, call := range batch.calls {
+		if err != nil && len(batch.calls) > 1 {
+			single := newKVBatch()
+			call.apply(single)
+			call.err = b.send(context.Background(), single)
+		} else {
+			call.err = err
+		}
+		close(call.done)
+	}
+}
+
+// send writes then deletes the keys of a batch, a key is only ever in one of them
+func (b *kvBatcher) send(ctx context.Context, batch *kvBatch) error {
+	writes := make(cloudflare.WorkersKVBulkWriteRequest, 0, len(batch.writes))
+	deletes := make([]string, 0, len(batch.deletes))
+	for _, key := range batch.keys {
+		if pair, ok := batch.writes[key]; ok {
+			writes = append(writes, pair)
+		} else if batch.deletes[key] {
+			deletes = append(deletes, key)
+		}
+	}
+	if len(writes) > 0 {
+		if err := checkResponse(b.api.WriteWorkersKVBulk(ctx, b.namespaceID, writes)); err != nil {
+			return err
+		}
+	}
+	if len(deletes) > 0 {
+		if err := checkResponse(b.api.DeleteWorkersKVBulk(ctx, b.namespaceID, deletes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package provisioner
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKV struct {
+	mu      sync.Mutex
+	writes  []cloudflare.WorkersKVBulkWriteRequest
+	deletes [][]string
+	resp    cloudflare.Response
+	// invalid fails every bulk write with one of the keys
+	invalid map[string]bool
+}
+
+func (f *fakeKV) WriteWorkersKVBulk(ctx context.Context, namespaceID string, kvs cloudflare.WorkersKVBulkWriteRequest) (cloudflare.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, kv := range kvs {
+		if f.invalid[kv.Key] {
+			return cloudflare.Response{Errors: []cloudflare.ResponseInfo{{Code: 10019, Message: "invalid key"}}}, nil
+		}
+	}
+	f.writes = append(f.writes, kvs)
+	return f.resp, nil
+}
+
+func (f *fakeKV) DeleteWorkersKVBulk(ctx context.Context, namespaceID string, keys []string) (cloudflare.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletes = append(f.deletes, keys)
+	return f.resp, nil
+}
+
+func TestKVBatcher(t *testing.T) {
+	api := &fakeKV{resp: cloudflare.Response{Success: true}}
+	b := newKVBatcher(api, "ns")
+	b.window = time.Millisecond * 50
+
+	wg := sync.WaitGroup{}
+	for _, op := range []func() error{
+		func() error { return b.Write(context.Background(), &cloudflare.WorkersKVPair{Key: "a", Value: "1"}) },
+		func() error { return b.Write(context.Background(), &cloudflare.WorkersKVPair{Key: "b", Value: "1"}) },
+		func() error { return b.Delete(context.Background(), "c") },
+	} {
+		op := op
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, op())
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, api.writes, 1)
+	assert.Len(t, api.writes[0], 2)
+	assert.Equal(t, [][]string{{"c"}}, api.deletes)
+}
+
+func TestKVBatch_LatestWins(t *testing.T) {
+	batch := newKVBatch()
+	batch.write(&cloudflare.WorkersKVPair{Key: "a", Value: "1"})
+	batch.delete("a")
+	batch.delete("b")
+	batch.write(&cloudflare.WorkersKVPair{Key: "b", Value: "2"})
+	batch.write(&cloudflare.WorkersKVPair{Key: "b", Value: "3"})
+
+	api := &fakeKV{resp: cloudflare.Response{Success: true}}
+	assert.Nil(t, newKVBatcher(api, "ns").send(context.Background(), batch))
+	assert.Equal(t, []cloudflare.WorkersKVBulkWriteRequest{{{Key: "b", Value: "3"}}}, api.writes)
+	assert.Equal(t, [][]string{{"a"}}, api.deletes)
+	assert.False(t, batch.fits(maxBatchPairs, 0))
+	assert.True(t, newKVBatch().fits(maxBatchPairs+1, 0))
+}
+
+func TestKVBatcher_Unsuccessful(t *testing.T) {
+	api := &fakeKV{resp: cloudflare.Response{Success: false, Errors: []cloudflare.ResponseInfo{{Code: 10000, Message: "authentication error"}}}}
+	err := newKVBatcher(api, "ns").Write(context.Background(), &cloudflare.WorkersKVPair{Key: "a", Value: "1"})
+	assert.ErrorAs(t, err, &ErrCloudflare{})
+	assert.Contains(t, err.Error(), "authentication error")
+}
+
+func TestKVBatcher_CallerErrors(t *testing.T) {
+	api := &fakeKV{resp: cloudflare.Response{Success: true}, invalid: map[string]bool{"bad": true}}
+	b := newKVBatcher(api, "ns")
+	b.window = time.Millisecond * 50
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+	for i, key := range []string{"a", "bad"} {
+		i, key := i, key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = b.Write(context.Background(), &cloudflare.WorkersKVPair{Key: key, Value: "1"})
+		}()
+	}
+	wg.Wait()
+	//the bulk request failed, only the caller with the invalid key gets an error
+	assert.Nil(t, errs[0])
+	assert.ErrorAs(t, errs[1], &ErrCloudflare{})
+	assert.Equal(t, []cloudflare.WorkersKVBulkWriteRequest{{{Key: "a", Value: "1"}}}, api.writes)
+}
+
+func TestKVBatcher_Order(t *testing.T) {
+	api := &fakeKV{resp: cloudflare.Response{Success: true}}
+	b := newKVBatcher(api, "ns")
+	b.window = time.Millisecond * 50
+	first := newKVBatch()
+	first.write(&cloudflare.WorkersKVPair{Key: "a", Value: "1"})
+	second := newKVBatch()
+	second.write(&cloudflare.WorkersKVPair{Key: "a", Value: "2"})
+	second.prev = first.sent
+
+	//the second batch waits for the first even if it is flushed first
+	go b.flush(second)
+	time.Sleep(time.Millisecond * 10)
+	assert.Empty(t, api.writes)
+	b.flush(first)
+	<-second.sent
+	assert.Equal(t, []cloudflare.WorkersKVBulkWriteRequest{{{Key: "a", Value: "1"}}, {{Key: "a", Value: "2"}}}, api.writes)
+}
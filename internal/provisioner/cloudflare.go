@@ -2,74 +2,134 @@ package provisioner
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/hex"
-	"github.com/broswen/vex/internal/flag"
+	"encoding/json"
+	"net/http"
+	"time"
+
 	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/signing"
 	"github.com/broswen/vex/internal/token"
 	"github.com/cloudflare/cloudflare-go"
-	"github.com/rs/zerolog/log"
 )
 
 type CloudflareProvisioner struct {
 	api                  *cloudflare.API
 	projectKVNamespaceID string
 	tokenKVNamespaceID   string
-	projectStore         project.Store
-	flagStore            flag.Store
+	renderer             *Renderer
 	tokenStore           token.Store
+	// signer is optional, rendered configs aren't signed if it is nil
+	signer *signing.Signer
+	// shardSize is the size of the shards that large configs are split into, sharding is disabled if it is 0
+	shardSize int
+	// limiter limits the rate of every request to the Cloudflare API, it is shared with the provisioners that use the same token
+	limiter *bucket
+	// projects and tokens batch the writes and deletes for each namespace
+	projects *kvBatcher
+	tokens   *kvBatcher
 }
 
-func NewCloudflareProvisioner(apiToken, accountID, projectVNamespaceID, tokenKVNamespaceID string, projectStore project.Store, flagStore flag.Store, tokenStore token.Store) (*CloudflareProvisioner, error) {
-	api, err := cloudflare.NewWithAPIToken(apiToken)
-	api.AccountID = accountID
+func NewCloudflareProvisioner(apiToken, accountID, projectVNamespaceID, tokenKVNamespaceID string, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) (*CloudflareProvisioner, error) {
+	limiter := tokenBucket(apiToken)
+	//requests are limited by the transport, which also sees the 429 responses that the client retries
+	api, err := cloudflare.NewWithAPIToken(apiToken,
+		cloudflare.HTTPClient(&http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport, limiter: limiter}}),
+		cloudflare.UsingRateLimit(1000))
 	if err != nil {
 		return nil, err
 	}
+	api.AccountID = accountID
 	return &CloudflareProvisioner{
 		api:                  api,
 		projectKVNamespaceID: projectVNamespaceID,
 		tokenKVNamespaceID:   tokenKVNamespaceID,
-		projectStore:         projectStore,
-		flagStore:            flagStore,
+		renderer:             renderer,
 		tokenStore:           tokenStore,
+		signer:               signer,
+		limiter:              limiter,
+		projects:             newKVBatcher(api, projectVNamespaceID),
+		tokens:               newKVBatcher(api, tokenKVNamespaceID),
 	}, nil
 }
 
+// Shard splits rendered configs larger than size into shards with a manifest, sizes above MaxValueSize are capped
+func (p *CloudflareProvisioner) Shard(size int) {
+	p.shardSize = shardSize(size)
+}
+
+// Batch gathers project and token writes for the window after the first one into bulk requests, batching is disabled if it is 0
+func (p *CloudflareProvisioner) Batch(window time.Duration) {
+	p.projects.window = window
+	p.tokens.window = window
+}
+
+// RateLimit sets the number of requests per second to the Cloudflare API, for every provisioner that uses the same token
+func (p *CloudflareProvisioner) RateLimit(rps float64) {
+	p.limiter.SetRate(rps)
+}
+
 func (p *CloudflareProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
-	project, err := p.projectStore.Get(ctx, pr.ID)
+	rendered, err := p.renderer.Render(ctx, pr.ID)
 	if err != nil {
 		return err
 	}
-	flags, err := p.flagStore.List(ctx, pr.ID, 1000, 0)
+	pairs, err := layout(rendered.Project.ID, rendered.Config, newMetadata(rendered.Project, rendered.Config, rendered.Hash, p.signer), p.shardSize)
 	if err != nil {
 		return err
 	}
-	rendered, err := flag.RenderConfig(flags)
+	v2, err := layout(V2Key(rendered.Project.ID), rendered.ConfigV2, newMetadata(rendered.Project, rendered.ConfigV2, rendered.HashV2, p.signer), p.shardSize)
 	if err != nil {
 		return err
 	}
-	resp, err := p.api.WriteWorkersKVBulk(ctx, p.projectKVNamespaceID, cloudflare.WorkersKVBulkWriteRequest{
-		{
-			Key:      project.ID,
-			Value:    string(rendered),
-			Metadata: project.AccountID,
-		},
-	})
+	pairs = append(pairs, v2...)
 
-	if !resp.Success {
-		log.Warn().Msgf("errors: %v", resp.Errors)
-		log.Warn().Msgf("messages: %v", resp.Messages)
+	//shards are written one per request to stay under the bulk request size limit, and before the manifests that reference them.
+	//they can split multi-byte characters so they are written base64 encoded
+	configs := make([]*cloudflare.WorkersKVPair, 0)
+	for _, pair := range pairs {
+		if pair.Metadata != nil {
+			configs = append(configs, &cloudflare.WorkersKVPair{Key: pair.Key, Value: string(pair.Value), Metadata: *pair.Metadata})
+			continue
+		}
+		err = checkResponse(p.api.WriteWorkersKVBulk(ctx, p.projectKVNamespaceID, cloudflare.WorkersKVBulkWriteRequest{
+			{Key: pair.Key, Value: base64.StdEncoding.EncodeToString(pair.Value), Base64: true},
+		}))
+		if err != nil {
+			return err
+		}
 	}
-	return err
+	if err = p.projects.Write(ctx, configs...); err != nil {
+		return err
+	}
+	return p.deleteShards(ctx, rendered.Project.ID, pairs)
+}
+
+// deleteShards deletes the shards of a project that aren't part of the pairs that were just written.
+// Shards are only listed when sharding is enabled.
+func (p *CloudflareProvisioner) deleteShards(ctx context.Context, projectId string, written []pair) error {
+	if p.shardSize == 0 {
+		return nil
+	}
+	shards := make([]string, 0)
+	for _, key := range []string{projectId, V2Key(projectId)} {
+		err := p.listKeys(ctx, p.projectKVNamespaceID, shardPrefix(key), func(key cloudflare.StorageKey) error {
+			shards = append(shards, key.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return p.projects.Delete(ctx, staleShards(shards, written)...)
 }
 
 func (p *CloudflareProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
-	resp, err := p.api.DeleteWorkersKV(ctx, p.projectKVNamespaceID, pr.ID)
-	if !resp.Success {
-		log.Warn().Msgf("errors: %v", resp.Errors)
-		log.Warn().Msgf("messages: %v", resp.Messages)
+	if err := p.projects.Delete(ctx, pr.ID, V2Key(pr.ID)); err != nil {
+		return err
 	}
-	return err
+	return p.deleteShards(ctx, pr.ID, nil)
 }
 
 func (p *CloudflareProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
@@ -77,25 +137,69 @@ func (p *CloudflareProvisioner) ProvisionToken(ctx context.Context, t *token.Tok
 	if err != nil {
 		return err
 	}
-	resp, err := p.api.WriteWorkersKVBulk(ctx, p.tokenKVNamespaceID, cloudflare.WorkersKVBulkWriteRequest{
-		{
-			Key:   hex.EncodeToString(tok.TokenHash),
-			Value: tok.AccountID,
-		},
+	return p.tokens.Write(ctx, &cloudflare.WorkersKVPair{
+		Key:   hex.EncodeToString(tok.TokenHash),
+		Value: tok.AccountID,
 	})
-
-	if !resp.Success {
-		log.Warn().Msgf("errors: %v", resp.Errors)
-		log.Warn().Msgf("messages: %v", resp.Messages)
-	}
-	return err
 }
 
 func (p *CloudflareProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
-	resp, err := p.api.DeleteWorkersKV(ctx, p.tokenKVNamespaceID, hex.EncodeToString(t.TokenHash))
-	if !resp.Success {
-		log.Warn().Msgf("errors: %v", resp.Errors)
-		log.Warn().Msgf("messages: %v", resp.Messages)
+	return p.tokens.Delete(ctx, hex.EncodeToString(t.TokenHash))
+}
+
+// ProjectKeys lists the keys in the project namespace with their metadata
+func (p *CloudflareProvisioner) ProjectKeys(ctx context.Context) (map[string]Metadata, error) {
+	keys := make(map[string]Metadata)
+	err := p.listKeys(ctx, p.projectKVNamespaceID, "", func(key cloudflare.StorageKey) error {
+		if IsShardKey(key.Name) {
+			return nil
+		}
+		m := Metadata{}
+		if key.Metadata != nil {
+			b, err := json.Marshal(key.Metadata)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(b, &m); err != nil {
+				return err
+			}
+		}
+		keys[key.Name] = m
+		return nil
+	})
+	return keys, err
+}
+
+// TokenKeys lists the hex encoded token hashes in the token namespace
+func (p *CloudflareProvisioner) TokenKeys(ctx context.Context) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	err := p.listKeys(ctx, p.tokenKVNamespaceID, "", func(key cloudflare.StorageKey) error {
+		keys[key.Name] = true
+		return nil
+	})
+	return keys, err
+}
+
+func (p *CloudflareProvisioner) listKeys(ctx context.Context, namespaceID, prefix string, fn func(key cloudflare.StorageKey) error) error {
+	limit := 1000
+	cursor := ""
+	for {
+		options := cloudflare.ListWorkersKVsOptions{Limit: &limit, Cursor: &cursor}
+		if prefix != "" {
+			options.Prefix = &prefix
+		}
+		resp, err := p.api.ListWorkersKVsWithOptions(ctx, namespaceID, options)
+		if err = checkResponse(resp.Response, err); err != nil {
+			return err
+		}
+		for _, key := range resp.Result {
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+		cursor = resp.Cursor
+		if cursor == "" {
+			return nil
+		}
 	}
-	return err
 }
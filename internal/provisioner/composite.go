@@ -0,0 +1,146 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog/log"
+)
+
+// Route sends the projects and tokens of some accounts to a target
+type Route struct {
+	// Name identifies the target in logs, errors and metrics
+	Name   string
+	Target Provisioner
+	// Accounts are the account ids that are routed to the target, every account is routed to it if it is empty
+	Accounts map[string]bool
+}
+
+// matches reports whether an account is routed to the target
+func (r Route) matches(accountId string) bool {
+	return len(r.Accounts) == 0 || r.Accounts[accountId]
+}
+
+// ErrTargets is returned when some of the targets failed, the other targets were provisioned
+type ErrTargets struct {
+	Errors map[string]error
+}
+
+func (e ErrTargets) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %s", name, e.Errors[name]))
+	}
+	return "targets failed: " + strings.Join(messages, "; ")
+}
+
+// CompositeProvisioner provisions to the targets of every route that matches the account, in parallel
+type CompositeProvisioner struct {
+	routes []Route
+	// projects and tokens look up the account of events without one, like messages from before envelopes
+	projects project.Store
+	tokens   token.Store
+}
+
+func NewCompositeProvisioner(routes ...Route) *CompositeProvisioner {
+	return &CompositeProvisioner{
+		routes: routes,
+	}
+}
+
+// Resolve looks up the account of projects and tokens that are provisioned without one, so they only go to the targets
+// of their account. Without it they only go to the targets of routes without accounts.
+func (p *CompositeProvisioner) Resolve(projects project.Store, tokens token.Store) {
+	p.projects = projects
+	p.tokens = tokens
+}
+
+func (p *CompositeProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	if pr.AccountID == "" && p.projects != nil {
+		stored, err := p.projects.Get(ctx, pr.ID)
+		if err != nil {
+			return err
+		}
+		resolved := *pr
+		resolved.AccountID = stored.AccountID
+		pr = &resolved
+	}
+	return p.each(pr.AccountID, false, func(target Provisioner) error {
+		return target.ProvisionProject(ctx, pr)
+	})
+}
+
+// DeprovisionProject deprovisions a project from the targets of its account. Deleted projects can't be looked up,
+// so projects without an account are deprovisioned from every target, which is a no-op for targets that don't have them.
+func (p *CompositeProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	return p.each(pr.AccountID, pr.AccountID == "", func(target Provisioner) error {
+		return target.DeprovisionProject(ctx, pr)
+	})
+}
+
+func (p *CompositeProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	if t.AccountID == "" && p.tokens != nil {
+		stored, err := p.tokens.Get(ctx, t.ID)
+		if err != nil {
+			return err
+		}
+		resolved := *t
+		resolved.AccountID = stored.AccountID
+		t = &resolved
+	}
+	return p.each(t.AccountID, false, func(target Provisioner) error {
+		return target.ProvisionToken(ctx, t)
+	})
+}
+
+// DeprovisionToken deprovisions a token from the targets of its account, tokens without an account are deprovisioned
+// from every target like projects.
+func (p *CompositeProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	return p.each(t.AccountID, t.AccountID == "", func(target Provisioner) error {
+		return target.DeprovisionToken(ctx, t)
+	})
+}
+
+// each calls fn with the target of every route that matches the account, or of every route if all is true, and records
+// the result for each target. Every target is called even if some fail, retries call the targets that succeeded again
+// which is safe because provisioning writes the latest render.
+func (p *CompositeProvisioner) each(accountId string, all bool, fn func(target Provisioner) error) error {
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	errs := make(map[string]error)
+	for _, r := range p.routes {
+		if !all && !r.matches(accountId) {
+			continue
+		}
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(r.Target); err != nil {
+				stats.TargetError.WithLabelValues(r.Name).Inc()
+				log.Error().Err(err).Str("target", r.Name).Str("account", accountId).Msg("target failed")
+				mu.Lock()
+				errs[r.Name] = err
+				mu.Unlock()
+				return
+			}
+			stats.TargetProvisioned.WithLabelValues(r.Name).Inc()
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return ErrTargets{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCompositeProvisioner(t *testing.T) {
+	us := NewMockProvisioner()
+	eu := NewMockProvisioner()
+	mirror := NewMockProvisioner()
+	p := NewCompositeProvisioner(
+		Route{Name: "us", Target: us, Accounts: map[string]bool{"1": true}},
+		Route{Name: "eu", Target: eu, Accounts: map[string]bool{"2": true}},
+		Route{Name: "mirror", Target: mirror},
+	)
+
+	pr := &project.Project{ID: "3", AccountID: "1"}
+	us.On("ProvisionProject", mock.Anything, pr).Return(nil)
+	mirror.On("ProvisionProject", mock.Anything, pr).Return(nil)
+	assert.Nil(t, p.ProvisionProject(context.Background(), pr))
+	eu.AssertNotCalled(t, "ProvisionProject", mock.Anything, pr)
+
+	//every target is called even if one fails
+	tok := &token.Token{ID: "4", AccountID: "2"}
+	eu.On("ProvisionToken", mock.Anything, tok).Return(errors.New("rate limited"))
+	mirror.On("ProvisionToken", mock.Anything, tok).Return(nil)
+	err := p.ProvisionToken(context.Background(), tok)
+	assert.ErrorAs(t, err, &ErrTargets{})
+	assert.Equal(t, "targets failed: eu: rate limited", err.Error())
+	mirror.AssertCalled(t, "ProvisionToken", mock.Anything, tok)
+	us.AssertNotCalled(t, "ProvisionToken", mock.Anything, tok)
+
+	//deprovisions without an account can't be looked up and go to every target
+	legacy := &token.Token{TokenHash: []byte{0xab}}
+	for _, target := range []*MockProvisioner{us, eu, mirror} {
+		target.On("DeprovisionToken", mock.Anything, legacy).Return(nil)
+	}
+	assert.Nil(t, p.DeprovisionToken(context.Background(), legacy))
+
+	//provisions without an account only go to routes without accounts when they can't be looked up
+	unrouted := &project.Project{ID: "5"}
+	mirror.On("ProvisionProject", mock.Anything, unrouted).Return(nil)
+	assert.Nil(t, p.ProvisionProject(context.Background(), unrouted))
+	us.AssertNotCalled(t, "ProvisionProject", mock.Anything, unrouted)
+	eu.AssertNotCalled(t, "ProvisionProject", mock.Anything, unrouted)
+	us.AssertExpectations(t)
+	eu.AssertExpectations(t)
+	mirror.AssertExpectations(t)
+}
+
+func TestRoutesFromEnv(t *testing.T) {
+	env := map[string]string{
+		"TARGET_US_PROVISIONER":                  "cloudflare",
+		"TARGET_US_ACCOUNTS":                     "1, 2",
+		"TARGET_EU_WEST_PROVISIONER":             "cloudflare",
+		"TARGET_EU_WEST_CLOUDFLARE_ACCOUNT_ID":   "eu-account",
+		"TARGET_EU_WEST_PROJECT_KV_NAMESPACE_ID": "eu-projects",
+		"TARGET_MIRROR_PROVISIONER":              "filesystem",
+		"TARGET_MIRROR_PROVISION_DIR":            "/mirror",
+		"TARGET_MIRROR_SHARD_SIZE":               "1024",
+	}
+	defaults := TargetConfig{CloudflareToken: "token", CloudflareAccountID: "us-account", ProjectKVNamespaceID: "us-projects", Dir: "/var/lib/vex"}
+	routes, err := RoutesFromEnv([]string{"us", "eu-west", " mirror"}, defaults, func(key string) string {
+		return env[key]
+	})
+	assert.Nil(t, err)
+	assert.Len(t, routes, 3)
+	assert.Equal(t, []string{"1", "2"}, routes[0].Accounts)
+	assert.Equal(t, defaults, routes[0].Config)
+	assert.Equal(t, "eu-west", routes[1].Name)
+	assert.Equal(t, "token", routes[1].Config.CloudflareToken)
+	assert.Equal(t, "eu-account", routes[1].Config.CloudflareAccountID)
+	assert.Equal(t, "eu-projects", routes[1].Config.ProjectKVNamespaceID)
+	assert.Empty(t, routes[1].Accounts)
+	assert.Equal(t, "filesystem", routes[2].Target)
+	assert.Equal(t, "/mirror", routes[2].Config.Dir)
+	assert.Equal(t, 1024, routes[2].Config.ShardSize)
+
+	_, err = RoutesFromEnv([]string{"other"}, defaults, func(key string) string {
+		return env[key]
+	})
+	assert.NotNil(t, err)
+	_, err = RoutesFromEnv([]string{"us", "us"}, defaults, func(key string) string {
+		return env[key]
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,112 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+)
+
+// EnvelopeVersion is the version of the envelope that provisioning events are sent in
+const EnvelopeVersion = 1
+
+// EnvelopeHeader is set on kafka messages that contain an envelope to the envelope version,
+// messages without it are from before envelopes and only contain the id or token hash
+const EnvelopeHeader = "vex-envelope"
+
+type EventType string
+
+const (
+	PROVISION_PROJECT   EventType = "PROVISION_PROJECT"
+	DEPROVISION_PROJECT EventType = "DEPROVISION_PROJECT"
+	PROVISION_TOKEN     EventType = "PROVISION_TOKEN"
+	DEPROVISION_TOKEN   EventType = "DEPROVISION_TOKEN"
+)
+
+// Envelope is a provisioning event
+type Envelope struct {
+	Version   int       `json:"version"`
+	Type      EventType `json:"type"`
+	AccountID string    `json:"account_id,omitempty"`
+	ProjectID string    `json:"project_id,omitempty"`
+	TokenID   string    `json:"token_id,omitempty"`
+	// TokenHash is the hex encoded hash of a deprovisioned token
+	TokenHash string `json:"token_hash,omitempty"`
+	// Sequence is the project version, events with a lower sequence than an event that was already handled are stale
+	Sequence int64 `json:"sequence,omitempty"`
+	// Reason is what changed, eg. flags or token.rerolled
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func NewEnvelope(ctx context.Context, t EventType) *Envelope {
+	return &Envelope{
+		Version:   EnvelopeVersion,
+		Type:      t,
+		Reason:    Reason(ctx),
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func newProjectEnvelope(ctx context.Context, t EventType, p *project.Project) *Envelope {
+	e := NewEnvelope(ctx, t)
+	e.AccountID = p.AccountID
+	e.ProjectID = p.ID
+	e.Sequence = p.Version
+	return e
+}
+
+func newTokenEnvelope(ctx context.Context, t EventType, tok *token.Token) *Envelope {
+	e := NewEnvelope(ctx, t)
+	e.AccountID = tok.AccountID
+	e.TokenID = tok.ID
+	if len(tok.TokenHash) > 0 {
+		e.TokenHash = hex.EncodeToString(tok.TokenHash)
+	}
+	return e
+}
+
+func DecodeEnvelope(b []byte) (*Envelope, error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	if e.Version < 1 || e.Version > EnvelopeVersion {
+		return nil, errors.New("unsupported envelope version")
+	}
+	return e, nil
+}
+
+// Project is the project the event is for
+func (e *Envelope) Project() *project.Project {
+	return &project.Project{ID: e.ProjectID, AccountID: e.AccountID, Version: e.Sequence}
+}
+
+// Token is the token the event is for
+func (e *Envelope) Token() (*token.Token, error) {
+	t := &token.Token{ID: e.TokenID, AccountID: e.AccountID}
+	if e.TokenHash != "" {
+		hash, err := hex.DecodeString(e.TokenHash)
+		if err != nil {
+			return nil, err
+		}
+		t.TokenHash = hash
+	}
+	return t, nil
+}
+
+type reasonKey struct{}
+
+// WithReason sets the reason that is sent with provisioning events
+func WithReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, reasonKey{}, reason)
+}
+
+func Reason(ctx context.Context) string {
+	reason, _ := ctx.Value(reasonKey{}).(string)
+	return reason
+}
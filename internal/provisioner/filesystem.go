@@ -0,0 +1,29 @@
+package provisioner
+
+import (
+	"path/filepath"
+
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/token"
+)
+
+// FilesystemProvisioner writes rendered configs under {dir}/projects and token mappings under {dir}/tokens.
+// Each value is stored with its metadata in one file that is replaced atomically, the edge server can serve the directory with STORE=disk.
+type FilesystemProvisioner struct {
+	*KVProvisioner
+}
+
+func NewFilesystemProvisioner(dir string, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) (*FilesystemProvisioner, error) {
+	projects, err := kv.NewDiskStore(filepath.Join(dir, "projects"))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := kv.NewDiskStore(filepath.Join(dir, "tokens"))
+	if err != nil {
+		return nil, err
+	}
+	return &FilesystemProvisioner{
+		KVProvisioner: NewKVProvisioner(projects, tokens, renderer, tokenStore, signer),
+	}, nil
+}
@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFilesystemProvisioner(t *testing.T) {
+	dir := t.TempDir()
+	projectStore := project.NewMockStore()
+	projectStore.On("Configs", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, &project.Configs{}, nil)
+	projectStore.On("Get", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, nil)
+	projectStore.On("SetConfigs", mock.Anything, "1", mock.Anything).Return(nil)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, "1").Return(&flag.Snapshot{Flags: []*flag.Flag{
+		{Key: "feature1", Type: flag.STRING, Value: "test"},
+	}}, nil)
+	tokenStore := token.NewMockStore()
+	tokenStore.On("Get", mock.Anything, "3").Return(&token.Token{ID: "3", AccountID: "2", TokenHash: []byte{0xab, 0xcd}}, nil)
+
+	p, err := NewFilesystemProvisioner(dir, NewRenderer(projectStore, flagStore, nil), tokenStore, nil)
+	assert.Nil(t, err)
+	projects, err := kv.NewDiskStore(filepath.Join(dir, "projects"))
+	assert.Nil(t, err)
+	tokens, err := kv.NewDiskStore(filepath.Join(dir, "tokens"))
+	assert.Nil(t, err)
+
+	err = p.ProvisionProject(context.Background(), &project.Project{ID: "1"})
+	assert.Nil(t, err)
+	config, err := projects.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"feature1\":{\"value\":\"test\",\"type\":\"STRING\"}}\n", string(config.Value))
+	_, err = os.Stat(filepath.Join(dir, "projects", "v2", "1"))
+	assert.Nil(t, err)
+	metadata := Metadata{}
+	assert.Nil(t, json.Unmarshal(config.Metadata, &metadata))
+	assert.Equal(t, "2", metadata.AccountID)
+	assert.Equal(t, flag.ContentHash(config.Value), metadata.Hash)
+
+	err = p.ProvisionToken(context.Background(), &token.Token{ID: "3"})
+	assert.Nil(t, err)
+	account, err := tokens.Get(context.Background(), hex.EncodeToString([]byte{0xab, 0xcd}))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(account.Value))
+
+	err = p.DeprovisionProject(context.Background(), &project.Project{ID: "1"})
+	assert.Nil(t, err)
+	for _, name := range []string{"1", "v2/1"} {
+		_, err = os.Stat(filepath.Join(dir, "projects", name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	err = p.DeprovisionToken(context.Background(), &token.Token{TokenHash: []byte{0xab, 0xcd}})
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "tokens", "abcd"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,12 +2,14 @@ package provisioner
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"github.com/Shopify/sarama"
 	"github.com/broswen/vex/internal/project"
 	"github.com/broswen/vex/internal/stats"
 	"github.com/broswen/vex/internal/token"
 	"github.com/rs/zerolog/log"
-	"time"
+	"strconv"
 )
 
 type KafkaProvisioner struct {
@@ -45,13 +47,26 @@ func NewKafkaProvisioner(provisionProjectTopic, deprovisionProjectTopic, provisi
 	}, nil
 }
 
-func (p *KafkaProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
-	_, _, err := p.producer.SendMessage(&sarama.ProducerMessage{
-		Topic:     p.provisionProjectTopic,
-		Key:       sarama.StringEncoder(pr.ID),
-		Value:     sarama.StringEncoder(pr.ID),
-		Timestamp: time.Now(),
+// send sends an envelope to the topic, events for the same project or token have the same key so they stay in order
+func (p *KafkaProvisioner) send(topic, key string, e *Envelope) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, _, err = p.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(EnvelopeHeader), Value: []byte(strconv.Itoa(EnvelopeVersion))},
+		},
+		Timestamp: e.Timestamp,
 	})
+	return err
+}
+
+func (p *KafkaProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	err := p.send(p.provisionProjectTopic, pr.ID, newProjectEnvelope(ctx, PROVISION_PROJECT, pr))
 	if err != nil {
 		stats.ProvisionError.Inc()
 	}
@@ -59,12 +74,7 @@ func (p *KafkaProvisioner) ProvisionProject(ctx context.Context, pr *project.Pro
 }
 
 func (p *KafkaProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
-	_, _, err := p.producer.SendMessage(&sarama.ProducerMessage{
-		Topic:     p.deprovisionProjectTopic,
-		Key:       sarama.StringEncoder(pr.ID),
-		Value:     sarama.StringEncoder(pr.ID),
-		Timestamp: time.Now(),
-	})
+	err := p.send(p.deprovisionProjectTopic, pr.ID, newProjectEnvelope(ctx, DEPROVISION_PROJECT, pr))
 	if err != nil {
 		stats.DeprovisionError.Inc()
 	}
@@ -72,12 +82,7 @@ func (p *KafkaProvisioner) DeprovisionProject(ctx context.Context, pr *project.P
 }
 
 func (p *KafkaProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
-	_, _, err := p.producer.SendMessage(&sarama.ProducerMessage{
-		Topic:     p.provisionTokenTopic,
-		Key:       sarama.StringEncoder(t.ID),
-		Value:     sarama.StringEncoder(t.ID),
-		Timestamp: time.Now(),
-	})
+	err := p.send(p.provisionTokenTopic, t.ID, newTokenEnvelope(ctx, PROVISION_TOKEN, t))
 	if err != nil {
 		stats.ProvisionError.Inc()
 	}
@@ -85,12 +90,7 @@ func (p *KafkaProvisioner) ProvisionToken(ctx context.Context, t *token.Token) e
 }
 
 func (p *KafkaProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
-	_, _, err := p.producer.SendMessage(&sarama.ProducerMessage{
-		Topic:     p.deprovisionTokenTopic,
-		Key:       sarama.StringEncoder(t.Token),
-		Value:     sarama.ByteEncoder(t.TokenHash),
-		Timestamp: time.Now(),
-	})
+	err := p.send(p.deprovisionTokenTopic, hex.EncodeToString(t.TokenHash), newTokenEnvelope(ctx, DEPROVISION_TOKEN, t))
 	if err != nil {
 		stats.DeprovisionError.Inc()
 	}
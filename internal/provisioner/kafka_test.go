@@ -0,0 +1,38 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaProvisioner_DeprovisionToken(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		sent = m
+		return nil
+	})
+	p := &KafkaProvisioner{deprovisionTokenTopic: "vex-deprovision-token", producer: producer}
+	err := p.DeprovisionToken(WithReason(context.Background(), "token.deleted"), &token.Token{AccountID: "a1", TokenHash: []byte{0xab, 0xcd}})
+	assert.NoError(t, err)
+	assert.NoError(t, producer.Close())
+
+	// the token hash is the key so events for the same token stay in order
+	assert.Equal(t, sarama.StringEncoder("abcd"), sent.Key)
+	assert.Equal(t, EnvelopeHeader, string(sent.Headers[0].Key))
+	value, err := sent.Value.Encode()
+	assert.NoError(t, err)
+	e := &Envelope{}
+	assert.NoError(t, json.Unmarshal(value, e))
+	assert.Equal(t, EnvelopeVersion, e.Version)
+	assert.Equal(t, DEPROVISION_TOKEN, e.Type)
+	assert.Equal(t, "a1", e.AccountID)
+	assert.Equal(t, "abcd", e.TokenHash)
+	assert.Equal(t, "token.deleted", e.Reason)
+}
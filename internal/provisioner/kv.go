@@ -0,0 +1,141 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/broswen/vex/internal/kv"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/token"
+)
+
+// KVProvisioner writes rendered configs and token hashes to kv stores with the same layout as the Cloudflare KV namespaces
+type KVProvisioner struct {
+	projects   kv.Store
+	tokens     kv.Store
+	renderer   *Renderer
+	tokenStore token.Store
+	// signer is optional, rendered configs aren't signed if it is nil
+	signer *signing.Signer
+	// shardSize is the size of the shards that large configs are split into, sharding is disabled if it is 0
+	shardSize int
+}
+
+func NewKVProvisioner(projects, tokens kv.Store, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) *KVProvisioner {
+	return &KVProvisioner{
+		projects:   projects,
+		tokens:     tokens,
+		renderer:   renderer,
+		tokenStore: tokenStore,
+		signer:     signer,
+	}
+}
+
+// Shard splits rendered configs larger than size into shards with a manifest, sizes above MaxValueSize are capped
+func (p *KVProvisioner) Shard(size int) {
+	p.shardSize = shardSize(size)
+}
+
+func (p *KVProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	rendered, err := p.renderer.Render(ctx, pr.ID)
+	if err != nil {
+		return err
+	}
+	if err = p.write(ctx, rendered.Project.ID, rendered.Config, newMetadata(rendered.Project, rendered.Config, rendered.Hash, p.signer)); err != nil {
+		return err
+	}
+	return p.write(ctx, V2Key(rendered.Project.ID), rendered.ConfigV2, newMetadata(rendered.Project, rendered.ConfigV2, rendered.HashV2, p.signer))
+}
+
+// write puts a rendered config, or its shards followed by the manifest, and then deletes the shards of the previous config
+func (p *KVProvisioner) write(ctx context.Context, key string, config []byte, m Metadata) error {
+	pairs, err := layout(key, config, m, p.shardSize)
+	if err != nil {
+		return err
+	}
+	previous, err := p.shards(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if err = p.put(ctx, pair); err != nil {
+			return err
+		}
+	}
+	for _, shard := range staleShards(previous, pairs) {
+		if err = p.projects.Delete(ctx, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *KVProvisioner) put(ctx context.Context, pair pair) error {
+	e := &kv.Entry{Value: pair.Value}
+	if pair.Metadata != nil {
+		metadata, err := json.Marshal(pair.Metadata)
+		if err != nil {
+			return err
+		}
+		e.Metadata = metadata
+	}
+	return p.projects.Put(ctx, pair.Key, e)
+}
+
+// shards returns the shard keys from the manifest stored under key, if the config is sharded
+func (p *KVProvisioner) shards(ctx context.Context, key string) ([]string, error) {
+	e, err := p.projects.Get(ctx, key)
+	if err != nil {
+		if errors.As(err, &kv.ErrKeyNotFound{}) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := Metadata{}
+	if len(e.Metadata) > 0 {
+		if err = json.Unmarshal(e.Metadata, &m); err != nil {
+			return nil, err
+		}
+	}
+	if m.Shards == 0 {
+		return nil, nil
+	}
+	manifest := Manifest{}
+	if err = json.Unmarshal(e.Value, &manifest); err != nil {
+		return nil, err
+	}
+	return manifest.Shards, nil
+}
+
+func (p *KVProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	for _, key := range []string{pr.ID, V2Key(pr.ID)} {
+		shards, err := p.shards(ctx, key)
+		if err != nil {
+			return err
+		}
+		if err = p.projects.Delete(ctx, key); err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			if err = p.projects.Delete(ctx, shard); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *KVProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	tok, err := p.tokenStore.Get(ctx, t.ID)
+	if err != nil {
+		return err
+	}
+	return p.tokens.Put(ctx, hex.EncodeToString(tok.TokenHash), &kv.Entry{Value: []byte(tok.AccountID)})
+}
+
+func (p *KVProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	return p.tokens.Delete(ctx, hex.EncodeToString(t.TokenHash))
+}
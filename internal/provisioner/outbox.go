@@ -0,0 +1,68 @@
+package provisioner
+
+import (
+	"context"
+
+	"github.com/broswen/vex/internal/outbox"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog/log"
+)
+
+// OutboxHandler sends outbox messages with a provisioner. Messages are sent with WithSync so a PoolProvisioner
+// returns the result of provisioning, and a message that fails is retried instead of being deleted from the outbox.
+func OutboxHandler(p Provisioner) outbox.Handler {
+	return func(ctx context.Context, m *outbox.Message) error {
+		ctx = WithSync(WithReason(ctx, m.Reason))
+		switch m.Type {
+		case outbox.PROVISION_PROJECT:
+			return p.ProvisionProject(ctx, &project.Project{ID: m.ProjectID, AccountID: m.AccountID, Version: m.Version})
+		case outbox.DEPROVISION_PROJECT:
+			return p.DeprovisionProject(ctx, &project.Project{ID: m.ProjectID, AccountID: m.AccountID})
+		case outbox.PROVISION_TOKEN:
+			return p.ProvisionToken(ctx, &token.Token{ID: m.TokenID, AccountID: m.AccountID})
+		case outbox.DEPROVISION_TOKEN:
+			return p.DeprovisionToken(ctx, &token.Token{TokenHash: m.TokenHash, AccountID: m.AccountID})
+		}
+		log.Warn().Int64("id", m.ID).Str("type", string(m.Type)).Msg("unknown outbox message")
+		return nil
+	}
+}
+
+// SyncProvisioner only provisions requests with a WithSync context.
+// Every other change is provisioned from the outbox by the relay.
+type SyncProvisioner struct {
+	next Provisioner
+}
+
+func NewSyncProvisioner(next Provisioner) *SyncProvisioner {
+	return &SyncProvisioner{next: next}
+}
+
+func (p *SyncProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	if !IsSync(ctx) {
+		return nil
+	}
+	return p.next.ProvisionProject(ctx, pr)
+}
+
+func (p *SyncProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	if !IsSync(ctx) {
+		return nil
+	}
+	return p.next.DeprovisionProject(ctx, pr)
+}
+
+func (p *SyncProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	if !IsSync(ctx) {
+		return nil
+	}
+	return p.next.ProvisionToken(ctx, t)
+}
+
+func (p *SyncProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	if !IsSync(ctx) {
+		return nil
+	}
+	return p.next.DeprovisionToken(ctx, t)
+}
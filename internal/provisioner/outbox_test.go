@@ -0,0 +1,50 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/outbox"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestOutboxHandler(t *testing.T) {
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, &project.Project{ID: "1", AccountID: "2"}).Return(nil)
+	target.On("DeprovisionToken", mock.Anything, &token.Token{TokenHash: []byte{0xab}, AccountID: "2"}).Return(nil)
+	handler := OutboxHandler(target)
+	assert.Nil(t, handler(context.Background(), &outbox.Message{Type: outbox.PROVISION_PROJECT, ProjectID: "1", AccountID: "2"}))
+	assert.Nil(t, handler(context.Background(), &outbox.Message{Type: outbox.DEPROVISION_TOKEN, TokenHash: []byte{0xab}, AccountID: "2"}))
+	target.AssertExpectations(t)
+}
+
+func TestOutboxHandler_PoolError(t *testing.T) {
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, mock.Anything).Return(errors.New("target unavailable"))
+	pool := NewPoolProvisioner(target, 1, 1)
+	defer pool.Close()
+
+	//the message is kept in the outbox when the pooled target fails
+	store := outbox.NewMockStore()
+	store.On("Claim", mock.Anything, int64(100), time.Minute).Return([]*outbox.Message{{ID: 1, Type: outbox.PROVISION_PROJECT, ProjectID: "1"}}, nil)
+	store.On("Retry", mock.Anything, int64(1), time.Second).Return(nil)
+	relay := outbox.NewRelay(store, OutboxHandler(pool))
+	assert.Nil(t, relay.Drain(context.Background()))
+	store.AssertExpectations(t)
+	store.AssertNotCalled(t, "Delete", mock.Anything, int64(1))
+}
+
+func TestSyncProvisioner(t *testing.T) {
+	target := NewMockProvisioner()
+	p := &project.Project{ID: "1"}
+	target.On("ProvisionProject", mock.MatchedBy(IsSync), p).Return(nil).Once()
+	sync := NewSyncProvisioner(target)
+	assert.Nil(t, sync.ProvisionProject(context.Background(), p))
+	assert.Nil(t, sync.ProvisionProject(WithSync(context.Background()), p))
+	target.AssertExpectations(t)
+}
@@ -0,0 +1,150 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrPoolClosed = errors.New("provisioner pool is closed")
+
+type syncKey struct{}
+
+// WithSync makes a PoolProvisioner wait for the result instead of returning as soon as the work is queued
+func WithSync(ctx context.Context) context.Context {
+	return context.WithValue(ctx, syncKey{}, true)
+}
+
+func IsSync(ctx context.Context) bool {
+	sync, _ := ctx.Value(syncKey{}).(bool)
+	return sync
+}
+
+type job struct {
+	ctx    context.Context
+	run    func(ctx context.Context) error
+	result chan error
+}
+
+// PoolProvisioner provisions in process with a pool of workers instead of sending events to the provisioner.
+// Work is sharded by project or token so changes to the same project are provisioned in order.
+type PoolProvisioner struct {
+	next    Provisioner
+	workers []chan *job
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+}
+
+func NewPoolProvisioner(next Provisioner, workers, queue int) *PoolProvisioner {
+	p := &PoolProvisioner{
+		next:    next,
+		workers: make([]chan *job, workers),
+	}
+	for i := range p.workers {
+		p.workers[i] = make(chan *job, queue)
+		p.wg.Add(1)
+		go p.work(p.workers[i])
+	}
+	return p
+}
+
+func (p *PoolProvisioner) work(jobs chan *job) {
+	defer p.wg.Done()
+	for j := range jobs {
+		err := j.run(j.ctx)
+		if err != nil {
+			stats.ProvisionError.Inc()
+		}
+		if j.result != nil {
+			j.result <- err
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("could not provision")
+		}
+	}
+}
+
+// do queues the work on the worker for the key, it waits for the result if the context is sync
+func (p *PoolProvisioner) do(ctx context.Context, key string, run func(ctx context.Context) error) error {
+	j := &job{run: run}
+	if IsSync(ctx) {
+		j.ctx = ctx
+		j.result = make(chan error, 1)
+	} else {
+		// async work outlives the request
+		j.ctx = context.Background()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrPoolClosed
+	}
+	select {
+	case p.workers[h.Sum32()%uint32(len(p.workers))] <- j:
+		p.mu.RUnlock()
+	case <-ctx.Done():
+		p.mu.RUnlock()
+		return ctx.Err()
+	}
+
+	if j.result == nil {
+		return nil
+	}
+	select {
+	case err := <-j.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *PoolProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	return p.do(ctx, pr.ID, func(ctx context.Context) error {
+		return p.next.ProvisionProject(ctx, pr)
+	})
+}
+
+func (p *PoolProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	return p.do(ctx, pr.ID, func(ctx context.Context) error {
+		return p.next.DeprovisionProject(ctx, pr)
+	})
+}
+
+func (p *PoolProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	return p.do(ctx, t.ID, func(ctx context.Context) error {
+		return p.next.ProvisionToken(ctx, t)
+	})
+}
+
+func (p *PoolProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	return p.do(ctx, hex.EncodeToString(t.TokenHash), func(ctx context.Context) error {
+		return p.next.DeprovisionToken(ctx, t)
+	})
+}
+
+// Close stops accepting work and waits for queued work to finish
+func (p *PoolProvisioner) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	for _, w := range p.workers {
+		close(w)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,46 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPoolProvisioner_Sync(t *testing.T) {
+	next := NewMockProvisioner()
+	next.On("ProvisionProject", mock.Anything, &project.Project{ID: "1"}).Return(nil)
+	next.On("ProvisionProject", mock.Anything, &project.Project{ID: "2"}).Return(errors.New("failed"))
+	p := NewPoolProvisioner(next, 2, 10)
+	defer p.Close()
+
+	assert.Nil(t, p.ProvisionProject(WithSync(context.Background()), &project.Project{ID: "1"}))
+	assert.EqualError(t, p.ProvisionProject(WithSync(context.Background()), &project.Project{ID: "2"}), "failed")
+	//async errors are only logged
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: "2"}))
+}
+
+func TestPoolProvisioner_Async(t *testing.T) {
+	next := NewMockProvisioner()
+	done := make(chan struct{})
+	next.On("ProvisionProject", mock.Anything, &project.Project{ID: "1"}).Return(nil).Run(func(args mock.Arguments) {
+		close(done)
+	})
+	p := NewPoolProvisioner(next, 1, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, p.ProvisionProject(ctx, &project.Project{ID: "1"}))
+	//async work isn't cancelled with the request
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("project wasn't provisioned")
+	}
+	p.Close()
+	assert.ErrorIs(t, p.ProvisionProject(context.Background(), &project.Project{ID: "1"}), ErrPoolClosed)
+}
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/broswen/vex/internal/notify"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog/log"
+)
+
+// PostgresProvisioner sends provisioning events through postgres instead of kafka,
+// events are stored in provision_event and a notification is sent with pg_notify
+type PostgresProvisioner struct {
+	events notify.Store
+}
+
+func NewPostgresProvisioner(events notify.Store) *PostgresProvisioner {
+	return &PostgresProvisioner{events: events}
+}
+
+func (p *PostgresProvisioner) send(ctx context.Context, e *notify.Event) error {
+	_, err := p.events.Insert(ctx, e)
+	if err != nil {
+		stats.ProvisionError.Inc()
+	}
+	return err
+}
+
+func (p *PostgresProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	return p.send(ctx, &notify.Event{Type: notify.PROVISION_PROJECT, ProjectID: pr.ID, AccountID: pr.AccountID})
+}
+
+func (p *PostgresProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	return p.send(ctx, &notify.Event{Type: notify.DEPROVISION_PROJECT, ProjectID: pr.ID, AccountID: pr.AccountID})
+}
+
+func (p *PostgresProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	return p.send(ctx, &notify.Event{Type: notify.PROVISION_TOKEN, TokenID: t.ID, AccountID: t.AccountID})
+}
+
+func (p *PostgresProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	return p.send(ctx, &notify.Event{Type: notify.DEPROVISION_TOKEN, TokenHash: t.TokenHash, AccountID: t.AccountID})
+}
+
+// NotifyHandler handles postgres provisioning events with a provisioner
+func NotifyHandler(p Provisioner) notify.Handler {
+	return func(ctx context.Context, e *notify.Event) error {
+		switch e.Type {
+		case notify.PROVISION_PROJECT:
+			log.Debug().Str("id", e.ProjectID).Msg("provisioning project")
+			stats.ProjectProvisioned.Inc()
+			return p.ProvisionProject(ctx, &project.Project{ID: e.ProjectID, AccountID: e.AccountID})
+		case notify.DEPROVISION_PROJECT:
+			log.Debug().Str("id", e.ProjectID).Msg("deprovisioning project")
+			stats.ProjectDeprovisioned.Inc()
+			return p.DeprovisionProject(ctx, &project.Project{ID: e.ProjectID, AccountID: e.AccountID})
+		case notify.PROVISION_TOKEN:
+			log.Debug().Str("id", e.TokenID).Msg("provisioning token")
+			stats.ProjectProvisioned.Inc()
+			return p.ProvisionToken(ctx, &token.Token{ID: e.TokenID, AccountID: e.AccountID})
+		case notify.DEPROVISION_TOKEN:
+			log.Debug().Str("token_hash", hex.EncodeToString(e.TokenHash)).Msg("deprovisioning token")
+			stats.ProjectDeprovisioned.Inc()
+			return p.DeprovisionToken(ctx, &token.Token{TokenHash: e.TokenHash, AccountID: e.AccountID})
+		}
+		log.Warn().Int64("id", e.ID).Str("type", string(e.Type)).Msg("unknown provision event")
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/broswen/vex/internal/notify"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPostgresProvisioner(t *testing.T) {
+	store := notify.NewMockStore()
+	p := NewPostgresProvisioner(store)
+	store.On("Insert", mock.Anything, &notify.Event{Type: notify.PROVISION_PROJECT, ProjectID: "1", AccountID: "2"}).Return(&notify.Event{ID: 1}, nil)
+	store.On("Insert", mock.Anything, &notify.Event{Type: notify.DEPROVISION_TOKEN, TokenHash: []byte{0xab}, AccountID: "2"}).Return(&notify.Event{ID: 2}, nil)
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: "1", AccountID: "2"}))
+	assert.Nil(t, p.DeprovisionToken(context.Background(), &token.Token{TokenHash: []byte{0xab}, AccountID: "2"}))
+	store.AssertExpectations(t)
+}
+
+func TestNotifyHandler(t *testing.T) {
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, &project.Project{ID: "1", AccountID: "2"}).Return(nil)
+	target.On("ProvisionToken", mock.Anything, &token.Token{ID: "3", AccountID: "2"}).Return(nil)
+	target.On("DeprovisionToken", mock.Anything, &token.Token{TokenHash: []byte{0xab}, AccountID: "2"}).Return(nil)
+	handler := NotifyHandler(target)
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.PROVISION_PROJECT, ProjectID: "1", AccountID: "2"}))
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.PROVISION_TOKEN, TokenID: "3", AccountID: "2"}))
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.DEPROVISION_TOKEN, TokenHash: []byte{0xab}, AccountID: "2"}))
+	target.AssertExpectations(t)
+}
+
+func TestNotifyHandler_Composite(t *testing.T) {
+	us := NewMockProvisioner()
+	eu := NewMockProvisioner()
+	composite := NewCompositeProvisioner(
+		Route{Name: "us", Target: us, Accounts: map[string]bool{"1": true}},
+		Route{Name: "eu", Target: eu, Accounts: map[string]bool{"2": true}},
+	)
+	projectStore := project.NewMockStore()
+	tokenStore := token.NewMockStore()
+	composite.Resolve(projectStore, tokenStore)
+	handler := NotifyHandler(composite)
+
+	//events without an account are routed to the target of the account they are looked up in
+	projectStore.On("Get", mock.Anything, "3").Return(&project.Project{ID: "3", AccountID: "1"}, nil)
+	us.On("ProvisionProject", mock.Anything, &project.Project{ID: "3", AccountID: "1"}).Return(nil)
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.PROVISION_PROJECT, ProjectID: "3"}))
+	tokenStore.On("Get", mock.Anything, "4").Return(&token.Token{ID: "4", AccountID: "2"}, nil)
+	eu.On("ProvisionToken", mock.Anything, &token.Token{ID: "4", AccountID: "2"}).Return(nil)
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.PROVISION_TOKEN, TokenID: "4"}))
+	eu.AssertNotCalled(t, "ProvisionProject", mock.Anything, mock.Anything)
+	us.AssertNotCalled(t, "ProvisionToken", mock.Anything, mock.Anything)
+
+	//events with an account aren't looked up
+	eu.On("ProvisionProject", mock.Anything, &project.Project{ID: "5", AccountID: "2"}).Return(nil)
+	assert.Nil(t, handler(context.Background(), &notify.Event{Type: notify.PROVISION_PROJECT, ProjectID: "5", AccountID: "2"}))
+	projectStore.AssertNumberOfCalls(t, "Get", 1)
+
+	us.AssertExpectations(t)
+	eu.AssertExpectations(t)
+	projectStore.AssertExpectations(t)
+	tokenStore.AssertExpectations(t)
+}
@@ -3,6 +3,7 @@ package provisioner
 import (
 	"context"
 	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/signing"
 	"github.com/broswen/vex/internal/token"
 )
 
@@ -12,3 +13,32 @@ type Provisioner interface {
 	ProvisionToken(ctx context.Context, t *token.Token) error
 	DeprovisionToken(ctx context.Context, t *token.Token) error
 }
+
+// V2Key is the KV key of the v2 rendered config for a project, the v1 config is stored under the project id
+func V2Key(projectId string) string {
+	return "v2/" + projectId
+}
+
+// Metadata is stored with each rendered config in the project KV namespace
+type Metadata struct {
+	AccountID string `json:"account_id"`
+	// Hash is the content hash of the rendered config
+	Hash string `json:"hash"`
+	// KeyID and Signature are set when rendered configs are signed
+	KeyID     string `json:"kid,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// Shards is set when the value is a Manifest of the shards the config is split into
+	Shards int `json:"shards,omitempty"`
+}
+
+func newMetadata(p *project.Project, rendered []byte, hash string, signer *signing.Signer) Metadata {
+	m := Metadata{
+		AccountID: p.AccountID,
+		Hash:      hash,
+	}
+	if signer != nil {
+		m.KeyID = signer.ID()
+		m.Signature = signer.Sign(rendered)
+	}
+	return m
+}
@@ -0,0 +1,143 @@
+package provisioner
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRateLimit is the Cloudflare API limit of 1200 requests per 5 minutes
+	DefaultRateLimit = 4
+	// rateLimitBackoff is how long requests are paused after a 429 response without a Retry-After header
+	rateLimitBackoff = time.Second * 30
+)
+
+// bucket is a token bucket that limits the rate of requests. A 429 response empties the bucket
+// and no requests are allowed until the Retry-After delay has passed.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// blocked is when requests are allowed again after a 429 response
+	blocked time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// tokenBuckets are shared by every provisioner that uses the same API token, the Cloudflare limit is per token
+var tokenBuckets = struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}{buckets: make(map[string]*bucket)}
+
+// tokenBucket returns the bucket of an API token, it is created with the default rate the first time
+func tokenBucket(apiToken string) *bucket {
+	tokenBuckets.mu.Lock()
+	defer tokenBuckets.mu.Unlock()
+	b, ok := tokenBuckets.buckets[apiToken]
+	if !ok {
+		b = newBucket(DefaultRateLimit, DefaultRateLimit)
+		tokenBuckets.buckets[apiToken] = b
+	}
+	return b
+}
+
+// SetRate changes the number of requests per second, rates that aren't positive are ignored
+func (b *bucket) SetRate(rate float64) {
+	if rate <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+}
+
+// Wait blocks until a request is allowed
+func (b *bucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		wait := b.reserve(time.Now())
+		b.mu.Unlock()
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reserve takes a token and returns 0, or returns how long to wait before trying again
+func (b *bucket) reserve(now time.Time) time.Duration {
+	if now.Before(b.blocked) {
+		return b.blocked.Sub(now)
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Backoff empties the bucket and blocks requests for d
+func (b *bucket) Backoff(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = 0
+	b.last = now
+	if blocked := now.Add(d); blocked.After(b.blocked) {
+		b.blocked = blocked
+	}
+}
+
+// rateLimitTransport waits for the bucket before each request and backs off when the API responds with a 429
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *bucket
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.limiter.Backoff(retryAfter(resp.Header.Get("Retry-After")))
+	}
+	return resp, nil
+}
+
+// retryAfter parses a Retry-After header in seconds or as a date
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return rateLimitBackoff
+}
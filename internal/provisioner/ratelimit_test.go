@@ -0,0 +1,61 @@
+package provisioner
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	b := newBucket(2, 2)
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	//empty until a token is added at 2 per second
+	assert.Equal(t, time.Millisecond*500, b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now.Add(time.Millisecond*500)))
+	//tokens don't go past the burst
+	assert.Equal(t, time.Duration(0), b.reserve(now.Add(time.Minute)))
+	assert.Equal(t, time.Duration(0), b.reserve(now.Add(time.Minute)))
+	assert.Equal(t, time.Millisecond*500, b.reserve(now.Add(time.Minute)))
+}
+
+func TestBucket_Backoff(t *testing.T) {
+	b := newBucket(DefaultRateLimit, DefaultRateLimit)
+	b.Backoff(time.Second * 10)
+	wait := b.reserve(time.Now())
+	assert.Greater(t, wait, time.Second*9)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.ErrorIs(t, b.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert.Same(t, tokenBucket("token1"), tokenBucket("token1"))
+	assert.NotSame(t, tokenBucket("token1"), tokenBucket("token2"))
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "20")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	limiter := newBucket(DefaultRateLimit, DefaultRateLimit)
+	client := &http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport, limiter: limiter}}
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	//requests are blocked for the Retry-After delay
+	assert.Greater(t, limiter.reserve(time.Now()), time.Second*19)
+
+	assert.Equal(t, rateLimitBackoff, retryAfter(""))
+	assert.Equal(t, time.Second*5, retryAfter("5"))
+}
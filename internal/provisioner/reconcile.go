@@ -0,0 +1,229 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog/log"
+)
+
+// Inventory lists what is provisioned so it can be compared with the database
+type Inventory interface {
+	// ProjectKeys returns the metadata of every key in the project namespace, including V2Key keys but not shards
+	ProjectKeys(ctx context.Context) (map[string]Metadata, error)
+	// TokenKeys returns every hex encoded token hash in the token namespace
+	TokenKeys(ctx context.Context) (map[string]bool, error)
+}
+
+// Drift is what a reconciliation found different between the database and the provisioned keys
+type Drift struct {
+	// ProjectsMissing and TokensMissing aren't provisioned
+	ProjectsMissing int
+	TokensMissing   int
+	// ProjectsStale have a content hash that doesn't match the rendered config
+	ProjectsStale int
+	// ProjectsOrphaned and TokensOrphaned are provisioned but no longer in the database
+	ProjectsOrphaned int
+	TokensOrphaned   int
+}
+
+// Reconciler provisions projects and tokens that are missing or stale and deprovisions orphaned keys
+type Reconciler struct {
+	targets  []reconcileTarget
+	renderer *Renderer
+	accounts account.Store
+	projects project.Store
+	tokens   token.Store
+}
+
+// reconcileTarget is a target with its inventory, only the accounts routed to it are reconciled
+type reconcileTarget struct {
+	route     Route
+	inventory Inventory
+}
+
+func NewReconciler(p Provisioner, inventory Inventory, renderer *Renderer, accounts account.Store, projects project.Store, tokens token.Store) *Reconciler {
+	return &Reconciler{
+		targets:  []reconcileTarget{{route: Route{Target: p}, inventory: inventory}},
+		renderer: renderer,
+		accounts: accounts,
+		projects: projects,
+		tokens:   tokens,
+	}
+}
+
+// NewRoutedReconciler reconciles every route of a CompositeProvisioner separately, the keys of each target are compared
+// with the accounts routed to it so accounts that are routed elsewhere are orphaned. Every target must be an Inventory.
+func NewRoutedReconciler(p *CompositeProvisioner, renderer *Renderer, accounts account.Store, projects project.Store, tokens token.Store) (*Reconciler, error) {
+	targets := make([]reconcileTarget, 0, len(p.routes))
+	for _, route := range p.routes {
+		inventory, ok := route.Target.(Inventory)
+		if !ok {
+			return nil, fmt.Errorf("target %s can't be reconciled", route.Name)
+		}
+		targets = append(targets, reconcileTarget{route: route, inventory: inventory})
+	}
+	return &Reconciler{
+		targets:  targets,
+		renderer: renderer,
+		accounts: accounts,
+		projects: projects,
+		tokens:   tokens,
+	}, nil
+}
+
+// Reconcile compares every project and token with the provisioned keys of each target and fixes the drift, the drift is summed over the targets
+func (r *Reconciler) Reconcile(ctx context.Context) (*Drift, error) {
+	drift := &Drift{}
+	for _, t := range r.targets {
+		if err := r.reconcileTarget(ctx, t, drift); err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+// reconcileTarget compares the projects and tokens of the accounts routed to a target with its keys.
+// Keys are listed before the database so anything created in between is provisioned again instead of deleted.
+func (r *Reconciler) reconcileTarget(ctx context.Context, t reconcileTarget, drift *Drift) error {
+	target := t.route.Target
+	projectKeys, err := t.inventory.ProjectKeys(ctx)
+	if err != nil {
+		return err
+	}
+	tokenKeys, err := t.inventory.TokenKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	projects := make(map[string]bool)
+	tokens := make(map[string]bool)
+	err = walkAccounts(ctx, r.accounts, func(a *account.Account) error {
+		if !t.route.matches(a.ID) {
+			return nil
+		}
+		err := walkProjects(ctx, r.projects, a.ID, func(p *project.Project) error {
+			projects[p.ID] = true
+			return r.reconcileProject(ctx, target, p, projectKeys, drift)
+		})
+		if err != nil {
+			return err
+		}
+		return walkTokens(ctx, r.tokens, a.ID, func(tk *token.Token) error {
+			key := hex.EncodeToString(tk.TokenHash)
+			tokens[key] = true
+			if tokenKeys[key] {
+				return nil
+			}
+			drift.TokensMissing++
+			log.Info().Str("id", tk.ID).Str("target", t.route.Name).Msg("provisioning missing token")
+			if err := target.ProvisionToken(ctx, tk); err != nil {
+				log.Error().Err(err).Str("id", tk.ID).Str("target", t.route.Name).Msg("could not provision missing token")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	deprovisioned := make(map[string]bool)
+	for key, m := range projectKeys {
+		id := strings.TrimPrefix(key, V2Key(""))
+		if projects[id] || deprovisioned[id] {
+			continue
+		}
+		deprovisioned[id] = true
+		drift.ProjectsOrphaned++
+		log.Info().Str("id", id).Str("target", t.route.Name).Msg("deprovisioning orphaned project")
+		if err := target.DeprovisionProject(ctx, &project.Project{ID: id, AccountID: m.AccountID}); err != nil {
+			log.Error().Err(err).Str("id", id).Str("target", t.route.Name).Msg("could not deprovision orphaned project")
+		}
+	}
+	for key := range tokenKeys {
+		if tokens[key] {
+			continue
+		}
+		hash, err := hex.DecodeString(key)
+		if err != nil {
+			log.Warn().Str("key", key).Msg("invalid token key")
+			continue
+		}
+		drift.TokensOrphaned++
+		log.Info().Str("key", key).Str("target", t.route.Name).Msg("deprovisioning orphaned token")
+		if err := target.DeprovisionToken(ctx, &token.Token{TokenHash: hash}); err != nil {
+			log.Error().Err(err).Str("key", key).Str("target", t.route.Name).Msg("could not deprovision orphaned token")
+		}
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileProject(ctx context.Context, target Provisioner, p *project.Project, keys map[string]Metadata, drift *Drift) error {
+	rendered, err := r.renderer.Render(ctx, p.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", p.ID).Msg("could not render project")
+		return nil
+	}
+	v1, ok1 := keys[p.ID]
+	v2, ok2 := keys[V2Key(p.ID)]
+	switch {
+	case !ok1 || !ok2:
+		drift.ProjectsMissing++
+		log.Info().Str("id", p.ID).Msg("provisioning missing project")
+	case v1.Hash != rendered.Hash || v2.Hash != rendered.HashV2:
+		drift.ProjectsStale++
+		log.Info().Str("id", p.ID).Str("hash", v1.Hash).Str("rendered", rendered.Hash).Msg("provisioning stale project")
+	default:
+		return nil
+	}
+	if err = target.ProvisionProject(ctx, p); err != nil {
+		log.Error().Err(err).Str("id", p.ID).Msg("could not provision project")
+	}
+	return nil
+}
+
+// Run reconciles every interval until the context is done and reports the drift as metrics
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce reconciles and reports the drift as metrics
+func (r *Reconciler) RunOnce(ctx context.Context) (*Drift, error) {
+	start := time.Now()
+	drift, err := r.Reconcile(ctx)
+	if err != nil {
+		stats.ReconcileError.Inc()
+		log.Error().Err(err).Msg("could not reconcile")
+		return drift, err
+	}
+	stats.DriftProjectsMissing.Set(float64(drift.ProjectsMissing))
+	stats.DriftProjectsStale.Set(float64(drift.ProjectsStale))
+	stats.DriftProjectsOrphaned.Set(float64(drift.ProjectsOrphaned))
+	stats.DriftTokensMissing.Set(float64(drift.TokensMissing))
+	stats.DriftTokensOrphaned.Set(float64(drift.TokensOrphaned))
+	log.Info().
+		Int("projects_missing", drift.ProjectsMissing).
+		Int("projects_stale", drift.ProjectsStale).
+		Int("projects_orphaned", drift.ProjectsOrphaned).
+		Int("tokens_missing", drift.TokensMissing).
+		Int("tokens_orphaned", drift.TokensOrphaned).
+		Dur("duration", time.Since(start)).
+		Msg("reconciled")
+	return drift, nil
+}
@@ -0,0 +1,138 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type testInventory struct {
+	projects map[string]Metadata
+	tokens   map[string]bool
+}
+
+func (i *testInventory) ProjectKeys(ctx context.Context) (map[string]Metadata, error) {
+	return i.projects, nil
+}
+
+func (i *testInventory) TokenKeys(ctx context.Context) (map[string]bool, error) {
+	return i.tokens, nil
+}
+
+func TestReconciler_Reconcile(t *testing.T) {
+	inSync := &project.Project{ID: "p1", AccountID: "a1"}
+	stale := &project.Project{ID: "p2", AccountID: "a1"}
+	missing := &project.Project{ID: "p3", AccountID: "a1"}
+	projectStore := project.NewMockStore()
+	flagStore := flag.NewMockStore()
+	for _, p := range []*project.Project{inSync, stale, missing} {
+		projectStore.On("Configs", mock.Anything, p.ID).Return(p, &project.Configs{}, nil)
+		projectStore.On("Get", mock.Anything, p.ID).Return(p, nil)
+		projectStore.On("SetConfigs", mock.Anything, p.ID, mock.Anything).Return(nil)
+		flagStore.On("Snapshot", mock.Anything, p.ID).Return(&flag.Snapshot{Flags: []*flag.Flag{}}, nil)
+	}
+	projectStore.On("ListAfter", mock.Anything, "a1", time.Time{}, walkStart, int64(walkPageSize)).Return([]*project.Project{inSync, stale, missing}, nil)
+	renderer := NewRenderer(projectStore, flagStore, nil)
+	rendered, err := renderer.Render(context.Background(), "p1")
+	assert.Nil(t, err)
+
+	accountStore := account.NewMockStore()
+	accountStore.On("ListAfter", mock.Anything, time.Time{}, walkStart, int64(walkPageSize)).Return([]*account.Account{{ID: "a1"}}, nil)
+	tokenStore := token.NewMockStore()
+	provisionedToken := &token.Token{ID: "t1", AccountID: "a1", TokenHash: []byte{0xab}}
+	missingToken := &token.Token{ID: "t2", AccountID: "a1", TokenHash: []byte{0xcd}}
+	tokenStore.On("ListAfter", mock.Anything, "a1", time.Time{}, walkStart, int64(walkPageSize)).Return([]*token.Token{provisionedToken, missingToken}, nil)
+
+	inventory := &testInventory{
+		projects: map[string]Metadata{
+			"p1":    {AccountID: "a1", Hash: rendered.Hash},
+			"v2/p1": {AccountID: "a1", Hash: rendered.HashV2},
+			"p2":    {AccountID: "a1", Hash: "old"},
+			"v2/p2": {AccountID: "a1", Hash: rendered.HashV2},
+			"p9":    {AccountID: "a9"},
+			"v2/p9": {AccountID: "a9"},
+		},
+		tokens: map[string]bool{"ab": true, "ef": true},
+	}
+
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, stale).Return(nil)
+	target.On("ProvisionProject", mock.Anything, missing).Return(nil)
+	target.On("DeprovisionProject", mock.Anything, &project.Project{ID: "p9", AccountID: "a9"}).Return(nil).Once()
+	target.On("ProvisionToken", mock.Anything, missingToken).Return(nil)
+	target.On("DeprovisionToken", mock.Anything, &token.Token{TokenHash: []byte{0xef}}).Return(nil)
+
+	reconciler := NewReconciler(target, inventory, renderer, accountStore, projectStore, tokenStore)
+	drift, err := reconciler.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, &Drift{
+		ProjectsMissing:  1,
+		ProjectsStale:    1,
+		ProjectsOrphaned: 1,
+		TokensMissing:    1,
+		TokensOrphaned:   1,
+	}, drift)
+	target.AssertExpectations(t)
+}
+
+type testTarget struct {
+	*MockProvisioner
+	*testInventory
+}
+
+func TestNewRoutedReconciler(t *testing.T) {
+	p1 := &project.Project{ID: "p1", AccountID: "a1"}
+	p2 := &project.Project{ID: "p2", AccountID: "a2"}
+	projectStore := project.NewMockStore()
+	flagStore := flag.NewMockStore()
+	for _, p := range []*project.Project{p1, p2} {
+		projectStore.On("Configs", mock.Anything, p.ID).Return(p, &project.Configs{}, nil)
+		projectStore.On("Get", mock.Anything, p.ID).Return(p, nil)
+		projectStore.On("SetConfigs", mock.Anything, p.ID, mock.Anything).Return(nil)
+		projectStore.On("ListAfter", mock.Anything, p.AccountID, time.Time{}, walkStart, int64(walkPageSize)).Return([]*project.Project{p}, nil)
+		flagStore.On("Snapshot", mock.Anything, p.ID).Return(&flag.Snapshot{Flags: []*flag.Flag{}}, nil)
+	}
+	renderer := NewRenderer(projectStore, flagStore, nil)
+	rendered, err := renderer.Render(context.Background(), "p1")
+	assert.Nil(t, err)
+	accountStore := account.NewMockStore()
+	accountStore.On("ListAfter", mock.Anything, time.Time{}, walkStart, int64(walkPageSize)).Return([]*account.Account{{ID: "a1"}, {ID: "a2"}}, nil)
+	tokenStore := token.NewMockStore()
+	tokenStore.On("ListAfter", mock.Anything, mock.Anything, time.Time{}, walkStart, int64(walkPageSize)).Return([]*token.Token{}, nil)
+
+	// p2 was moved from us to eu
+	us := testTarget{NewMockProvisioner(), &testInventory{
+		projects: map[string]Metadata{
+			"p1":    {AccountID: "a1", Hash: rendered.Hash},
+			"v2/p1": {AccountID: "a1", Hash: rendered.HashV2},
+			"p2":    {AccountID: "a2"},
+			"v2/p2": {AccountID: "a2"},
+		},
+	}}
+	us.On("DeprovisionProject", mock.Anything, &project.Project{ID: "p2", AccountID: "a2"}).Return(nil).Once()
+	eu := testTarget{NewMockProvisioner(), &testInventory{}}
+	eu.On("ProvisionProject", mock.Anything, p2).Return(nil).Once()
+
+	composite := NewCompositeProvisioner(
+		Route{Name: "us", Target: us, Accounts: map[string]bool{"a1": true}},
+		Route{Name: "eu", Target: eu, Accounts: map[string]bool{"a2": true}},
+	)
+	reconciler, err := NewRoutedReconciler(composite, renderer, accountStore, projectStore, tokenStore)
+	assert.Nil(t, err)
+	drift, err := reconciler.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, &Drift{ProjectsMissing: 1, ProjectsOrphaned: 1}, drift)
+	us.AssertExpectations(t)
+	eu.AssertExpectations(t)
+
+	// targets without an inventory can't be reconciled
+	_, err = NewRoutedReconciler(NewCompositeProvisioner(Route{Name: "kafka", Target: NewMockProvisioner()}), renderer, accountStore, projectStore, tokenStore)
+	assert.Error(t, err)
+}
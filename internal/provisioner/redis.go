@@ -0,0 +1,141 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/token"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// RedisChannel receives a RedisChange for every write so subscribers can reload
+	RedisChannel = "vex:changes"
+)
+
+// RedisProjectKey is the key of a rendered config, the v2 config is stored under RedisProjectKey(V2Key(id))
+func RedisProjectKey(key string) string {
+	return "vex:project:" + key
+}
+
+// RedisMetadataKey is the key of the hash that holds the Metadata for a rendered config
+func RedisMetadataKey(key string) string {
+	return RedisProjectKey(key) + ":metadata"
+}
+
+// RedisTokenKey is the key that maps a hex encoded token hash to its account id
+func RedisTokenKey(hash string) string {
+	return "vex:token:" + hash
+}
+
+// RedisChange is published to RedisChannel
+type RedisChange struct {
+	// Type is project or token
+	Type string `json:"type"`
+	// Action is provision or deprovision
+	Action string `json:"action"`
+	// ID is the project id or the hex encoded token hash
+	ID string `json:"id"`
+}
+
+// RedisProvisioner writes rendered configs and token hashes to redis and publishes each change to RedisChannel
+type RedisProvisioner struct {
+	client     *redis.Client
+	renderer   *Renderer
+	tokenStore token.Store
+	// signer is optional, rendered configs aren't signed if it is nil
+	signer *signing.Signer
+}
+
+func NewRedisProvisioner(url string, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) (*RedisProvisioner, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisProvisioner{
+		client:     redis.NewClient(opts),
+		renderer:   renderer,
+		tokenStore: tokenStore,
+		signer:     signer,
+	}, nil
+}
+
+func (p *RedisProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	rendered, err := p.renderer.Render(ctx, pr.ID)
+	if err != nil {
+		return err
+	}
+	change, err := json.Marshal(RedisChange{Type: "project", Action: "provision", ID: rendered.Project.ID})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		p.set(ctx, pipe, rendered.Project.ID, rendered.Config, newMetadata(rendered.Project, rendered.Config, rendered.Hash, p.signer))
+		p.set(ctx, pipe, V2Key(rendered.Project.ID), rendered.ConfigV2, newMetadata(rendered.Project, rendered.ConfigV2, rendered.HashV2, p.signer))
+		pipe.Publish(ctx, RedisChannel, change)
+		return nil
+	})
+	return err
+}
+
+func (p *RedisProvisioner) set(ctx context.Context, pipe redis.Pipeliner, key string, config []byte, m Metadata) {
+	pipe.Set(ctx, RedisProjectKey(key), config, 0)
+	//replace the hash so fields from an old signing key don't linger
+	pipe.Del(ctx, RedisMetadataKey(key))
+	pipe.HSet(ctx, RedisMetadataKey(key), "account_id", m.AccountID, "hash", m.Hash)
+	if m.Signature != "" {
+		pipe.HSet(ctx, RedisMetadataKey(key), "kid", m.KeyID, "signature", m.Signature)
+	}
+}
+
+func (p *RedisProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	change, err := json.Marshal(RedisChange{Type: "project", Action: "deprovision", ID: pr.ID})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, RedisProjectKey(pr.ID), RedisMetadataKey(pr.ID), RedisProjectKey(V2Key(pr.ID)), RedisMetadataKey(V2Key(pr.ID)))
+		pipe.Publish(ctx, RedisChannel, change)
+		return nil
+	})
+	return err
+}
+
+func (p *RedisProvisioner) ProvisionToken(ctx context.Context, t *token.Token) error {
+	tok, err := p.tokenStore.Get(ctx, t.ID)
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(tok.TokenHash)
+	change, err := json.Marshal(RedisChange{Type: "token", Action: "provision", ID: hash})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, RedisTokenKey(hash), tok.AccountID, 0)
+		pipe.Publish(ctx, RedisChannel, change)
+		return nil
+	})
+	return err
+}
+
+func (p *RedisProvisioner) DeprovisionToken(ctx context.Context, t *token.Token) error {
+	hash := hex.EncodeToString(t.TokenHash)
+	change, err := json.Marshal(RedisChange{Type: "token", Action: "deprovision", ID: hash})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, RedisTokenKey(hash))
+		pipe.Publish(ctx, RedisChannel, change)
+		return nil
+	})
+	return err
+}
+
+func (p *RedisProvisioner) Close() error {
+	return p.client.Close()
+}
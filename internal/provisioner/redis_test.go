@@ -0,0 +1,79 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRedisProvisioner(t *testing.T) {
+	mr := miniredis.RunT(t)
+	projectStore := project.NewMockStore()
+	projectStore.On("Configs", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, &project.Configs{}, nil)
+	projectStore.On("Get", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, nil)
+	projectStore.On("SetConfigs", mock.Anything, "1", mock.Anything).Return(nil)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, "1").Return(&flag.Snapshot{Flags: []*flag.Flag{
+		{Key: "feature1", Type: flag.STRING, Value: "test"},
+	}}, nil)
+	tokenStore := token.NewMockStore()
+	tokenStore.On("Get", mock.Anything, "3").Return(&token.Token{ID: "3", AccountID: "2", TokenHash: []byte{0xab, 0xcd}}, nil)
+
+	p, err := NewRedisProvisioner("redis://"+mr.Addr(), NewRenderer(projectStore, flagStore, nil), tokenStore, nil)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	sub := client.Subscribe(context.Background(), RedisChannel)
+	defer sub.Close()
+	_, err = sub.Receive(context.Background())
+	assert.Nil(t, err)
+	next := func() RedisChange {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		msg, err := sub.ReceiveMessage(ctx)
+		assert.Nil(t, err)
+		change := RedisChange{}
+		assert.Nil(t, json.Unmarshal([]byte(msg.Payload), &change))
+		return change
+	}
+
+	err = p.ProvisionProject(context.Background(), &project.Project{ID: "1"})
+	assert.Nil(t, err)
+	config, err := mr.Get("vex:project:1")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"feature1\":{\"value\":\"test\",\"type\":\"STRING\"}}\n", config)
+	assert.True(t, mr.Exists("vex:project:v2/1"))
+	assert.Equal(t, "2", mr.HGet("vex:project:1:metadata", "account_id"))
+	assert.Equal(t, flag.ContentHash([]byte(config)), mr.HGet("vex:project:1:metadata", "hash"))
+	assert.Equal(t, RedisChange{Type: "project", Action: "provision", ID: "1"}, next())
+
+	err = p.ProvisionToken(context.Background(), &token.Token{ID: "3"})
+	assert.Nil(t, err)
+	account, err := mr.Get("vex:token:abcd")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", account)
+	assert.Equal(t, RedisChange{Type: "token", Action: "provision", ID: "abcd"}, next())
+
+	err = p.DeprovisionProject(context.Background(), &project.Project{ID: "1"})
+	assert.Nil(t, err)
+	for _, key := range []string{"vex:project:1", "vex:project:1:metadata", "vex:project:v2/1", "vex:project:v2/1:metadata"} {
+		assert.False(t, mr.Exists(key), key)
+	}
+	assert.Equal(t, RedisChange{Type: "project", Action: "deprovision", ID: "1"}, next())
+
+	err = p.DeprovisionToken(context.Background(), &token.Token{TokenHash: []byte{0xab, 0xcd}})
+	assert.Nil(t, err)
+	assert.False(t, mr.Exists("vex:token:abcd"))
+	assert.Equal(t, RedisChange{Type: "token", Action: "deprovision", ID: "abcd"}, next())
+}
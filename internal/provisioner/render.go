@@ -0,0 +1,215 @@
+package provisioner
+
+import (
+	"context"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/rs/zerolog/log"
+)
+
+// Rendered holds the rendered configs for a project
+type Rendered struct {
+	Project *project.Project
+	// Flags are the rendered flags, SECRET flags are removed or encrypted with the payload key, only set by Snapshot
+	Flags []*flag.Flag
+	// Hidden are the keys of the SECRET flags that were removed, only set by Snapshot
+	Hidden []string
+	// Config is rendered in the project render mode and stored under the project id
+	Config []byte
+	// ConfigV2 is stored under V2Key
+	ConfigV2 []byte
+	// Hash and HashV2 are the content hashes of Config and ConfigV2
+	Hash   string
+	HashV2 string
+}
+
+// Renderer reads a project and its flags and renders the configs that are provisioned for it
+type Renderer struct {
+	projectStore project.Store
+	flagStore    flag.Store
+	// secrets is optional, SECRET flags are never rendered if it is nil
+	secrets *secret.Cipher
+}
+
+func NewRenderer(projectStore project.Store, flagStore flag.Store, secrets *secret.Cipher) *Renderer {
+	return &Renderer{
+		projectStore: projectStore,
+		flagStore:    flagStore,
+		secrets:      secrets,
+	}
+}
+
+// Render returns the configs of a project. They are read with the project from the row the flag writes store them in,
+// configs that aren't current for the project version are rendered from a snapshot of the flags and stored.
+func (r *Renderer) Render(ctx context.Context, projectId string) (*Rendered, error) {
+	p, c, err := r.projectStore.Configs(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Current(p) {
+		//projects written before configs were stored, or by a server without a renderer
+		snapshot, err := r.Snapshot(ctx, projectId)
+		if err != nil {
+			return nil, err
+		}
+		p = snapshot.Project
+		c, err = r.configs(p, snapshot.Flags)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.projectStore.SetConfigs(ctx, projectId, c); err != nil {
+			log.Error().Err(err).Str("id", projectId).Int64("version", c.Version).Msg("could not store rendered configs")
+		}
+	}
+	return &Rendered{Project: p, Config: c.Config, ConfigV2: c.ConfigV2, Hash: c.Hash, HashV2: c.HashV2}, nil
+}
+
+// RenderDoc renders the configs of a project from its flag document, the stores call it in the transactions that change them
+func (r *Renderer) RenderDoc(p *project.Project, doc []byte) (*project.Configs, error) {
+	flags, err := flag.ParseConfigDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	flags, err = r.renderSecrets(p, flags)
+	if err != nil {
+		return nil, err
+	}
+	return r.configs(p, flags)
+}
+
+// configs renders the configs of the current project version from flags whose secrets are already rendered
+func (r *Renderer) configs(p *project.Project, flags []*flag.Flag) (*project.Configs, error) {
+	config, err := renderConfig(p, flags)
+	if err != nil {
+		return nil, err
+	}
+	v2, err := flag.RenderConfigV2(p.ID, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &project.Configs{
+		Version:  p.Version,
+		Config:   config,
+		ConfigV2: v2,
+		Hash:     flag.ContentHash(config),
+		HashV2:   flag.ContentHash(v2),
+	}, nil
+}
+
+// Snapshot renders the flags of a project without the configs. The flags are read along with the project version
+// and the project is read after them, so its payload key is never older than the flags. Project.Version and
+// Project.PrunedVersion are the versions the flags were read at.
+func (r *Renderer) Snapshot(ctx context.Context, projectId string) (*Rendered, error) {
+	snapshot, err := r.flagStore.Snapshot(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	p, err := r.projectStore.Get(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	p.Version = snapshot.Version
+	p.PrunedVersion = snapshot.PrunedVersion
+	flags, err := r.renderSecrets(p, snapshot.Flags)
+	if err != nil {
+		return nil, err
+	}
+	rendered := &Rendered{Project: p, Flags: flags, Hidden: make([]string, 0)}
+	if len(flags) < len(snapshot.Flags) {
+		for _, f := range snapshot.Flags {
+			if f.Type == flag.SECRET {
+				rendered.Hidden = append(rendered.Hidden, f.Key)
+			}
+		}
+	}
+	return rendered, nil
+}
+
+// Hashes returns the content hashes of the configs of the current project version. They are read from the project
+// and the project is only rendered if its version changed since the configs were stored.
+func (r *Renderer) Hashes(ctx context.Context, projectId string) (*project.Hashes, error) {
+	h, err := r.projectStore.Hashes(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	if h.Current() {
+		return h, nil
+	}
+	//rendering stores the configs and records their hashes on the project
+	rendered, err := r.Render(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	h.Hash = rendered.Hash
+	h.HashV2 = rendered.HashV2
+	h.Version = rendered.Project.Version
+	h.RenderedVersion = rendered.Project.Version
+	return h, nil
+}
+
+// ConfigSize returns the size of the largest config that is rendered for flags, in the project render mode or the v2 format.
+// Secrets are removed or re-encrypted like Render does, so the size is of what is provisioned and not of the stored ciphertext.
+func (r *Renderer) ConfigSize(p *project.Project, flags []*flag.Flag) (int, error) {
+	flags, err := r.renderSecrets(p, flags)
+	if err != nil {
+		return 0, err
+	}
+	config, err := renderConfig(p, flags)
+	if err != nil {
+		return 0, err
+	}
+	v2, err := flag.RenderConfigV2(p.ID, flags)
+	if err != nil {
+		return 0, err
+	}
+	if len(v2) > len(config) {
+		return len(v2), nil
+	}
+	return len(config), nil
+}
+
+func renderConfig(p *project.Project, flags []*flag.Flag) ([]byte, error) {
+	switch p.RenderMode {
+	case project.NESTED:
+		return flag.RenderNestedConfig(flags)
+	default:
+		return flag.RenderConfig(flags)
+	}
+}
+
+// renderSecrets removes SECRET flags unless the project has opted in to an encrypted payload,
+// in which case their values are re-encrypted with the project payload key
+func (r *Renderer) renderSecrets(p *project.Project, flags []*flag.Flag) ([]*flag.Flag, error) {
+	var payloadKey []byte
+	if p.PayloadKey != "" && r.secrets != nil {
+		key, err := r.secrets.Decrypt(p.PayloadKey)
+		if err != nil {
+			return nil, err
+		}
+		payloadKey = key
+	}
+	rendered := make([]*flag.Flag, 0, len(flags))
+	for _, f := range flags {
+		if f.Type != flag.SECRET {
+			rendered = append(rendered, f)
+			continue
+		}
+		if payloadKey == nil {
+			continue
+		}
+		plaintext, err := r.secrets.Decrypt(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		value, err := secret.EncryptPayload(payloadKey, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := *f
+		encrypted.Value = value
+		rendered = append(rendered, &encrypted)
+	}
+	return rendered, nil
+}
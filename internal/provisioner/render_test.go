@@ -0,0 +1,93 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRenderer_Secrets(t *testing.T) {
+	kek, err := secret.GenerateKey()
+	assert.Nil(t, err)
+	secrets, err := secret.NewCipher(base64.StdEncoding.EncodeToString(kek))
+	assert.Nil(t, err)
+	payloadKey, err := secret.GenerateKey()
+	assert.Nil(t, err)
+	encryptedPayloadKey, err := secrets.Encrypt(payloadKey)
+	assert.Nil(t, err)
+	encryptedValue, err := secrets.Encrypt([]byte("abc123"))
+	assert.Nil(t, err)
+
+	flags := []*flag.Flag{
+		{Key: "api_key", Type: flag.SECRET, Value: encryptedValue},
+		{Key: "feature1", Type: flag.STRING, Value: "test"},
+	}
+	doc, err := json.Marshal(map[string]*flag.Flag{"api_key": flags[0], "feature1": flags[1]})
+	assert.Nil(t, err)
+
+	//secrets are left out of the config without a payload key
+	renderer := NewRenderer(project.NewMockStore(), flag.NewMockStore(), secrets)
+	p := &project.Project{ID: "1", AccountID: "2"}
+	configs, err := renderer.RenderDoc(p, doc)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("{\"feature1\":{\"value\":\"test\",\"type\":\"STRING\"}}\n"), configs.Config)
+	//the size of the config doesn't include the ciphertext of removed secrets
+	size, err := renderer.ConfigSize(p, flags)
+	assert.Nil(t, err)
+	withoutSecrets, err := renderer.ConfigSize(p, flags[1:])
+	assert.Nil(t, err)
+	assert.Equal(t, withoutSecrets, size)
+
+	//secrets are encrypted with the payload key
+	configs, err = renderer.RenderDoc(&project.Project{ID: "1", AccountID: "2", PayloadKey: encryptedPayloadKey}, doc)
+	assert.Nil(t, err)
+	config := make(map[string]flag.JsonFlag)
+	err = json.Unmarshal(configs.Config, &config)
+	assert.Nil(t, err)
+	assert.Equal(t, flag.SECRET, config["api_key"].Type)
+	value, err := secret.DecryptPayload(payloadKey, config["api_key"].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc123"), value)
+	//stored flags aren't modified
+	assert.Equal(t, encryptedValue, flags[0].Value)
+}
+
+func TestRenderer_Render(t *testing.T) {
+	p := &project.Project{ID: "1", AccountID: "2", Version: 3}
+	stored := &project.Configs{Version: 3, Config: []byte("v1"), ConfigV2: []byte("v2"), Hash: "h1", HashV2: "h2"}
+	projectStore := project.NewMockStore()
+	flagStore := flag.NewMockStore()
+	renderer := NewRenderer(projectStore, flagStore, nil)
+
+	//current configs are read from one row and returned as stored
+	projectStore.On("Configs", mock.Anything, "1").Return(p, stored, nil).Once()
+	rendered, err := renderer.Render(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), rendered.Config)
+	assert.Equal(t, []byte("v2"), rendered.ConfigV2)
+	assert.Equal(t, "h1", rendered.Hash)
+	assert.Equal(t, "h2", rendered.HashV2)
+	flagStore.AssertNotCalled(t, "Snapshot", mock.Anything, mock.Anything)
+
+	//configs of an older version are rendered from a snapshot and stored
+	projectStore.On("Configs", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2", Version: 4}, stored, nil).Once()
+	flagStore.On("Snapshot", mock.Anything, "1").Return(&flag.Snapshot{Version: 4, Flags: []*flag.Flag{{Key: "feature1", Type: flag.STRING, Value: "test"}}}, nil).Once()
+	projectStore.On("Get", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2", Version: 4}, nil).Once()
+	config := []byte("{\"feature1\":{\"value\":\"test\",\"type\":\"STRING\"}}\n")
+	projectStore.On("SetConfigs", mock.Anything, "1", mock.MatchedBy(func(c *project.Configs) bool {
+		return c.Version == 4 && string(c.Config) == string(config) && c.Hash == flag.ContentHash(config)
+	})).Return(nil).Once()
+	rendered, err = renderer.Render(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, config, rendered.Config)
+	assert.Equal(t, int64(4), rendered.Project.Version)
+	projectStore.AssertExpectations(t)
+	flagStore.AssertExpectations(t)
+}
@@ -0,0 +1,157 @@
+package provisioner
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/resync"
+	"github.com/broswen/vex/internal/token"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Progress counts what a resync has done
+type Progress struct {
+	Accounts int64
+	// Skipped accounts were finished by an earlier run of the resync
+	Skipped  int64
+	Projects int64
+	Tokens   int64
+	Failed   int64
+}
+
+// Resyncer provisions every project and token again, an account is saved to the checkpoint store once
+// all of its projects and tokens are provisioned so an interrupted resync can resume
+type Resyncer struct {
+	provisioner Provisioner
+	accounts    account.Store
+	projects    project.Store
+	tokens      token.Store
+	checkpoints resync.Store
+	// concurrency is the number of projects and tokens provisioned at a time
+	concurrency int
+	// report is how often progress is logged
+	report time.Duration
+}
+
+func NewResyncer(p Provisioner, accounts account.Store, projects project.Store, tokens token.Store, checkpoints resync.Store, concurrency int) *Resyncer {
+	return &Resyncer{
+		provisioner: p,
+		accounts:    accounts,
+		projects:    projects,
+		tokens:      tokens,
+		checkpoints: checkpoints,
+		concurrency: concurrency,
+		report:      time.Second * 10,
+	}
+}
+
+// Resync provisions every project and token of the accounts that the named resync hasn't finished.
+// Accounts with failures aren't saved, running the resync again with the same name retries them.
+func (r *Resyncer) Resync(ctx context.Context, name string) (*Progress, error) {
+	done, err := r.checkpoints.Done(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	progress := &Progress{}
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.reportProgress(name, progress, stop)
+
+	sem := make(chan struct{}, r.concurrency)
+	wg := sync.WaitGroup{}
+	provision := func(accountWg *sync.WaitGroup, failed *int64, fn func() error) {
+		sem <- struct{}{}
+		accountWg.Add(1)
+		go func() {
+			defer func() { <-sem }()
+			defer accountWg.Done()
+			if err := fn(); err != nil {
+				atomic.AddInt64(failed, 1)
+				atomic.AddInt64(&progress.Failed, 1)
+			}
+		}()
+	}
+
+	err = walkAccounts(ctx, r.accounts, func(a *account.Account) error {
+		if done[a.ID] {
+			atomic.AddInt64(&progress.Skipped, 1)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		accountWg := &sync.WaitGroup{}
+		var failed int64
+		err := walkProjects(ctx, r.projects, a.ID, func(p *project.Project) error {
+			provision(accountWg, &failed, func() error {
+				err := r.provisioner.ProvisionProject(ctx, p)
+				if err != nil {
+					log.Error().Err(err).Str("id", p.ID).Msg("could not resync project")
+					return err
+				}
+				atomic.AddInt64(&progress.Projects, 1)
+				return nil
+			})
+			return nil
+		})
+		if err == nil {
+			err = walkTokens(ctx, r.tokens, a.ID, func(t *token.Token) error {
+				provision(accountWg, &failed, func() error {
+					err := r.provisioner.ProvisionToken(ctx, t)
+					if err != nil {
+						log.Error().Err(err).Str("id", t.ID).Msg("could not resync token")
+						return err
+					}
+					atomic.AddInt64(&progress.Tokens, 1)
+					return nil
+				})
+				return nil
+			})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accountWg.Wait()
+			if err != nil || atomic.LoadInt64(&failed) > 0 {
+				return
+			}
+			if err := r.checkpoints.Save(ctx, name, a.ID); err != nil {
+				log.Error().Err(err).Str("id", a.ID).Msg("could not save resync checkpoint")
+				return
+			}
+			atomic.AddInt64(&progress.Accounts, 1)
+		}()
+		return err
+	})
+	wg.Wait()
+	r.logProgress(name, progress).Msg("resync finished")
+	return progress, err
+}
+
+func (r *Resyncer) reportProgress(name string, progress *Progress, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.logProgress(name, progress).Msg("resyncing")
+		}
+	}
+}
+
+func (r *Resyncer) logProgress(name string, progress *Progress) *zerolog.Event {
+	return log.Info().
+		Str("resync", name).
+		Int64("accounts", atomic.LoadInt64(&progress.Accounts)).
+		Int64("skipped", atomic.LoadInt64(&progress.Skipped)).
+		Int64("projects", atomic.LoadInt64(&progress.Projects)).
+		Int64("tokens", atomic.LoadInt64(&progress.Tokens)).
+		Int64("failed", atomic.LoadInt64(&progress.Failed))
+}
@@ -0,0 +1,48 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/resync"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestResyncer_Resync(t *testing.T) {
+	accountStore := account.NewMockStore()
+	accountStore.On("ListAfter", mock.Anything, time.Time{}, walkStart, int64(walkPageSize)).Return([]*account.Account{{ID: "a1"}, {ID: "a2"}, {ID: "a3"}}, nil)
+
+	p2 := &project.Project{ID: "p2", AccountID: "a2"}
+	p3 := &project.Project{ID: "p3", AccountID: "a3"}
+	projectStore := project.NewMockStore()
+	projectStore.On("ListAfter", mock.Anything, "a2", time.Time{}, walkStart, int64(walkPageSize)).Return([]*project.Project{p2}, nil)
+	projectStore.On("ListAfter", mock.Anything, "a3", time.Time{}, walkStart, int64(walkPageSize)).Return([]*project.Project{p3}, nil)
+
+	t2 := &token.Token{ID: "t2", AccountID: "a2"}
+	tokenStore := token.NewMockStore()
+	tokenStore.On("ListAfter", mock.Anything, "a2", time.Time{}, walkStart, int64(walkPageSize)).Return([]*token.Token{t2}, nil)
+	tokenStore.On("ListAfter", mock.Anything, "a3", time.Time{}, walkStart, int64(walkPageSize)).Return([]*token.Token{}, nil)
+
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, p2).Return(nil)
+	target.On("ProvisionToken", mock.Anything, t2).Return(nil)
+	target.On("ProvisionProject", mock.Anything, p3).Return(errors.New("kv unavailable"))
+
+	// a1 was finished by an earlier run, a3 failed so it isn't saved
+	checkpoints := resync.NewMockStore()
+	checkpoints.On("Done", mock.Anything, "migration").Return(map[string]bool{"a1": true}, nil)
+	checkpoints.On("Save", mock.Anything, "migration", "a2").Return(nil).Once()
+
+	resyncer := NewResyncer(target, accountStore, projectStore, tokenStore, checkpoints, 2)
+	progress, err := resyncer.Resync(context.Background(), "migration")
+	assert.Nil(t, err)
+	assert.Equal(t, &Progress{Accounts: 1, Skipped: 1, Projects: 1, Tokens: 1, Failed: 1}, progress)
+	target.AssertExpectations(t)
+	checkpoints.AssertExpectations(t)
+}
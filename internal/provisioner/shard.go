@@ -0,0 +1,114 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MaxValueSize is the largest value that can be stored under a single Workers KV key
+const MaxValueSize = 25 * 1024 * 1024
+
+// MaxShards is the number of shards a config can be split into with the default MaxConfigSize
+const MaxShards = 8
+
+// MaxConfigSize is the default limit of a rendered config, a single KV value without sharding or MaxShards shards with it
+func MaxConfigSize(size int) int {
+	if size <= 0 {
+		return MaxValueSize
+	}
+	return MaxShards * shardSize(size)
+}
+
+// ShardKey is the key of the nth shard of a rendered config. Shards are keyed by the content hash of the config
+// so provisioning a new config never overwrites the shards of the config that is being served.
+func ShardKey(key, hash string, n int) string {
+	return fmt.Sprintf("%s%s/%d", shardPrefix(key), hash, n)
+}
+
+// IsShardKey reports whether a key in the project namespace is a shard instead of a rendered config or manifest
+func IsShardKey(key string) bool {
+	return strings.HasPrefix(key, "shards/")
+}
+
+// shardPrefix is the prefix of every shard of the config stored under key,
+// shards aren't nested under the key itself so the filesystem layout can store both
+func shardPrefix(key string) string {
+	return "shards/" + key + "/"
+}
+
+// Manifest is stored under the key of a rendered config that is split into shards, with Metadata.Shards set.
+// The config is the values of Shards concatenated in order, and its content hash is Hash.
+type Manifest struct {
+	Hash   string   `json:"hash"`
+	Size   int      `json:"size"`
+	Shards []string `json:"shards"`
+}
+
+// ErrConfigTooLarge is returned when a rendered config doesn't fit in a single KV value and sharding is disabled
+type ErrConfigTooLarge struct {
+	Key  string
+	Size int
+}
+
+func (e ErrConfigTooLarge) Error() string {
+	return fmt.Sprintf("rendered config %s is %d bytes, larger than the %d byte KV value limit", e.Key, e.Size, MaxValueSize)
+}
+
+// pair is a value to write under a key, Metadata is nil for shards
+type pair struct {
+	Key      string
+	Value    []byte
+	Metadata *Metadata
+}
+
+// layout returns the pairs to write for a rendered config. Configs larger than shardSize are split into shards
+// which come before the manifest that replaces the config under key. Sharding is disabled if shardSize is 0.
+func layout(key string, config []byte, m Metadata, shardSize int) ([]pair, error) {
+	if shardSize <= 0 || len(config) <= shardSize {
+		if len(config) > MaxValueSize {
+			return nil, ErrConfigTooLarge{Key: key, Size: len(config)}
+		}
+		return []pair{{Key: key, Value: config, Metadata: &m}}, nil
+	}
+	manifest := Manifest{Hash: m.Hash, Size: len(config), Shards: make([]string, 0)}
+	pairs := make([]pair, 0)
+	for start := 0; start < len(config); start += shardSize {
+		end := start + shardSize
+		if end > len(config) {
+			end = len(config)
+		}
+		shardKey := ShardKey(key, m.Hash, len(manifest.Shards))
+		manifest.Shards = append(manifest.Shards, shardKey)
+		pairs = append(pairs, pair{Key: shardKey, Value: config[start:end]})
+	}
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	m.Shards = len(manifest.Shards)
+	return append(pairs, pair{Key: key, Value: value, Metadata: &m}), nil
+}
+
+// staleShards returns the shards that aren't part of the pairs that were just written
+func staleShards(shards []string, written []pair) []string {
+	keys := make(map[string]bool, len(written))
+	for _, p := range written {
+		keys[p.Key] = true
+	}
+	stale := make([]string, 0)
+	for _, s := range shards {
+		if !keys[s] {
+			stale = append(stale, s)
+		}
+	}
+	return stale
+}
+
+// shardSize caps a configured shard size to MaxValueSize
+func shardSize(size int) int {
+	if size > MaxValueSize {
+		return MaxValueSize
+	}
+	return size
+}
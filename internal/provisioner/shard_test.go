@@ -0,0 +1,111 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/broswen/vex/internal/flag"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLayout(t *testing.T) {
+	config := []byte("0123456789")
+	m := Metadata{AccountID: "2", Hash: flag.ContentHash(config)}
+
+	//configs that fit in a shard are stored as is
+	pairs, err := layout("1", config, m, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []pair{{Key: "1", Value: config, Metadata: &m}}, pairs)
+	pairs, err = layout("1", config, m, 10)
+	assert.Nil(t, err)
+	assert.Len(t, pairs, 1)
+
+	pairs, err = layout("1", config, m, 4)
+	assert.Nil(t, err)
+	assert.Len(t, pairs, 4)
+	joined := make([]byte, 0)
+	for i, p := range pairs[:3] {
+		assert.Equal(t, ShardKey("1", m.Hash, i), p.Key)
+		assert.True(t, IsShardKey(p.Key))
+		assert.Nil(t, p.Metadata)
+		joined = append(joined, p.Value...)
+	}
+	assert.Equal(t, config, joined)
+	//the manifest is written last
+	manifest := Manifest{}
+	assert.Nil(t, json.Unmarshal(pairs[3].Value, &manifest))
+	assert.Equal(t, "1", pairs[3].Key)
+	assert.Equal(t, 3, pairs[3].Metadata.Shards)
+	assert.Equal(t, m.Hash, manifest.Hash)
+	assert.Equal(t, 10, manifest.Size)
+	assert.Equal(t, []string{pairs[0].Key, pairs[1].Key, pairs[2].Key}, manifest.Shards)
+
+	assert.Equal(t, []string{"a"}, staleShards([]string{"a", pairs[0].Key}, pairs))
+}
+
+func TestLayout_TooLarge(t *testing.T) {
+	config := bytes.Repeat([]byte("a"), MaxValueSize+1)
+	_, err := layout("1", config, Metadata{}, 0)
+	assert.ErrorAs(t, err, &ErrConfigTooLarge{})
+
+	pairs, err := layout("1", config, Metadata{}, MaxValueSize)
+	assert.Nil(t, err)
+	assert.Len(t, pairs, 3)
+}
+
+func TestMaxConfigSize(t *testing.T) {
+	assert.Equal(t, MaxValueSize, MaxConfigSize(0))
+	assert.Equal(t, MaxShards*1024, MaxConfigSize(1024))
+	assert.Equal(t, MaxShards*MaxValueSize, MaxConfigSize(MaxValueSize*2))
+}
+
+func TestFilesystemProvisioner_Sharded(t *testing.T) {
+	dir := t.TempDir()
+	projectStore := project.NewMockStore()
+	projectStore.On("Configs", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, &project.Configs{}, nil)
+	projectStore.On("Get", mock.Anything, "1").Return(&project.Project{ID: "1", AccountID: "2"}, nil)
+	projectStore.On("SetConfigs", mock.Anything, "1", mock.Anything).Return(nil)
+	flagStore := flag.NewMockStore()
+	flagStore.On("Snapshot", mock.Anything, "1").Return(&flag.Snapshot{Flags: []*flag.Flag{
+		{Key: "feature1", Type: flag.STRING, Value: "test"},
+	}}, nil).Once()
+	flagStore.On("Snapshot", mock.Anything, "1").Return(&flag.Snapshot{Flags: []*flag.Flag{
+		{Key: "feature1", Type: flag.STRING, Value: "changed"},
+	}}, nil).Once()
+
+	p, err := NewFilesystemProvisioner(dir, NewRenderer(projectStore, flagStore, nil), token.NewMockStore(), nil)
+	assert.Nil(t, err)
+	p.Shard(16)
+
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: "1"}))
+	first, err := p.shards(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, first)
+	for _, shard := range first {
+		_, err = os.Stat(filepath.Join(dir, "projects", filepath.FromSlash(shard)))
+		assert.Nil(t, err, shard)
+	}
+
+	//the shards of the previous config are deleted
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: "1"}))
+	second, err := p.shards(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	for _, shard := range first {
+		_, err = os.Stat(filepath.Join(dir, "projects", filepath.FromSlash(shard)))
+		assert.True(t, os.IsNotExist(err), shard)
+	}
+
+	assert.Nil(t, p.DeprovisionProject(context.Background(), &project.Project{ID: "1"}))
+	for _, shard := range second {
+		_, err = os.Stat(filepath.Join(dir, "projects", filepath.FromSlash(shard)))
+		assert.True(t, os.IsNotExist(err), shard)
+	}
+}
@@ -0,0 +1,36 @@
+package provisioner
+
+import (
+	"context"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/rs/zerolog/log"
+)
+
+// StatusProvisioner records the project version in postgres after it is provisioned,
+// the version is read before provisioning so the recorded version is never newer than what was written
+type StatusProvisioner struct {
+	Provisioner
+	projects project.Store
+}
+
+func NewStatusProvisioner(next Provisioner, projects project.Store) *StatusProvisioner {
+	return &StatusProvisioner{
+		Provisioner: next,
+		projects:    projects,
+	}
+}
+
+func (p *StatusProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	current, err := p.projects.Get(ctx, pr.ID)
+	if err != nil {
+		return p.Provisioner.ProvisionProject(ctx, pr)
+	}
+	if err = p.Provisioner.ProvisionProject(ctx, pr); err != nil {
+		return err
+	}
+	if err = p.projects.SetProvisionedVersion(ctx, current.ID, current.Version); err != nil {
+		log.Error().Err(err).Str("id", current.ID).Int64("version", current.Version).Msg("could not record provisioned version")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestStatusProvisioner_ProvisionProject(t *testing.T) {
+	projectStore := project.NewMockStore()
+	projectStore.On("Get", mock.Anything, "p1").Return(&project.Project{ID: "p1", Version: 7}, nil)
+	projectStore.On("SetProvisionedVersion", mock.Anything, "p1", int64(7)).Return(nil).Once()
+	target := NewMockProvisioner()
+	target.On("ProvisionProject", mock.Anything, &project.Project{ID: "p1"}).Return(nil).Once()
+	target.On("ProvisionProject", mock.Anything, &project.Project{ID: "p1"}).Return(errors.New("kv unavailable")).Once()
+
+	p := NewStatusProvisioner(target, projectStore)
+	assert.Nil(t, p.ProvisionProject(context.Background(), &project.Project{ID: "p1"}))
+	// failed provisioning isn't recorded
+	assert.Error(t, p.ProvisionProject(context.Background(), &project.Project{ID: "p1"}))
+	projectStore.AssertExpectations(t)
+	target.AssertExpectations(t)
+}
@@ -0,0 +1,57 @@
+package provisioner
+
+import (
+	"context"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/stream"
+	"github.com/rs/zerolog/log"
+)
+
+// StreamProvisioner records a config event for every provisioned project so it can be streamed to clients
+type StreamProvisioner struct {
+	Provisioner
+	renderer *Renderer
+	events   stream.Store
+}
+
+func NewStreamProvisioner(next Provisioner, renderer *Renderer, events stream.Store) *StreamProvisioner {
+	return &StreamProvisioner{
+		Provisioner: next,
+		renderer:    renderer,
+		events:      events,
+	}
+}
+
+func (p *StreamProvisioner) ProvisionProject(ctx context.Context, pr *project.Project) error {
+	err := p.Provisioner.ProvisionProject(ctx, pr)
+	rendered, rerr := p.renderer.Render(ctx, pr.ID)
+	if rerr != nil {
+		log.Error().Err(rerr).Str("id", pr.ID).Msg("could not render config event")
+		return err
+	}
+	_, rerr = p.events.Insert(ctx, &stream.Event{
+		ProjectID: rendered.Project.ID,
+		AccountID: rendered.Project.AccountID,
+		Type:      stream.CONFIG,
+		Config:    rendered.Config,
+		Version:   rendered.Project.Version,
+	})
+	if rerr != nil {
+		log.Error().Err(rerr).Str("id", pr.ID).Msg("could not insert config event")
+	}
+	return err
+}
+
+func (p *StreamProvisioner) DeprovisionProject(ctx context.Context, pr *project.Project) error {
+	err := p.Provisioner.DeprovisionProject(ctx, pr)
+	_, rerr := p.events.Insert(ctx, &stream.Event{
+		ProjectID: pr.ID,
+		AccountID: pr.AccountID,
+		Type:      stream.DELETE,
+	})
+	if rerr != nil {
+		log.Error().Err(rerr).Str("id", pr.ID).Msg("could not insert config event")
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/broswen/vex/internal/signing"
+	"github.com/broswen/vex/internal/token"
+)
+
+// TargetConfig configures the provisioner targets
+type TargetConfig struct {
+	CloudflareToken      string
+	CloudflareAccountID  string
+	ProjectKVNamespaceID string
+	TokenKVNamespaceID   string
+	// Dir is the directory the filesystem target writes to
+	Dir string
+	// RedisURL is the redis the redis target writes to
+	RedisURL string
+	// ShardSize splits larger configs into shards for the cloudflare and filesystem targets, sharding is disabled if it is 0
+	ShardSize int
+	// BatchWindow gathers cloudflare writes into bulk requests, batching is disabled if it is 0
+	BatchWindow time.Duration
+	// RateLimit is the number of requests per second to the cloudflare API, DefaultRateLimit is used if it is 0
+	RateLimit float64
+}
+
+// NewTarget creates the cloudflare, filesystem or redis provisioner
+func NewTarget(target string, c TargetConfig, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) (Provisioner, error) {
+	switch target {
+	case "cloudflare":
+		p, err := NewCloudflareProvisioner(c.CloudflareToken, c.CloudflareAccountID, c.ProjectKVNamespaceID, c.TokenKVNamespaceID, renderer, tokenStore, signer)
+		if err != nil {
+			return nil, err
+		}
+		p.Shard(c.ShardSize)
+		p.Batch(c.BatchWindow)
+		p.RateLimit(c.RateLimit)
+		return p, nil
+	case "filesystem":
+		p, err := NewFilesystemProvisioner(c.Dir, renderer, tokenStore, signer)
+		if err != nil {
+			return nil, err
+		}
+		p.Shard(c.ShardSize)
+		return p, nil
+	case "redis":
+		return NewRedisProvisioner(c.RedisURL, renderer, tokenStore, signer)
+	}
+	return nil, fmt.Errorf("unknown provisioner: %s", target)
+}
+
+// RouteConfig configures a named target and the accounts that are routed to it
+type RouteConfig struct {
+	Name   string
+	Target string
+	Config TargetConfig
+	// Accounts are the routed account ids, every account is routed to the target if it is empty
+	Accounts []string
+}
+
+// RoutesFromEnv reads the route for each target name from TARGET_{NAME}_* variables, like TARGET_EU_PROVISIONER=cloudflare
+// and TARGET_EU_ACCOUNTS=id1,id2. Target settings that aren't set fall back to defaults.
+func RoutesFromEnv(names []string, defaults TargetConfig, getenv func(string) string) ([]RouteConfig, error) {
+	routes := make([]RouteConfig, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate target: %s", name)
+		}
+		seen[name] = true
+		prefix := "TARGET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		env := func(key, fallback string) string {
+			if value := getenv(prefix + key); value != "" {
+				return value
+			}
+			return fallback
+		}
+		route := RouteConfig{
+			Name:   name,
+			Target: env("PROVISIONER", ""),
+			Config: TargetConfig{
+				CloudflareToken:      env("CLOUDFLARE_API_TOKEN", defaults.CloudflareToken),
+				CloudflareAccountID:  env("CLOUDFLARE_ACCOUNT_ID", defaults.CloudflareAccountID),
+				ProjectKVNamespaceID: env("PROJECT_KV_NAMESPACE_ID", defaults.ProjectKVNamespaceID),
+				TokenKVNamespaceID:   env("TOKEN_KV_NAMESPACE_ID", defaults.TokenKVNamespaceID),
+				Dir:                  env("PROVISION_DIR", defaults.Dir),
+				RedisURL:             env("REDIS_URL", defaults.RedisURL),
+				ShardSize:            defaults.ShardSize,
+				BatchWindow:          defaults.BatchWindow,
+				RateLimit:            defaults.RateLimit,
+			},
+			Accounts: make([]string, 0),
+		}
+		if route.Target == "" {
+			return nil, fmt.Errorf("%sPROVISIONER must be set", prefix)
+		}
+		if size := getenv(prefix + "SHARD_SIZE"); size != "" {
+			n, err := strconv.Atoi(size)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %sSHARD_SIZE: %s", prefix, size)
+			}
+			route.Config.ShardSize = n
+		}
+		for _, account := range strings.Split(getenv(prefix+"ACCOUNTS"), ",") {
+			if account = strings.TrimSpace(account); account != "" {
+				route.Accounts = append(route.Accounts, account)
+			}
+		}
+		routes = append(routes, route)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	return routes, nil
+}
+
+// NewRoutedTargets creates a CompositeProvisioner with the target of each route
+func NewRoutedTargets(routes []RouteConfig, renderer *Renderer, tokenStore token.Store, signer *signing.Signer) (*CompositeProvisioner, error) {
+	targets := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		target, err := NewTarget(r.Target, r.Config, renderer, tokenStore, signer)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", r.Name, err)
+		}
+		accounts := make(map[string]bool, len(r.Accounts))
+		for _, account := range r.Accounts {
+			accounts[account] = true
+		}
+		targets = append(targets, Route{Name: r.Name, Target: target, Accounts: accounts})
+	}
+	composite := NewCompositeProvisioner(targets...)
+	composite.Resolve(renderer.projectStore, tokenStore)
+	return composite, nil
+}
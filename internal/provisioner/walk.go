@@ -0,0 +1,80 @@
+package provisioner
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/account"
+	"github.com/broswen/vex/internal/project"
+	"github.com/broswen/vex/internal/token"
+)
+
+// walkPageSize is the number of rows read from a store at a time
+const walkPageSize = 100
+
+// walkStart is the cursor id that sorts before every row. Rows are paged by
+// (created_on, id) so a row deleted mid walk can't shift a live row off a page.
+const walkStart = "00000000-0000-0000-0000-000000000000"
+
+// walkAccounts calls fn for every account
+func walkAccounts(ctx context.Context, accounts account.Store, fn func(a *account.Account) error) error {
+	createdOn, id := time.Time{}, walkStart
+	for {
+		page, err := accounts.ListAfter(ctx, createdOn, id, walkPageSize)
+		if err != nil {
+			return err
+		}
+		for _, a := range page {
+			if err = fn(a); err != nil {
+				return err
+			}
+		}
+		if len(page) < walkPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		createdOn, id = last.CreatedOn, last.ID
+	}
+}
+
+// walkProjects calls fn for every project of an account
+func walkProjects(ctx context.Context, projects project.Store, accountId string, fn func(p *project.Project) error) error {
+	createdOn, id := time.Time{}, walkStart
+	for {
+		page, err := projects.ListAfter(ctx, accountId, createdOn, id, walkPageSize)
+		if err != nil {
+			return err
+		}
+		for _, p := range page {
+			if err = fn(p); err != nil {
+				return err
+			}
+		}
+		if len(page) < walkPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		createdOn, id = last.CreatedOn, last.ID
+	}
+}
+
+// walkTokens calls fn for every token of an account
+func walkTokens(ctx context.Context, tokens token.Store, accountId string, fn func(t *token.Token) error) error {
+	createdOn, id := time.Time{}, walkStart
+	for {
+		page, err := tokens.ListAfter(ctx, accountId, createdOn, id, walkPageSize)
+		if err != nil {
+			return err
+		}
+		for _, t := range page {
+			if err = fn(t); err != nil {
+				return err
+			}
+		}
+		if len(page) < walkPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		createdOn, id = last.CreatedOn, last.ID
+	}
+}
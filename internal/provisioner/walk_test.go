@@ -0,0 +1,36 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/project"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWalkProjects_Keyset(t *testing.T) {
+	now := time.Now()
+	first := make([]*project.Project, 0, walkPageSize)
+	for i := 0; i < walkPageSize; i++ {
+		first = append(first, &project.Project{ID: fmt.Sprintf("p%d", i), AccountID: "a1", CreatedOn: now})
+	}
+	last := first[len(first)-1]
+	second := []*project.Project{{ID: "p100", AccountID: "a1", CreatedOn: now}}
+
+	projectStore := project.NewMockStore()
+	projectStore.On("ListAfter", mock.Anything, "a1", time.Time{}, walkStart, int64(walkPageSize)).Return(first, nil)
+	// the second page starts after the last row seen, not at an offset
+	projectStore.On("ListAfter", mock.Anything, "a1", last.CreatedOn, last.ID, int64(walkPageSize)).Return(second, nil)
+
+	walked := 0
+	err := walkProjects(context.Background(), projectStore, "a1", func(p *project.Project) error {
+		walked++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, walkPageSize+1, walked)
+	projectStore.AssertExpectations(t)
+}
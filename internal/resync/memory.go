@@ -0,0 +1,38 @@
+package resync
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps the finished accounts in memory, for resyncs that don't resume after a restart
+type MemoryStore struct {
+	mu   sync.Mutex
+	done map[string]map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		done: make(map[string]map[string]bool),
+	}
+}
+
+func (store *MemoryStore) Done(ctx context.Context, resync string) (map[string]bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	done := make(map[string]bool, len(store.done[resync]))
+	for id := range store.done[resync] {
+		done[id] = true
+	}
+	return done, nil
+}
+
+func (store *MemoryStore) Save(ctx context.Context, resync, accountId string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.done[resync] == nil {
+		store.done[resync] = make(map[string]bool)
+	}
+	store.done[resync][accountId] = true
+	return nil
+}
@@ -0,0 +1,25 @@
+package resync
+
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) Done(ctx context.Context, resync string) (map[string]bool, error) {
+	args := m.Called(ctx, resync)
+	return args.Get(0).(map[string]bool), args.Error(1)
+}
+
+func (m *MockStore) Save(ctx context.Context, resync, accountId string) error {
+	args := m.Called(ctx, resync, accountId)
+	return args.Error(0)
+}
@@ -0,0 +1,46 @@
+package resync
+
+import (
+	"context"
+
+	"github.com/broswen/vex/internal/db"
+)
+
+// Store keeps the accounts that each resync has finished
+type Store interface {
+	Done(ctx context.Context, resync string) (map[string]bool, error)
+	Save(ctx context.Context, resync, accountId string) error
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+// Done returns the ids of the accounts that the resync has finished
+func (store *PostgresStore) Done(ctx context.Context, resync string) (map[string]bool, error) {
+	rows, err := store.db.Query(ctx, `SELECT account_id FROM resync_account WHERE resync = $1;`, resync)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		done[id] = true
+	}
+	return done, db.PgError(rows.Err())
+}
+
+// Save records that the resync finished an account
+func (store *PostgresStore) Save(ctx context.Context, resync, accountId string) error {
+	_, err := store.db.Exec(ctx, `INSERT INTO resync_account (resync, account_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;`, resync, accountId)
+	return db.PgError(err)
+}
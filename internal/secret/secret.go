@@ -0,0 +1,162 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	KeySize = 32
+	// envelopePrefix versions the format of encrypted values
+	envelopePrefix = "v1"
+)
+
+var (
+	ErrInvalidKey        = errors.New("invalid secret key")
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+)
+
+// Cipher encrypts values at rest with envelope encryption.
+// Every value is encrypted with a new data key, and the data key is encrypted with the key encryption key.
+type Cipher struct {
+	kek cipher.AEAD
+}
+
+// NewCipher creates a Cipher from a base64 encoded 32 byte key encryption key
+func NewCipher(encodedKey string) (*Cipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{kek: kek}, nil
+}
+
+// GenerateKey returns a new random 32 byte key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	dek, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(c.kek, dek)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dekAEAD, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		envelopePrefix,
+		base64.StdEncoding.EncodeToString(wrappedKey),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+// IsEncrypted reports whether a value was encrypted by a Cipher
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, envelopePrefix+":")
+}
+
+func (c *Cipher) Decrypt(value string) ([]byte, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[0] != envelopePrefix {
+		return nil, ErrInvalidCiphertext
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	dek, err := open(c.kek, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return open(dekAEAD, ciphertext)
+}
+
+// EncryptPayload encrypts a value that is included in a rendered config with a project payload key.
+// The nonce is derived from the key and plaintext so the same value always renders the same ciphertext,
+// this keeps rendered configs stable between renders.
+func EncryptPayload(key, plaintext []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func DecryptPayload(key []byte, value string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return open(aead, ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce and prepends the nonce to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
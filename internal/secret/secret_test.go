@@ -0,0 +1,58 @@
+package secret
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCipher(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	c, err := NewCipher(base64.StdEncoding.EncodeToString(key))
+	assert.Nil(t, err)
+
+	encrypted, err := c.Encrypt([]byte("api key"))
+	assert.Nil(t, err)
+	assert.NotContains(t, encrypted, "api key")
+
+	//every value uses a new data key
+	encrypted2, err := c.Encrypt([]byte("api key"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, encrypted, encrypted2)
+
+	decrypted, err := c.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("api key"), decrypted)
+
+	_, err = c.Decrypt("api key")
+	assert.ErrorIs(t, err, ErrInvalidCiphertext)
+
+	otherKey, err := GenerateKey()
+	assert.Nil(t, err)
+	other, err := NewCipher(base64.StdEncoding.EncodeToString(otherKey))
+	assert.Nil(t, err)
+	_, err = other.Decrypt(encrypted)
+	assert.ErrorIs(t, err, ErrInvalidCiphertext)
+}
+
+func TestNewCipher_InvalidKey(t *testing.T) {
+	_, err := NewCipher(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestEncryptPayload(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	encrypted, err := EncryptPayload(key, []byte("api key"))
+	assert.Nil(t, err)
+
+	//payloads are deterministic so rendered configs are stable
+	encrypted2, err := EncryptPayload(key, []byte("api key"))
+	assert.Nil(t, err)
+	assert.Equal(t, encrypted, encrypted2)
+
+	decrypted, err := DecryptPayload(key, encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("api key"), decrypted)
+}
@@ -0,0 +1,24 @@
+package signing
+
+import (
+	"context"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) Save(ctx context.Context, k *Key) error {
+	args := m.Called(ctx, k)
+	return args.Error(0)
+}
+
+func (m *MockStore) List(ctx context.Context, limit int64) ([]*Key, error) {
+	args := m.Called(ctx, limit)
+	return args.Get(0).([]*Key), args.Error(1)
+}
@@ -0,0 +1,100 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid signing key")
+	ErrKeyIDInUse = errors.New("signing key id is already used by a different key")
+)
+
+// Key is a public key that rendered configs can be verified with
+type Key struct {
+	ID         string            `json:"id"`
+	PublicKey  ed25519.PublicKey `json:"public_key" db:"public_key"`
+	CreatedOn  time.Time         `json:"created_on" db:"created_on"`
+	ModifiedOn time.Time         `json:"modified_on" db:"modified_on"`
+}
+
+// Signer signs rendered configs with an Ed25519 private key
+type Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// NewSigner creates a Signer from a key id and a base64 encoded 32 byte Ed25519 seed
+func NewSigner(id, encodedSeed string) (*Signer, error) {
+	if id == "" {
+		return nil, ErrInvalidKey
+	}
+	seed, err := base64.StdEncoding.DecodeString(encodedSeed)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	return &Signer{
+		id:  id,
+		key: ed25519.NewKeyFromSeed(seed),
+	}, nil
+}
+
+func (s *Signer) ID() string {
+	return s.id
+}
+
+// Key returns the public key for this signer
+func (s *Signer) Key() *Key {
+	return &Key{
+		ID:        s.id,
+		PublicKey: s.key.Public().(ed25519.PublicKey),
+	}
+}
+
+// Sign returns the unpadded base64url encoded signature of b
+func (s *Signer) Sign(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(s.key, b))
+}
+
+// Verify checks an unpadded base64url encoded signature of b against a public key
+func Verify(key ed25519.PublicKey, b []byte, signature string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, b, sig)
+}
+
+// JWK is a JSON Web Key for an Ed25519 public key, see RFC 8037
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	X   string `json:"x"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewJWKS(keys []*Key) JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, k := range keys {
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Use: "sig",
+			Alg: "EdDSA",
+			Kid: k.ID,
+			X:   base64.RawURLEncoding.EncodeToString(k.PublicKey),
+		})
+	}
+	return jwks
+}
@@ -0,0 +1,61 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var seed = base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		id   string
+		seed string
+		err  error
+	}{
+		{
+			id:   "key1",
+			seed: seed,
+			err:  nil,
+		},
+		{
+			id:   "",
+			seed: seed,
+			err:  ErrInvalidKey,
+		},
+		{
+			id:   "key1",
+			seed: base64.StdEncoding.EncodeToString([]byte("short")),
+			err:  ErrInvalidKey,
+		},
+	}
+	for _, tc := range tests {
+		_, err := NewSigner(tc.id, tc.seed)
+		assert.ErrorIs(t, err, tc.err)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, err := NewSigner("key1", seed)
+	assert.Nil(t, err)
+	config := []byte("{\"feature1\":{\"value\":\"test\",\"type\":\"STRING\"}}\n")
+	signature := signer.Sign(config)
+	assert.True(t, Verify(signer.Key().PublicKey, config, signature))
+	assert.False(t, Verify(signer.Key().PublicKey, []byte("{}\n"), signature))
+	assert.False(t, Verify(signer.Key().PublicKey, config, "not a signature"))
+}
+
+func TestNewJWKS(t *testing.T) {
+	signer, err := NewSigner("key1", seed)
+	assert.Nil(t, err)
+	jwks := NewJWKS([]*Key{signer.Key()})
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "key1", jwks.Keys[0].Kid)
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "Ed25519", jwks.Keys[0].Crv)
+	x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(signer.Key().PublicKey), x)
+}
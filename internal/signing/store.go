@@ -0,0 +1,55 @@
+package signing
+
+import (
+	"context"
+	"github.com/broswen/vex/internal/db"
+)
+
+type Store interface {
+	Save(ctx context.Context, k *Key) error
+	List(ctx context.Context, limit int64) ([]*Key, error)
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+// Save inserts a public key, saving an existing key again marks it as the most recent key.
+// A key id can't be reused for a different public key.
+func (store *PostgresStore) Save(ctx context.Context, k *Key) error {
+	res, err := store.db.Exec(ctx, `INSERT INTO signing_key (id, public_key) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET modified_on = now() WHERE signing_key.public_key = excluded.public_key;`, k.ID, []byte(k.PublicKey))
+	err = db.PgError(err)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrKeyIDInUse
+	}
+	return nil
+}
+
+// List returns the most recently used keys first
+func (store *PostgresStore) List(ctx context.Context, limit int64) ([]*Key, error) {
+	rows, err := store.db.Query(ctx, `SELECT id, public_key, created_on, modified_on FROM signing_key ORDER BY modified_on DESC LIMIT $1;`, limit)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*Key, 0)
+	for rows.Next() {
+		k := &Key{}
+		var publicKey []byte
+		err = rows.Scan(&k.ID, &publicKey, &k.CreatedOn, &k.ModifiedOn)
+		if err != nil {
+			return nil, err
+		}
+		k.PublicKey = publicKey
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
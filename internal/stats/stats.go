@@ -53,4 +53,75 @@ var (
 	TokenDeleted = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "token_deleted",
 	})
+
+	WebhookDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_delivered",
+	})
+
+	WebhookDeliveryError = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_delivery_error",
+	})
+
+	OutboxRelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbox_relayed",
+	})
+
+	OutboxRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbox_retried",
+	})
+
+	ConsumerRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_retried",
+	})
+
+	StaleSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stale_skipped",
+	})
+
+	// provisioning messages that were coalesced into a later message for the same project, each one is a render and KV write saved
+	ProvisionCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "provision_coalesced",
+	})
+
+	DeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dead_lettered",
+	})
+
+	Replayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "replayed",
+	})
+
+	ReconcileError = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reconcile_error",
+	})
+
+	// drift found by the last reconciliation
+	DriftProjectsMissing = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "drift_projects_missing",
+	})
+
+	DriftProjectsStale = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "drift_projects_stale",
+	})
+
+	DriftProjectsOrphaned = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "drift_projects_orphaned",
+	})
+
+	DriftTokensMissing = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "drift_tokens_missing",
+	})
+
+	DriftTokensOrphaned = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "drift_tokens_orphaned",
+	})
+
+	// results of each target of a composite provisioner, labeled with the target name
+	TargetProvisioned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "target_provisioned",
+	}, []string{"target"})
+
+	TargetError = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "target_error",
+	}, []string{"target"})
 )
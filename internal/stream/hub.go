@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+	"github.com/rs/zerolog/log"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber,
+// slow subscribers are dropped and have to reconnect with Last-Event-ID
+const subscriberBuffer = 16
+
+// Hub fans out events to the subscribers of a project.
+// Events are received from postgres notifications so every server replica sees every event.
+type Hub struct {
+	store       Store
+	mu          sync.Mutex
+	subscribers map[string]map[chan *Event]struct{}
+}
+
+func NewHub(store Store) *Hub {
+	return &Hub{
+		store:       store,
+		subscribers: make(map[string]map[chan *Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel of events for a project and a func to unsubscribe.
+// The channel is closed if the subscriber falls behind.
+func (h *Hub) Subscribe(projectId string) (<-chan *Event, func()) {
+	ch := make(chan *Event, subscriberBuffer)
+	h.mu.Lock()
+	if h.subscribers[projectId] == nil {
+		h.subscribers[projectId] = make(map[chan *Event]struct{})
+	}
+	h.subscribers[projectId][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(projectId, ch)
+	}
+}
+
+// remove must be called with the lock held
+func (h *Hub) remove(projectId string, ch chan *Event) {
+	subs, ok := h.subscribers[projectId]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, projectId)
+	}
+}
+
+// Broadcast sends an event to the subscribers of the project on this replica
+func (h *Hub) Broadcast(e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[e.ProjectID] {
+		select {
+		case ch <- e:
+		default:
+			log.Warn().Str("id", e.ProjectID).Msg("dropping slow event subscriber")
+			h.remove(e.ProjectID, ch)
+		}
+	}
+}
+
+// Since returns the events of a project after the project version
+func (h *Hub) Since(ctx context.Context, projectId string, version int64, limit int64) ([]*Event, error) {
+	return h.store.ListSince(ctx, projectId, version, limit)
+}
+
+// Listen receives event notifications from postgres and broadcasts them until the context is done
+func (h *Hub) Listen(ctx context.Context, database *db.Database) error {
+	for {
+		err := h.listen(ctx, database)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Error().Err(err).Msg("error listening for config events")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (h *Hub) listen(ctx context.Context, database *db.Database) error {
+	conn, err := database.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err = conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(n.Payload, 10, 64)
+		if err != nil {
+			log.Warn().Str("payload", n.Payload).Msg("invalid config event notification")
+			continue
+		}
+		e, err := h.store.Get(ctx, id)
+		if err != nil {
+			log.Error().Err(err).Int64("id", id).Msg("could not get config event")
+			continue
+		}
+		h.Broadcast(e)
+	}
+}
+
+// Prune deletes events older than the retention every interval until the context is done
+func (h *Hub) Prune(ctx context.Context, retention, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			n, err := h.store.Prune(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.Error().Err(err).Msg("could not prune config events")
+				continue
+			}
+			log.Debug().Int64("count", n).Msg("pruned config events")
+		}
+	}
+}
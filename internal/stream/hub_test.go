@@ -0,0 +1,43 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub_Broadcast(t *testing.T) {
+	h := NewHub(NewMockStore())
+	events, cancel := h.Subscribe("1")
+	defer cancel()
+	other, cancelOther := h.Subscribe("2")
+	defer cancelOther()
+
+	e := &Event{ID: 1, ProjectID: "1", Type: CONFIG, Config: []byte(`{"a":{"type":"BOOLEAN","value":"true"}}`)}
+	h.Broadcast(e)
+	assert.Equal(t, e, <-events)
+	assert.Len(t, other, 0)
+}
+
+func TestHub_DropsSlowSubscriber(t *testing.T) {
+	h := NewHub(NewMockStore())
+	events, cancel := h.Subscribe("1")
+	defer cancel()
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Broadcast(&Event{ID: int64(i), ProjectID: "1", Type: CONFIG})
+	}
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, subscriberBuffer, count)
+}
+
+func TestEvent_Write(t *testing.T) {
+	buf := &bytes.Buffer{}
+	//the id is the project version and the trailing newline of the rendered config is trimmed
+	e := &Event{ID: 3, Version: 12, ProjectID: "1", Type: CONFIG, Config: []byte("{\"a\":{\"type\":\"BOOLEAN\",\"value\":\"true\"}}\n")}
+	assert.Nil(t, e.Write(buf))
+	assert.Equal(t, "id: 12\nevent: config\ndata: {\"a\":{\"type\":\"BOOLEAN\",\"value\":\"true\"}}\n\n", buf.String())
+}
@@ -0,0 +1,36 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) Insert(ctx context.Context, e *Event) (*Event, error) {
+	args := m.Called(ctx, e)
+	return args.Get(0).(*Event), args.Error(1)
+}
+
+func (m *MockStore) Get(ctx context.Context, id int64) (*Event, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Event), args.Error(1)
+}
+
+func (m *MockStore) ListSince(ctx context.Context, projectId string, version int64, limit int64) ([]*Event, error) {
+	args := m.Called(ctx, projectId, version, limit)
+	return args.Get(0).([]*Event), args.Error(1)
+}
+
+func (m *MockStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	args := m.Called(ctx, before)
+	return args.Get(0).(int64), args.Error(1)
+}
@@ -0,0 +1,82 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+)
+
+type Store interface {
+	Insert(ctx context.Context, e *Event) (*Event, error)
+	Get(ctx context.Context, id int64) (*Event, error)
+	ListSince(ctx context.Context, projectId string, version int64, limit int64) ([]*Event, error)
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+// Insert inserts an event, events without a version, like deletes, follow the latest event of the project
+func (store *PostgresStore) Insert(ctx context.Context, e *Event) (*Event, error) {
+	inserted := &Event{}
+	var config string
+	err := store.db.QueryRow(ctx, `INSERT INTO config_event (project_id, account_id, event_type, config, version) VALUES ($1, $2, $3, $4, coalesce(nullif($5::bigint, 0), (SELECT coalesce(max(version), 0) + 1 FROM config_event WHERE project_id = $1))) RETURNING id, project_id, account_id, event_type, config, version, created_on;`,
+		e.ProjectID, e.AccountID, e.Type, string(e.Config), e.Version).Scan(&inserted.ID, &inserted.ProjectID, &inserted.AccountID, &inserted.Type, &config, &inserted.Version, &inserted.CreatedOn)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	inserted.Config = []byte(config)
+	return inserted, nil
+}
+
+func (store *PostgresStore) Get(ctx context.Context, id int64) (*Event, error) {
+	e := &Event{}
+	var config string
+	err := store.db.QueryRow(ctx, `SELECT id, project_id, account_id, event_type, config, version, created_on FROM config_event WHERE id = $1;`, id).
+		Scan(&e.ID, &e.ProjectID, &e.AccountID, &e.Type, &config, &e.Version, &e.CreatedOn)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	e.Config = []byte(config)
+	return e, nil
+}
+
+// ListSince returns the events of a project after the project version, oldest first
+func (store *PostgresStore) ListSince(ctx context.Context, projectId string, version int64, limit int64) ([]*Event, error) {
+	rows, err := store.db.Query(ctx, `SELECT id, project_id, account_id, event_type, config, version, created_on FROM config_event WHERE project_id = $1 AND version > $2 ORDER BY version, id LIMIT $3;`, projectId, version, limit)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]*Event, 0)
+	for rows.Next() {
+		e := &Event{}
+		var config string
+		err = rows.Scan(&e.ID, &e.ProjectID, &e.AccountID, &e.Type, &config, &e.Version, &e.CreatedOn)
+		if err != nil {
+			return nil, err
+		}
+		e.Config = []byte(config)
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Prune deletes events created before the time and returns the number of deleted events
+func (store *PostgresStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res, err := store.db.Exec(ctx, `DELETE FROM config_event WHERE created_on < $1;`, before)
+	err = db.PgError(err)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,42 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+type EventType string
+
+const (
+	// CONFIG events carry the new rendered config of a project
+	CONFIG EventType = "config"
+	// DELETE events are sent when a project is deleted
+	DELETE EventType = "delete"
+)
+
+// Channel is the postgres notification channel new event ids are published on
+const Channel = "config_event"
+
+type Event struct {
+	ID        int64     `json:"id"`
+	ProjectID string    `json:"project_id"`
+	AccountID string    `json:"account_id"`
+	Type      EventType `json:"type"`
+	Config    []byte    `json:"config"`
+	// Version is the project version of the event, it is the Server-Sent Events id that clients resume from
+	Version   int64     `json:"version"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+// Write writes the event in the Server-Sent Events format, the rendered config is always a single line of JSON
+// and its trailing newline is trimmed so it doesn't end the event early
+func (e *Event) Write(w io.Writer) error {
+	data := bytes.TrimRight(e.Config, "\n")
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Version, e.Type, data)
+	return err
+}
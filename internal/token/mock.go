@@ -3,6 +3,7 @@ package token
 import (
 	"context"
 	"github.com/stretchr/testify/mock"
+	"time"
 )
 
 type MockStore struct {
@@ -38,6 +39,11 @@ func (m *MockStore) List(ctx context.Context, accountId string, limit, offset in
 	return args.Get(0).([]*Token), args.Error(1)
 }
 
+func (m *MockStore) ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Token, error) {
+	args := m.Called(ctx, accountId, createdOn, id, limit)
+	return args.Get(0).([]*Token), args.Error(1)
+}
+
 func (m *MockStore) Delete(ctx context.Context, id string) error {
 	args := m.Called(ctx, id)
 	return args.Error(0)
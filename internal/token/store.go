@@ -6,10 +6,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/outbox"
+	"time"
 )
 
 type Store interface {
 	List(ctx context.Context, accountId string, limit, offset int64) ([]*Token, error)
+	ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Token, error)
 	Generate(ctx context.Context, accountId string, readOnly bool) (*Token, error)
 	Reroll(ctx context.Context, tokenId string) (*Token, error)
 	Get(ctx context.Context, id string) (*Token, error)
@@ -37,28 +40,65 @@ func GenerateTokenAndHash(length int) (string, []byte, error) {
 	return token, hash, nil
 }
 
+// Generate creates a token for the account and provisions it through the outbox
 func (store *PostgresStore) Generate(ctx context.Context, accountId string, readOnly bool) (*Token, error) {
 	t := &Token{}
 	generatedToken, tokenHash, err := GenerateTokenAndHash(16)
 	if err != nil {
 		return nil, err
 	}
-	err = db.PgError(store.db.QueryRow(ctx, `INSERT INTO token (account_id, read_only, token_hash) VALUES ($1, $2, $3) RETURNING id, account_id, read_only, created_on, modified_on;`,
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return t, db.PgError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = db.PgError(tx.QueryRow(ctx, `INSERT INTO token (account_id, read_only, token_hash) VALUES ($1, $2, $3) RETURNING id, account_id, read_only, created_on, modified_on;`,
 		accountId, readOnly, tokenHash).Scan(&t.ID, &t.AccountID, &t.ReadOnly, &t.CreatedOn, &t.ModifiedOn))
 	t.Token = generatedToken
-	return t, err
+	if err != nil {
+		return t, err
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.PROVISION_TOKEN, TokenID: t.ID, AccountID: t.AccountID, Reason: "token.created"})
+	if err != nil {
+		return t, err
+	}
+	return t, db.PgError(tx.Commit(ctx))
 }
 
+// Reroll replaces the token hash, the new token is provisioned and the old one is deprovisioned through the outbox
 func (store *PostgresStore) Reroll(ctx context.Context, tokenId string) (*Token, error) {
 	generatedToken, tokenHash, err := GenerateTokenAndHash(16)
 	if err != nil {
 		return nil, err
 	}
 	updatedToken := &Token{}
-	err = db.PgError(store.db.QueryRow(ctx, `UPDATE token SET token_hash = $1 WHERE id = $2 RETURNING id, account_id, read_only, created_on, modified_on;`,
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return updatedToken, db.PgError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var oldHash []byte
+	err = db.PgError(tx.QueryRow(ctx, `SELECT token_hash FROM token WHERE id = $1 FOR UPDATE;`, tokenId).Scan(&oldHash))
+	if err != nil {
+		return updatedToken, err
+	}
+	err = db.PgError(tx.QueryRow(ctx, `UPDATE token SET token_hash = $1 WHERE id = $2 RETURNING id, account_id, read_only, created_on, modified_on;`,
 		tokenHash, tokenId).Scan(&updatedToken.ID, &updatedToken.AccountID, &updatedToken.ReadOnly, &updatedToken.CreatedOn, &updatedToken.ModifiedOn))
 	updatedToken.Token = generatedToken
-	return updatedToken, err
+	if err != nil {
+		return updatedToken, err
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.PROVISION_TOKEN, TokenID: updatedToken.ID, AccountID: updatedToken.AccountID, Reason: "token.rerolled"})
+	if err != nil {
+		return updatedToken, err
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.DEPROVISION_TOKEN, TokenHash: oldHash, AccountID: updatedToken.AccountID, Reason: "token.rerolled"})
+	if err != nil {
+		return updatedToken, err
+	}
+	return updatedToken, db.PgError(tx.Commit(ctx))
 }
 
 func (store *PostgresStore) Get(ctx context.Context, id string) (*Token, error) {
@@ -79,7 +119,7 @@ func (store *PostgresStore) GetByHash(ctx context.Context, token string) (*Token
 }
 
 func (store *PostgresStore) List(ctx context.Context, accountId string, limit, offset int64) ([]*Token, error) {
-	rows, err := store.db.Query(ctx, `SELECT id, account_id, read_only, created_on, modified_on FROM token WHERE account_id = $1 OFFSET $2 LIMIT $3;`, accountId, offset, limit)
+	rows, err := store.db.Query(ctx, `SELECT id, account_id, token_hash, read_only, created_on, modified_on FROM token WHERE account_id = $1 ORDER BY created_on, id OFFSET $2 LIMIT $3;`, accountId, offset, limit)
 	err = db.PgError(err)
 	if err != nil {
 		return nil, err
@@ -88,7 +128,7 @@ func (store *PostgresStore) List(ctx context.Context, accountId string, limit, o
 	fs := make([]*Token, 0)
 	for rows.Next() {
 		t := &Token{}
-		err = rows.Scan(&t.ID, &t.AccountID, &t.ReadOnly, &t.CreatedOn, &t.ModifiedOn)
+		err = rows.Scan(&t.ID, &t.AccountID, &t.TokenHash, &t.ReadOnly, &t.CreatedOn, &t.ModifiedOn)
 		if err != nil {
 			return nil, err
 		}
@@ -97,8 +137,43 @@ func (store *PostgresStore) List(ctx context.Context, accountId string, limit, o
 	return fs, nil
 }
 
-func (store *PostgresStore) Delete(ctx context.Context, id string) error {
-	_, err := store.db.Exec(ctx, `DELETE FROM token WHERE id = $1;`, id)
+// ListAfter lists the tokens of an account ordered by (created_on, id) that sort after the given cursor
+func (store *PostgresStore) ListAfter(ctx context.Context, accountId string, createdOn time.Time, id string, limit int64) ([]*Token, error) {
+	rows, err := store.db.Query(ctx, `SELECT id, account_id, token_hash, read_only, created_on, modified_on FROM token WHERE account_id = $1 AND (created_on, id) > ($2, $3::uuid) ORDER BY created_on, id LIMIT $4;`, accountId, createdOn, id, limit)
 	err = db.PgError(err)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fs := make([]*Token, 0)
+	for rows.Next() {
+		t := &Token{}
+		err = rows.Scan(&t.ID, &t.AccountID, &t.TokenHash, &t.ReadOnly, &t.CreatedOn, &t.ModifiedOn)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, t)
+	}
+	return fs, nil
+}
+
+// Delete deletes a token and deprovisions it through the outbox
+func (store *PostgresStore) Delete(ctx context.Context, id string) error {
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return db.PgError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var accountId string
+	var tokenHash []byte
+	err = db.PgError(tx.QueryRow(ctx, `DELETE FROM token WHERE id = $1 RETURNING account_id, token_hash;`, id).Scan(&accountId, &tokenHash))
+	if err != nil {
+		return err
+	}
+	err = outbox.Write(ctx, tx, &outbox.Message{Type: outbox.DEPROVISION_TOKEN, TokenHash: tokenHash, AccountID: accountId, Reason: "token.deleted"})
+	if err != nil {
+		return err
+	}
+	return db.PgError(tx.Commit(ctx))
 }
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a webhook url points to an address that deliveries must not reach
+type ErrForbiddenAddress struct {
+	IP net.IP
+}
+
+func (e ErrForbiddenAddress) Error() string {
+	return fmt.Sprintf("webhook address %s is not allowed", e.IP)
+}
+
+// allowedIP reports whether deliveries can be sent to ip, internal addresses are rejected so a webhook
+// can't be used to reach services on the private network
+func allowedIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// dialControl checks the resolved address of every connection, so a hostname that resolves to an allowed address
+// when the webhook is created can't later be pointed at an internal one
+func dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !allowedIP(ip) {
+		return ErrForbiddenAddress{IP: ip}
+	}
+	return nil
+}
+
+// NewClient returns a client for sending deliveries that refuses to connect to internal addresses
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Second * 10,
+		KeepAlive: time.Second * 30,
+		Control:   dialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			//deliveries aren't sent through a proxy since the proxy would connect to the address instead
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       time.Second * 90,
+			TLSHandshakeTimeout:   time.Second * 10,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
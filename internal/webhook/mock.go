@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/event"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{}
+}
+
+func (m *MockStore) List(ctx context.Context, accountId string, limit, offset int64) ([]*Webhook, error) {
+	args := m.Called(ctx, accountId, limit, offset)
+	return args.Get(0).([]*Webhook), args.Error(1)
+}
+
+func (m *MockStore) Insert(ctx context.Context, w *Webhook) (*Webhook, error) {
+	args := m.Called(ctx, w)
+	return args.Get(0).(*Webhook), args.Error(1)
+}
+
+func (m *MockStore) Update(ctx context.Context, w *Webhook) (*Webhook, error) {
+	args := m.Called(ctx, w)
+	return args.Get(0).(*Webhook), args.Error(1)
+}
+
+func (m *MockStore) Get(ctx context.Context, id string) (*Webhook, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Webhook), args.Error(1)
+}
+
+func (m *MockStore) Delete(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockStore) Enqueue(ctx context.Context, accountId, eventId string, eventType event.Type, payload []byte) (int64, error) {
+	args := m.Called(ctx, accountId, eventId, eventType, payload)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockStore) ListDeliveries(ctx context.Context, webhookId string, limit, offset int64) ([]*Delivery, error) {
+	args := m.Called(ctx, webhookId, limit, offset)
+	return args.Get(0).([]*Delivery), args.Error(1)
+}
+
+func (m *MockStore) GetDelivery(ctx context.Context, id string) (*Delivery, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Delivery), args.Error(1)
+}
+
+func (m *MockStore) Redeliver(ctx context.Context, id string) (*Delivery, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Delivery), args.Error(1)
+}
+
+func (m *MockStore) Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Attempt, error) {
+	args := m.Called(ctx, limit, lease)
+	return args.Get(0).([]*Attempt), args.Error(1)
+}
+
+func (m *MockStore) Complete(ctx context.Context, d *Delivery) error {
+	args := m.Called(ctx, d)
+	return args.Error(0)
+}
@@ -0,0 +1,26 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/broswen/vex/internal/event"
+)
+
+// Publisher queues a delivery of each event to the subscribed webhooks of the account
+type Publisher struct {
+	store Store
+}
+
+func NewPublisher(store Store) *Publisher {
+	return &Publisher{store: store}
+}
+
+func (p *Publisher) Publish(ctx context.Context, e *event.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.store.Enqueue(ctx, e.AccountID, e.ID, e.Type, payload)
+	return err
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/broswen/vex/internal/db"
+	"github.com/broswen/vex/internal/event"
+	"github.com/jackc/pgx/v4"
+)
+
+type Store interface {
+	List(ctx context.Context, accountId string, limit, offset int64) ([]*Webhook, error)
+	Insert(ctx context.Context, w *Webhook) (*Webhook, error)
+	Update(ctx context.Context, w *Webhook) (*Webhook, error)
+	Get(ctx context.Context, id string) (*Webhook, error)
+	Delete(ctx context.Context, id string) error
+	// Enqueue creates a pending delivery for every webhook of the account subscribed to the event type
+	Enqueue(ctx context.Context, accountId, eventId string, eventType event.Type, payload []byte) (int64, error)
+	ListDeliveries(ctx context.Context, webhookId string, limit, offset int64) ([]*Delivery, error)
+	GetDelivery(ctx context.Context, id string) (*Delivery, error)
+	// Redeliver resets a delivery so it is sent again
+	Redeliver(ctx context.Context, id string) (*Delivery, error)
+	// Claim returns pending deliveries that are due and leases them so other workers skip them
+	Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Attempt, error)
+	// Complete saves the result of a delivery attempt
+	Complete(ctx context.Context, d *Delivery) error
+}
+
+type PostgresStore struct {
+	db *db.Database
+}
+
+func NewPostgresStore(database *db.Database) (*PostgresStore, error) {
+	return &PostgresStore{db: database}, nil
+}
+
+const webhookColumns = `id, account_id, url, event_types, created_on, modified_on`
+
+const deliveryColumns = `id, webhook_id, account_id, event_id, event_type, payload, status, attempts, next_attempt, response_status, error, created_on, modified_on`
+
+func scanWebhook(row pgx.Row) (*Webhook, error) {
+	w := &Webhook{}
+	var eventTypes []string
+	err := row.Scan(&w.ID, &w.AccountID, &w.URL, &eventTypes, &w.CreatedOn, &w.ModifiedOn)
+	if err != nil {
+		return nil, err
+	}
+	w.EventTypes = make([]event.Type, 0, len(eventTypes))
+	for _, t := range eventTypes {
+		w.EventTypes = append(w.EventTypes, event.Type(t))
+	}
+	return w, nil
+}
+
+func scanDelivery(row pgx.Row) (*Delivery, error) {
+	d := &Delivery{}
+	err := row.Scan(&d.ID, &d.WebhookID, &d.AccountID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.ResponseStatus, &d.Error, &d.CreatedOn, &d.ModifiedOn)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func eventTypes(w *Webhook) []string {
+	types := make([]string, 0, len(w.EventTypes))
+	for _, t := range w.EventTypes {
+		types = append(types, string(t))
+	}
+	return types
+}
+
+func (store *PostgresStore) List(ctx context.Context, accountId string, limit, offset int64) ([]*Webhook, error) {
+	rows, err := store.db.Query(ctx, `SELECT `+webhookColumns+` FROM webhook WHERE account_id = $1 ORDER BY created_on OFFSET $2 LIMIT $3;`, accountId, offset, limit)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	ws := make([]*Webhook, 0)
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+// Insert returns the new webhook with its secret
+func (store *PostgresStore) Insert(ctx context.Context, w *Webhook) (*Webhook, error) {
+	newWebhook, err := scanWebhook(store.db.QueryRow(ctx, `INSERT INTO webhook (account_id, url, secret, event_types) VALUES ($1, $2, $3, $4) RETURNING `+webhookColumns+`;`,
+		w.AccountID, w.URL, w.Secret, eventTypes(w)))
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	newWebhook.Secret = w.Secret
+	return newWebhook, nil
+}
+
+func (store *PostgresStore) Update(ctx context.Context, w *Webhook) (*Webhook, error) {
+	updatedWebhook, err := scanWebhook(store.db.QueryRow(ctx, `UPDATE webhook SET url = $2, event_types = $3 WHERE id = $1 RETURNING `+webhookColumns+`;`,
+		w.ID, w.URL, eventTypes(w)))
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return updatedWebhook, nil
+}
+
+func (store *PostgresStore) Get(ctx context.Context, id string) (*Webhook, error) {
+	w, err := scanWebhook(store.db.QueryRow(ctx, `SELECT `+webhookColumns+` FROM webhook WHERE id = $1;`, id))
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return w, nil
+}
+
+func (store *PostgresStore) Delete(ctx context.Context, id string) error {
+	res, err := store.db.Exec(ctx, `DELETE FROM webhook WHERE id = $1;`, id)
+	err = db.PgError(err)
+	if err != nil {
+		return storeError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrWebhookNotFound{db.ErrNotFound.Error()}
+	}
+	return nil
+}
+
+func (store *PostgresStore) Enqueue(ctx context.Context, accountId, eventId string, eventType event.Type, payload []byte) (int64, error) {
+	res, err := store.db.Exec(ctx, `INSERT INTO webhook_delivery (webhook_id, account_id, event_id, event_type, payload) SELECT id, account_id, $2, $3, $4 FROM webhook WHERE account_id = $1 AND (event_types = '{}' OR $3 = ANY(event_types));`,
+		accountId, eventId, string(eventType), string(payload))
+	err = db.PgError(err)
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return res.RowsAffected(), nil
+}
+
+func (store *PostgresStore) ListDeliveries(ctx context.Context, webhookId string, limit, offset int64) ([]*Delivery, error) {
+	rows, err := store.db.Query(ctx, `SELECT `+deliveryColumns+` FROM webhook_delivery WHERE webhook_id = $1 ORDER BY created_on DESC OFFSET $2 LIMIT $3;`, webhookId, offset, limit)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	ds := make([]*Delivery, 0)
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func (store *PostgresStore) GetDelivery(ctx context.Context, id string) (*Delivery, error) {
+	d, err := scanDelivery(store.db.QueryRow(ctx, `SELECT `+deliveryColumns+` FROM webhook_delivery WHERE id = $1;`, id))
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return d, nil
+}
+
+func (store *PostgresStore) Redeliver(ctx context.Context, id string) (*Delivery, error) {
+	d, err := scanDelivery(store.db.QueryRow(ctx, `UPDATE webhook_delivery SET status = 'PENDING', attempts = 0, next_attempt = now(), response_status = 0, error = '' WHERE id = $1 RETURNING `+deliveryColumns+`;`, id))
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return d, nil
+}
+
+// Claim uses SKIP LOCKED so multiple workers can claim deliveries concurrently.
+// Claimed deliveries are leased by moving next_attempt forward, if a worker dies the delivery is retried after the lease.
+func (store *PostgresStore) Claim(ctx context.Context, limit int64, lease time.Duration) ([]*Attempt, error) {
+	rows, err := store.db.Query(ctx, `UPDATE webhook_delivery d SET attempts = d.attempts + 1, next_attempt = now() + $2::interval FROM webhook w
+WHERE w.id = d.webhook_id AND d.id IN (SELECT id FROM webhook_delivery WHERE status = 'PENDING' AND next_attempt <= now() ORDER BY next_attempt LIMIT $1 FOR UPDATE SKIP LOCKED)
+RETURNING d.id, d.webhook_id, d.account_id, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt, d.response_status, d.error, d.created_on, d.modified_on, w.url, w.secret;`, limit, lease)
+	err = db.PgError(err)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	as := make([]*Attempt, 0)
+	for rows.Next() {
+		a := &Attempt{}
+		err = rows.Scan(&a.ID, &a.WebhookID, &a.AccountID, &a.EventID, &a.EventType, &a.Payload, &a.Status, &a.Attempts, &a.NextAttempt, &a.ResponseStatus, &a.Error, &a.CreatedOn, &a.ModifiedOn, &a.URL, &a.Secret)
+		if err != nil {
+			return nil, ErrUnknown{err}
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+func (store *PostgresStore) Complete(ctx context.Context, d *Delivery) error {
+	_, err := store.db.Exec(ctx, `UPDATE webhook_delivery SET status = $2, next_attempt = $3, response_status = $4, error = $5 WHERE id = $1;`,
+		d.ID, d.Status, d.NextAttempt, d.ResponseStatus, d.Error)
+	return storeError(db.PgError(err))
+}
+
+func storeError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case db.ErrNotFound:
+		return ErrWebhookNotFound{err.Error()}
+	case db.ErrInvalidData:
+		return ErrInvalidData{err.Error()}
+	default:
+		return ErrUnknown{err}
+	}
+}
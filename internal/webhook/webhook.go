@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/broswen/vex/internal/event"
+)
+
+type Status string
+
+const (
+	PENDING   Status = "PENDING"
+	SUCCEEDED Status = "SUCCEEDED"
+	FAILED    Status = "FAILED"
+)
+
+const (
+	SignatureHeader = "X-Vex-Signature"
+	TimestampHeader = "X-Vex-Timestamp"
+	EventHeader     = "X-Vex-Event"
+	DeliveryHeader  = "X-Vex-Delivery"
+)
+
+type Webhook struct {
+	ID        string `json:"id"`
+	AccountID string `json:"account_id"`
+	URL       string `json:"url"`
+	// Secret signs deliveries, it is only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+	// EventTypes filters the events that are delivered, an empty list delivers every event
+	EventTypes []event.Type `json:"event_types"`
+	CreatedOn  time.Time    `json:"created_on"`
+	ModifiedOn time.Time    `json:"modified_on"`
+}
+
+type Delivery struct {
+	ID             string     `json:"id"`
+	WebhookID      string     `json:"webhook_id"`
+	AccountID      string     `json:"account_id"`
+	EventID        string     `json:"event_id"`
+	EventType      event.Type `json:"event_type"`
+	Payload        string     `json:"payload"`
+	Status         Status     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttempt    time.Time  `json:"next_attempt"`
+	ResponseStatus int        `json:"response_status"`
+	Error          string     `json:"error"`
+	CreatedOn      time.Time  `json:"created_on"`
+	ModifiedOn     time.Time  `json:"modified_on"`
+}
+
+// Attempt is a claimed delivery with the webhook it is sent to
+type Attempt struct {
+	Delivery
+	URL    string
+	Secret string
+}
+
+// Validate checks the webhook url is https and doesn't point to an internal address.
+// Hostnames are checked again when deliveries connect, since they can resolve to a different address later.
+func Validate(w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return ErrInvalidData{"invalid webhook url, it must be https"}
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") || strings.HasSuffix(strings.ToLower(u.Hostname()), ".localhost") {
+		return ErrInvalidData{"webhook url must not be an internal address"}
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowedIP(ip) {
+		return ErrInvalidData{"webhook url must not be an internal address"}
+	}
+	for _, t := range w.EventTypes {
+		if !event.ValidType(t) {
+			return ErrInvalidData{fmt.Sprintf("invalid event type %q", t)}
+		}
+	}
+	return nil
+}
+
+// NewSecret generates a random hex encoded webhook secret
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>" with the webhook secret.
+// Receivers should recompute the signature and reject old timestamps to prevent replays.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		Webhook Webhook
+		Valid   bool
+	}{
+		{Webhook: Webhook{URL: "https://example.com/hook"}, Valid: true},
+		{Webhook: Webhook{URL: "https://example.com/hook", EventTypes: []event.Type{event.FlagUpdated}}, Valid: true},
+		{Webhook: Webhook{URL: "https://example.com/hook", EventTypes: []event.Type{"flag.renamed"}}, Valid: false},
+		{Webhook: Webhook{URL: "ftp://example.com/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "example.com"}, Valid: false},
+		{Webhook: Webhook{URL: "http://example.com/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://localhost/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://127.0.0.1/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://10.0.0.1/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://169.254.169.254/latest"}, Valid: false},
+		{Webhook: Webhook{URL: "https://0.0.0.0/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://[::1]/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://[fd00::1]/hook"}, Valid: false},
+		{Webhook: Webhook{URL: "https://93.184.216.34/hook"}, Valid: true},
+	}
+	for _, test := range tests {
+		err := Validate(test.Webhook)
+		assert.Equalf(t, test.Valid, err == nil, "%s %v", test.Webhook.URL, test.Webhook.EventTypes)
+	}
+}
+
+func TestSign(t *testing.T) {
+	ts := time.Unix(1660532420, 0)
+	//echo -n '1660532420.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=d4098fd95eecf6512034a9f03883595335d6e992ec75f3a433f54254247cc60c", Sign("secret", ts, []byte("{}")))
+	assert.NotEqual(t, Sign("secret", ts, []byte("{}")), Sign("other", ts, []byte("{}")))
+	assert.NotEqual(t, Sign("secret", ts, []byte("{}")), Sign("secret", ts.Add(time.Second), []byte("{}")))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second*10, Backoff(1))
+	assert.Equal(t, time.Second*20, Backoff(2))
+	assert.Equal(t, time.Second*80, Backoff(4))
+	assert.Equal(t, time.Hour, Backoff(MaxAttempts))
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/broswen/vex/internal/secret"
+	"github.com/broswen/vex/internal/stats"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MaxAttempts is the number of attempts before a delivery is marked FAILED
+	MaxAttempts = 10
+	baseBackoff = time.Second * 10
+	maxBackoff  = time.Hour
+	// lease is how long a claimed delivery is hidden from other workers
+	lease = time.Minute * 2
+)
+
+// Worker polls for pending deliveries and sends them
+type Worker struct {
+	store  Store
+	client *http.Client
+	// secrets decrypts webhook secrets, it is optional if the secrets aren't encrypted
+	secrets *secret.Cipher
+	batch   int64
+}
+
+func NewWorker(store Store, client *http.Client, secrets *secret.Cipher, batch int64) *Worker {
+	return &Worker{
+		store:   store,
+		client:  client,
+		secrets: secrets,
+		batch:   batch,
+	}
+}
+
+// Run delivers pending deliveries every interval until the context is done
+func (w *Worker) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := w.Deliver(ctx); err != nil {
+				log.Error().Err(err).Msg("could not deliver webhooks")
+			}
+		}
+	}
+}
+
+// Deliver claims and sends one batch of deliveries
+func (w *Worker) Deliver(ctx context.Context) error {
+	attempts, err := w.store.Claim(ctx, w.batch, lease)
+	if err != nil {
+		return err
+	}
+	for _, a := range attempts {
+		d := w.send(ctx, a)
+		if err = w.store.Complete(ctx, d); err != nil {
+			log.Error().Err(err).Str("id", d.ID).Msg("could not complete webhook delivery")
+		}
+	}
+	return nil
+}
+
+func (w *Worker) send(ctx context.Context, a *Attempt) *Delivery {
+	d := a.Delivery
+	status, err := w.post(ctx, a)
+	d.ResponseStatus = status
+	if err == nil {
+		d.Status = SUCCEEDED
+		d.Error = ""
+		stats.WebhookDelivered.Inc()
+		return &d
+	}
+	d.Error = err.Error()
+	stats.WebhookDeliveryError.Inc()
+	if d.Attempts >= MaxAttempts {
+		d.Status = FAILED
+		log.Warn().Str("id", d.ID).Str("webhook_id", d.WebhookID).Err(err).Msg("webhook delivery failed")
+		return &d
+	}
+	d.Status = PENDING
+	d.NextAttempt = time.Now().Add(Backoff(d.Attempts))
+	return &d
+}
+
+func (w *Worker) post(ctx context.Context, a *Attempt) (int, error) {
+	signingSecret, err := w.signingSecret(a)
+	if err != nil {
+		return 0, err
+	}
+	payload := []byte(a.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vex-webhooks")
+	req.Header.Set(EventHeader, string(a.EventType))
+	req.Header.Set(DeliveryHeader, a.ID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(signingSecret, now, payload))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// signingSecret decrypts the secret of the webhook, secrets stored before encryption was enabled are used as is
+func (w *Worker) signingSecret(a *Attempt) (string, error) {
+	if !secret.IsEncrypted(a.Secret) {
+		return a.Secret, nil
+	}
+	if w.secrets == nil {
+		return "", errors.New("webhook secret is encrypted but no secret key is configured")
+	}
+	plaintext, err := w.secrets.Decrypt(a.Secret)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Backoff is the delay before retrying a delivery after the number of attempts, doubling up to an hour
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := baseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return d
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/broswen/vex/internal/event"
+	"github.com/broswen/vex/internal/secret"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWorker_Deliver(t *testing.T) {
+	payload := `{"id":"1","type":"flag.updated"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		if r.Header.Get(SignatureHeader) != Sign("secret", time.Unix(ts, 0), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, string(event.FlagUpdated), r.Header.Get(EventHeader))
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	key, err := secret.GenerateKey()
+	assert.Nil(t, err)
+	secrets, err := secret.NewCipher(base64.StdEncoding.EncodeToString(key))
+	assert.Nil(t, err)
+	encrypted, err := secrets.Encrypt([]byte("secret"))
+	assert.Nil(t, err)
+
+	store := NewMockStore()
+	store.On("Claim", mock.Anything, int64(10), lease).Return([]*Attempt{
+		{Delivery: Delivery{ID: "1", EventType: event.FlagUpdated, Payload: payload, Attempts: 1}, URL: server.URL + "/ok", Secret: "secret"},
+		{Delivery: Delivery{ID: "2", EventType: event.FlagUpdated, Payload: payload, Attempts: 2}, URL: server.URL + "/fail", Secret: "secret"},
+		{Delivery: Delivery{ID: "3", EventType: event.FlagUpdated, Payload: payload, Attempts: MaxAttempts}, URL: server.URL + "/fail", Secret: "secret"},
+		{Delivery: Delivery{ID: "4", EventType: event.FlagUpdated, Payload: payload, Attempts: 1}, URL: server.URL + "/ok", Secret: "wrong"},
+		{Delivery: Delivery{ID: "5", EventType: event.FlagUpdated, Payload: payload, Attempts: 1}, URL: server.URL + "/ok", Secret: encrypted},
+	}, nil)
+	results := make(map[string]*Delivery)
+	store.On("Complete", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		d := args.Get(1).(*Delivery)
+		results[d.ID] = d
+	}).Return(nil)
+
+	w := NewWorker(store, server.Client(), secrets, 10)
+	start := time.Now()
+	assert.Nil(t, w.Deliver(context.Background()))
+
+	assert.Equal(t, SUCCEEDED, results["1"].Status)
+	assert.Equal(t, http.StatusNoContent, results["1"].ResponseStatus)
+
+	assert.Equal(t, PENDING, results["2"].Status)
+	assert.Equal(t, http.StatusInternalServerError, results["2"].ResponseStatus)
+	assert.True(t, results["2"].NextAttempt.After(start.Add(Backoff(2)-time.Second)))
+	assert.NotEmpty(t, results["2"].Error)
+
+	assert.Equal(t, FAILED, results["3"].Status)
+
+	assert.Equal(t, PENDING, results["4"].Status)
+	assert.Equal(t, http.StatusUnauthorized, results["4"].ResponseStatus)
+
+	//encrypted secrets are decrypted before signing
+	assert.Equal(t, SUCCEEDED, results["5"].Status)
+}
+
+func TestNewClient_ForbiddenAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	//the test server listens on loopback, which deliveries must not reach
+	_, err := NewClient(time.Second).Get(server.URL)
+	assert.ErrorAs(t, err, &ErrForbiddenAddress{})
+}
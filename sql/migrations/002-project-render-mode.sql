@@ -0,0 +1,3 @@
+alter table project add column render_mode text not null default 'FLAT';
+
+alter table project add constraint project_render_mode check (render_mode in ('FLAT', 'NESTED'));
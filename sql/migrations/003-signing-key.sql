@@ -0,0 +1,12 @@
+create table signing_key (
+    id text primary key,
+    public_key bytea not null,
+    created_on timestamptz not null default now(),
+    modified_on timestamptz not null default now()
+);
+
+create trigger signing_key_modified_on
+    before update or insert
+    on signing_key
+    for each row
+execute procedure update_modified_on();
@@ -0,0 +1,4 @@
+alter type FLAGTYPE add value 'SECRET';
+
+-- project payload keys are encrypted with the server envelope key, empty if secrets aren't included in the config
+alter table project add column payload_key text not null default '';
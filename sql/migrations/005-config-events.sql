@@ -0,0 +1,25 @@
+create table config_event (
+    id bigserial primary key,
+    project_id uuid not null,
+    account_id uuid not null,
+    event_type text not null,
+    config text not null,
+    created_on timestamptz not null default now()
+);
+
+create index if not exists config_event_project_id on config_event(project_id, id);
+create index if not exists config_event_created_on on config_event(created_on);
+
+-- notify every server replica of new events, the payload is only the event id because notifications are limited to 8000 bytes
+create or replace function notify_config_event() returns trigger as $$
+    begin
+        perform pg_notify('config_event', NEW.id::text);
+        return NEW;
+    end;
+$$ language plpgsql;
+
+create trigger config_event_notify
+    after insert
+    on config_event
+    for each row
+execute procedure notify_config_event();
@@ -0,0 +1,13 @@
+-- version is incremented every time the flags of a project change,
+-- changes up to pruned_version have been deleted and can't be used to compute a delta
+alter table project add column version bigint not null default 0;
+alter table project add column pruned_version bigint not null default 0;
+
+create table flag_change (
+    project_id uuid not null references project(id) on delete cascade,
+    version bigint not null,
+    flag_key text not null,
+    change_type text not null check (change_type in ('CREATED', 'UPDATED', 'DELETED')),
+    created_on timestamptz not null default now(),
+    primary key (project_id, version, flag_key)
+);
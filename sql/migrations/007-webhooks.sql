@@ -0,0 +1,43 @@
+create table webhook (
+    id uuid default uuid_generate_v4() primary key,
+    account_id uuid not null references account(id) on delete cascade,
+    url text not null,
+    secret text not null,
+    -- an empty list subscribes to every event type
+    event_types text[] not null default '{}',
+    created_on timestamptz not null default now(),
+    modified_on timestamptz not null default now()
+);
+
+create index if not exists webhook_account_id on webhook(account_id);
+
+create table webhook_delivery (
+    id uuid default uuid_generate_v4() primary key,
+    webhook_id uuid not null references webhook(id) on delete cascade,
+    account_id uuid not null references account(id) on delete cascade,
+    event_id uuid not null,
+    event_type text not null,
+    payload text not null,
+    status text not null default 'PENDING' check (status in ('PENDING', 'SUCCEEDED', 'FAILED')),
+    attempts int not null default 0,
+    next_attempt timestamptz not null default now(),
+    response_status int not null default 0,
+    error text not null default '',
+    created_on timestamptz not null default now(),
+    modified_on timestamptz not null default now()
+);
+
+create index if not exists webhook_delivery_webhook_id on webhook_delivery(webhook_id, created_on);
+create index if not exists webhook_delivery_pending on webhook_delivery(next_attempt) where status = 'PENDING';
+
+create trigger webhook_modified_on
+    before update or insert
+    on webhook
+    for each row
+execute procedure update_modified_on();
+
+create trigger webhook_delivery_modified_on
+    before update or insert
+    on webhook_delivery
+    for each row
+execute procedure update_modified_on();
@@ -0,0 +1,32 @@
+-- provisioning events for deployments that use postgres instead of kafka, events are kept so provisioners can catch up after downtime
+create table provision_event (
+    id bigserial primary key,
+    event_type text not null check (event_type in ('PROVISION_PROJECT', 'DEPROVISION_PROJECT', 'PROVISION_TOKEN', 'DEPROVISION_TOKEN')),
+    project_id uuid,
+    account_id uuid,
+    token_id uuid,
+    token_hash bytea,
+    created_on timestamptz not null default now()
+);
+
+create index if not exists provision_event_created_on on provision_event(created_on);
+
+-- the last event each consumer has handled
+create table provision_cursor (
+    consumer text primary key,
+    event_id bigint not null,
+    modified_on timestamptz not null default now()
+);
+
+create or replace function notify_provision_event() returns trigger as $$
+    begin
+        perform pg_notify('provision_event', NEW.id::text);
+        return NEW;
+    end;
+$$ language plpgsql;
+
+create trigger provision_event_notify
+    after insert
+    on provision_event
+    for each row
+execute procedure notify_provision_event();
@@ -0,0 +1,29 @@
+-- provisioning events written in the same transaction as the flag, project and token changes,
+-- the server relays them to the provision bus and deletes them once they are sent
+create table provision_outbox (
+    id bigserial primary key,
+    event_type text not null check (event_type in ('PROVISION_PROJECT', 'DEPROVISION_PROJECT', 'PROVISION_TOKEN', 'DEPROVISION_TOKEN')),
+    project_id uuid,
+    account_id uuid,
+    token_id uuid,
+    token_hash bytea,
+    attempts int not null default 0,
+    -- messages are claimed by moving available_on forward, failed messages are retried after a backoff
+    available_on timestamptz not null default now(),
+    created_on timestamptz not null default now()
+);
+
+create index if not exists provision_outbox_available_on on provision_outbox(available_on, id);
+
+create or replace function notify_provision_outbox() returns trigger as $$
+    begin
+        perform pg_notify('provision_outbox', NEW.id::text);
+        return NEW;
+    end;
+$$ language plpgsql;
+
+create trigger provision_outbox_notify
+    after insert
+    on provision_outbox
+    for each row
+execute procedure notify_provision_outbox();
@@ -0,0 +1,7 @@
+-- accounts that a resync has provisioned, an interrupted resync skips them when it is run again with the same name
+create table resync_account (
+    resync text not null,
+    account_id uuid not null,
+    created_on timestamptz not null default now(),
+    primary key (resync, account_id)
+);
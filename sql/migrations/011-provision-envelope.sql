@@ -0,0 +1,3 @@
+-- the project version and reason are sent with provisioning events so consumers can skip stale events
+alter table provision_outbox add column version bigint not null default 0;
+alter table provision_outbox add column reason text not null default '';
@@ -0,0 +1,3 @@
+-- the latest project version that the provisioner has written to the edge
+alter table project add column provisioned_version bigint not null default 0;
+alter table project add column provisioned_on timestamptz;
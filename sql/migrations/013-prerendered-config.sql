@@ -0,0 +1,21 @@
+-- the raw flags of each project as a single document keyed by flag key, updated in the same transaction as the flags
+-- so the provisioner reads one row instead of listing every flag, configs are still rendered from it on every provision
+create table project_config (
+    project_id uuid primary key references project(id) on delete cascade,
+    flags jsonb not null default '{}'::jsonb,
+    modified_on timestamptz not null default now()
+);
+
+insert into project_config (project_id, flags)
+select p.id, coalesce(jsonb_object_agg(f.flag_key, jsonb_build_object(
+        'id', f.id,
+        'project_id', f.project_id,
+        'account_id', f.account_id,
+        'created_on', f.created_on,
+        'modified_on', f.modified_on,
+        'key', f.flag_key,
+        'type', f.flag_type,
+        'value', f.flag_value
+    )) filter (where f.id is not null), '{}'::jsonb)
+from project p left join flag f on f.project_id = p.id
+group by p.id;
@@ -0,0 +1,5 @@
+-- the content hashes of the configs last rendered for a project and the project version they were rendered for,
+-- so the version endpoint doesn't render the project on every poll
+alter table project add column rendered_version bigint not null default 0;
+alter table project add column config_hash text not null default '';
+alter table project add column config_hash_v2 text not null default '';
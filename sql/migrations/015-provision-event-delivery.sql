@@ -0,0 +1,24 @@
+-- events are claimed by each consumer group until they are handled instead of being read after an id cursor,
+-- event ids are assigned before commit so an event with a lower id can become visible after a cursor has passed it
+create table provision_event_delivery (
+    consumer text not null references provision_cursor(consumer) on delete cascade,
+    event_id bigint not null references provision_event(id) on delete cascade,
+    available_on timestamptz not null default now(),
+    handled_on timestamptz,
+    primary key (consumer, event_id)
+);
+
+create index if not exists provision_event_delivery_unhandled on provision_event_delivery(consumer, event_id) where handled_on is null;
+
+-- provision_cursor registers the consumer groups, event_id is the latest event when the group was registered
+insert into provision_event_delivery (consumer, event_id)
+select c.consumer, e.id from provision_cursor c join provision_event e on e.id > c.event_id;
+
+-- every inserted event is queued for each consumer group in the same transaction
+create or replace function notify_provision_event() returns trigger as $$
+    begin
+        insert into provision_event_delivery (consumer, event_id) select consumer, NEW.id from provision_cursor;
+        perform pg_notify('provision_event', NEW.id::text);
+        return NEW;
+    end;
+$$ language plpgsql;
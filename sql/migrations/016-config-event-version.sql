@@ -0,0 +1,5 @@
+-- events are ordered and resumed by the project version instead of the event id, ids are assigned before commit
+-- so an event with a lower id can become visible after a client has seen a higher one
+alter table config_event add column version bigint not null default 0;
+
+create index if not exists config_event_project_version on config_event(project_id, version);
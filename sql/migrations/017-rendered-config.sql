@@ -0,0 +1,7 @@
+-- the configs rendered from the flag document and their content hashes, written in the same transaction as the flags,
+-- render mode or payload key so the provisioner reads one row and writes it as is
+alter table project_config add column rendered_version bigint not null default 0;
+alter table project_config add column config bytea not null default '';
+alter table project_config add column config_v2 bytea not null default '';
+alter table project_config add column config_hash text not null default '';
+alter table project_config add column config_hash_v2 text not null default '';
@@ -1,4 +1,4 @@
-import {getToken, handleRequest} from "@/index";
+import {assemble, Env, etagMatches, getMetadata, getToken, handleRequest, toHex} from "@/index";
 
 
 test("should get bearer token", () => {
@@ -12,4 +12,34 @@ test("should not get bearer token", () => {
   const request = new Request("https://test.com")
   const token = getToken(request)
   expect(token).toBeNull()
-})
\ No newline at end of file
+})
+
+test("should get metadata from account id", () => {
+  expect(getMetadata('abc123')).toEqual({account_id: 'abc123'})
+})
+
+test("should get signed metadata", () => {
+  const metadata = {account_id: 'abc123', kid: 'key1', signature: 'sig'}
+  expect(getMetadata(metadata)).toEqual(metadata)
+})
+
+test("should match etag", () => {
+  expect(etagMatches('"abc"', '"abc"')).toBeTruthy()
+  expect(etagMatches('W/"abc", "def"', '"abc"')).toBeTruthy()
+  expect(etagMatches('"def"', '"abc"')).toBeFalsy()
+  expect(etagMatches(null, '"abc"')).toBeFalsy()
+})
+
+test("should assemble sharded config", async () => {
+  const config = new TextEncoder().encode('{"feature1":{"value":"true","type":"BOOLEAN"}}\n')
+  const hash = toHex(await crypto.subtle.digest({name: 'SHA-256'}, config))
+  const shards: Record<string, ArrayBuffer> = {
+    'shards/1/a/0': config.slice(0, 16).buffer,
+    'shards/1/a/1': config.slice(16).buffer,
+  }
+  const env = {FLAG: {get: async (key: string) => shards[key] ?? null}} as unknown as Env
+  const manifest = {hash, size: config.byteLength, shards: Object.keys(shards)}
+  expect(await assemble(manifest, env)).toEqual(config)
+  expect(await assemble({...manifest, hash: 'wrong'}, env)).toBeNull()
+  expect(await assemble({...manifest, shards: ['shards/1/a/0', 'shards/1/a/2']}, env)).toBeNull()
+})
@@ -4,9 +4,26 @@ export type Env = {
   TOKEN: KVNamespace
 }
 
+export type Metadata = {
+  account_id: string
+  hash?: string
+  kid?: string
+  signature?: string
+  //set when the value is a manifest of the shards that a large config is split into
+  shards?: number
+}
+
+export type Manifest = {
+  hash: string
+  size: number
+  shards: string[]
+}
+
 export async function handleRequest(request: Request, env: Env) {
   const url = new URL(request.url);
-  const projectId = url.pathname.slice(1)
+  //v2 configs are requested with /v2/{projectId} and stored under the same key
+  const key = url.pathname.slice(1)
+  const projectId = key.startsWith('v2/') ? key.slice(3) : key
   const token = getToken(request)
 
   //reject if no bearer token
@@ -18,8 +35,7 @@ export async function handleRequest(request: Request, env: Env) {
   const tokenBytes = new TextEncoder().encode(token)
   //get SHA256 digest of token bytes
   const tokenHash = await crypto.subtle.digest({name: 'SHA-256'}, tokenBytes)
-  //convert bytes into uint8 array, convert each byte to hex representation, join into hex string
-  const hashedToken = Array.from(new Uint8Array(tokenHash)).map(b => b.toString(16).padStart(2, '0')).join('')
+  const hashedToken = toHex(tokenHash)
   //reject if token not in kv
   const tokenAccount = await getTokenAccount(hashedToken, env)
   if (!tokenAccount) {
@@ -30,10 +46,11 @@ export async function handleRequest(request: Request, env: Env) {
   if (projectId.length !== 36) {
     return new Response('invalid project id', {status: 400})
   }
-  const getWithMetadataResult = await env.FLAG.getWithMetadata(projectId)
+  const getWithMetadataResult = await env.FLAG.getWithMetadata<Metadata | string>(key)
+  const metadata = getMetadata(getWithMetadataResult.metadata)
 
   //reject if bearer token account id doesn't match project account id from metadata
-  if (getWithMetadataResult.metadata !== tokenAccount) {
+  if (metadata.account_id !== tokenAccount) {
     return new Response('unauthorized', {status: 401})
   }
 
@@ -41,7 +58,31 @@ export async function handleRequest(request: Request, env: Env) {
   if (getWithMetadataResult.value === null) {
     return new Response('not found', {status: 404})
   }
-  return new Response(getWithMetadataResult.value)
+  const headers = new Headers()
+  //the content hash is used as the etag so pollers can skip unchanged configs
+  if (metadata.hash) {
+    const etag = `"${metadata.hash}"`
+    headers.set('ETag', etag)
+    if (etagMatches(request.headers.get('If-None-Match'), etag)) {
+      return new Response(null, {status: 304, headers})
+    }
+  }
+  let value: string | Uint8Array = getWithMetadataResult.value
+  //large configs are stored as a manifest of shards
+  if (metadata.shards) {
+    const config = await assemble(JSON.parse(value) as Manifest, env)
+    //the shards were replaced by a newer config while they were read
+    if (config === null) {
+      return new Response('config is being updated', {status: 503, headers: {'Retry-After': '1'}})
+    }
+    value = config
+  }
+  //signed configs include the signature and key id so clients can verify them against the published keys
+  if (metadata.signature && metadata.kid) {
+    headers.set('X-Vex-Signature', metadata.signature)
+    headers.set('X-Vex-Key-Id', metadata.kid)
+  }
+  return new Response(value, {headers})
 }
 
 const worker: { fetch: (request: Request, env: Env) => Promise<Response> } = { fetch: handleRequest };
@@ -63,4 +104,49 @@ export function getToken(request: Request): string | null {
 export async function getTokenAccount(token: string, env: Env): Promise<string | null> {
   const accountId = await env.TOKEN.get(token)
   return accountId
-}
\ No newline at end of file
+}
+
+//convert bytes into uint8 array, convert each byte to hex representation, join into hex string
+export function toHex(buffer: ArrayBuffer): string {
+  return Array.from(new Uint8Array(buffer)).map(b => b.toString(16).padStart(2, '0')).join('')
+}
+
+//read the shards of a manifest in order, null if a shard is missing or they don't match the manifest hash
+export async function assemble(manifest: Manifest, env: Env): Promise<Uint8Array | null> {
+  const shards = await Promise.all(manifest.shards.map(key => env.FLAG.get(key, 'arrayBuffer')))
+  const config = new Uint8Array(manifest.size)
+  let offset = 0
+  for (const shard of shards) {
+    if (shard === null || offset + shard.byteLength > manifest.size) {
+      return null
+    }
+    config.set(new Uint8Array(shard), offset)
+    offset += shard.byteLength
+  }
+  if (offset !== manifest.size) {
+    return null
+  }
+  const hash = await crypto.subtle.digest({name: 'SHA-256'}, config)
+  if (toHex(hash) !== manifest.hash) {
+    return null
+  }
+  return config
+}
+
+//older configs were provisioned with just the account id as metadata
+export function getMetadata(metadata: Metadata | string | null): Metadata {
+  if (metadata === null) {
+    return {account_id: ''}
+  }
+  if (typeof metadata === 'string') {
+    return {account_id: metadata}
+  }
+  return metadata
+}
+
+export function etagMatches(header: string | null, etag: string): boolean {
+  if (!header) {
+    return false
+  }
+  return header.split(',').map(t => t.trim().replace(/^W\//, '')).some(t => t === '*' || t === etag)
+}